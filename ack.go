@@ -0,0 +1,78 @@
+// ack.go - Acknowledgement frames telling senders whether a message was accepted
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Nack error codes
+const (
+	nackInvalidPayload = "invalid_payload"
+	nackNotMember      = "not_member"
+	nackMuted          = "muted"
+	nackStorageFailed  = "storage_failed"
+	nackNotFound       = "not_found"
+	nackNotSender      = "not_sender"
+	nackEditWindow     = "edit_window_closed"
+)
+
+// Ack is returned to the sender for every accepted message
+type Ack struct {
+	MessageType string    `json:"messageType"`         // "ack"
+	ID          string    `json:"id"`                  // the client's message id
+	MessageID   string    `json:"messageId,omitempty"` // set when another sender had the id: the message's id from now on
+	ToID        string    `json:"toId"`
+	Timestamp   time.Time `json:"timestamp"` // server assigned
+	Seq         int64     `json:"seq"`
+	Status      string    `json:"status"` // "sent", or "delivered" once the recipient has it
+}
+
+// Nack is returned to the sender when a message is rejected
+type Nack struct {
+	MessageType string `json:"messageType"` // "nack"
+	ID          string `json:"id"`
+	Code        string `json:"code"`
+	Error       string `json:"error"`
+}
+
+// sendAck confirms msg to the client that sent it
+func sendAck(sender *Client, msg Message) {
+	ack := Ack{
+		MessageType: "ack",
+		ID:          senderMessageID(msg.ID, msg.ClientID),
+		ToID:        msg.ToID,
+		Timestamp:   msg.Timestamp,
+		Seq:         msg.Seq,
+		Status:      msg.Status,
+	}
+	if msg.ClientID != "" {
+		ack.MessageID = msg.ID
+	}
+	sender.SendWait(ack)
+}
+
+// sendNack tells the client that the message with messageID was rejected
+func sendNack(sender *Client, messageID, code, reason string) {
+	nack := Nack{
+		MessageType: "nack",
+		ID:          messageID,
+		Code:        code,
+		Error:       reason,
+	}
+	sender.SendWait(nack)
+}
+
+// answerStoreError tells the sender why storing a message failed. A
+// resubmission is not an error for the client: stored is the original message
+// and its ack is replayed so retries never deliver twice.
+func answerStoreError(sender *Client, messageID string, stored Message, err error) {
+	switch {
+	case errors.Is(err, ErrDuplicateMessage):
+		log.Printf("Replaying ack for duplicate message %s from %s", messageID, sender.ID)
+		sendAck(sender, stored)
+	default:
+		sendNack(sender, messageID, nackStorageFailed, "Message could not be stored")
+	}
+}
@@ -0,0 +1,226 @@
+// auth.go - User registration, login and session tokens
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Sessions are opaque random tokens. Only their SHA-256 is stored, so a leaked
+// database does not leak usable tokens. Clients send the token as
+// "Authorization: Bearer <token>"; browsers cannot set headers on a websocket
+// upgrade, so /ws/:id also accepts it as ?token=. Nothing else does: query
+// strings end up in access logs and browser history.
+//
+// Registration needs the claim handed out with the id by /api/generate-id
+// (see ids.go).
+
+// ErrUserExists is returned when registering a user id that is already taken
+var ErrUserExists = errors.New("user already exists")
+
+// sessionTTL is how long a login stays valid
+var sessionTTL = 30 * 24 * time.Hour
+
+// Password length limits; bcrypt ignores everything past 72 bytes
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// Session is what register and login return
+type Session struct {
+	Token     string    `json:"token"`
+	UserID    string    `json:"userId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// credentials is the body of register and login requests
+type credentials struct {
+	UserID   string `json:"userId"`
+	Password string `json:"password"`
+	Claim    string `json:"claim,omitempty"` // register only
+}
+
+// hashToken derives the stored form of a session token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns 256 random bits, encoded for use in URLs
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueSession creates a session for userID
+func issueSession(userID string) (Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{
+		Token:     token,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(sessionTTL).UTC(),
+	}
+	return session, authStore.CreateSession(hashToken(session.Token), userID, session.ExpiresAt)
+}
+
+// bearerToken returns the token of the Authorization header, if any
+func bearerToken(c *fiber.Ctx) string {
+	if token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// authenticate resolves a session token to a user id
+func authenticate(token string) (string, error) {
+	if token == "" {
+		return "", ErrNotFound
+	}
+	userID, expiresAt, err := authStore.GetSession(hashToken(token))
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(expiresAt) {
+		authStore.DeleteSession(hashToken(token))
+		return "", ErrNotFound
+	}
+	return userID, nil
+}
+
+// requireAuth rejects requests without a valid session and records the
+// caller's id for authUser
+func requireAuth(c *fiber.Ctx) error {
+	return authorize(c, bearerToken(c))
+}
+
+// requireSocketAuth is requireAuth for websocket upgrades, which may also
+// carry the token as ?token=
+func requireSocketAuth(c *fiber.Ctx) error {
+	token := bearerToken(c)
+	if token == "" {
+		token = c.Query("token")
+	}
+	return authorize(c, token)
+}
+
+// authorize continues with the user of token as the caller, or rejects the request
+func authorize(c *fiber.Ctx, token string) error {
+	userID, err := authenticate(token)
+	if err == ErrNotFound {
+		return c.Status(401).JSON(fiber.Map{"error": "Authentication required"})
+	}
+	if err != nil {
+		log.Printf("Error checking session: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	c.Locals("userID", userID)
+	return c.Next()
+}
+
+// authUser returns the id of the authenticated caller
+func authUser(c *fiber.Ctx) string {
+	userID, _ := c.Locals("userID").(string)
+	return userID
+}
+
+// handleRegister creates a user with a password and logs them in
+func handleRegister(c *fiber.Ctx) error {
+	var req credentials
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.UserID == "" || strings.HasPrefix(req.UserID, "GROUP_") {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid user id"})
+	}
+	if len(req.Password) < minPasswordLength {
+		return c.Status(400).JSON(fiber.Map{"error": "Password is too short"})
+	}
+	if len(req.Password) > maxPasswordLength {
+		return c.Status(400).JSON(fiber.Map{"error": "Password is too long"})
+	}
+
+	claimed, err := checkClaim(req.UserID, req.Claim)
+	if err != nil {
+		log.Printf("Error checking the claim on user id %s: %v", req.UserID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if !claimed {
+		return c.Status(403).JSON(fiber.Map{"error": "User id was not issued to you or its claim expired"})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to register"})
+	}
+	err = authStore.CreateUser(req.UserID, string(hash))
+	if err == ErrUserExists {
+		return c.Status(409).JSON(fiber.Map{"error": "User id is already registered"})
+	}
+	if err != nil {
+		log.Printf("Error registering %s: %v", req.UserID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	session, err := issueSession(req.UserID)
+	if err != nil {
+		log.Printf("Error creating session for %s: %v", req.UserID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.Status(201).JSON(session)
+}
+
+// handleLogin exchanges a user id and password for a session token
+func handleLogin(c *fiber.Ctx) error {
+	var req credentials
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	hash, err := authStore.GetPasswordHash(req.UserID)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error loading credentials of %s: %v", req.UserID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if err == ErrNotFound || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user id or password"})
+	}
+
+	session, err := issueSession(req.UserID)
+	if err != nil {
+		log.Printf("Error creating session for %s: %v", req.UserID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(session)
+}
+
+// handleLogout ends the session used for the request
+func handleLogout(c *fiber.Ctx) error {
+	if err := authStore.DeleteSession(hashToken(bearerToken(c))); err != nil {
+		log.Printf("Error deleting session: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// setupAuthRoutes registers the routes that work without a session
+func setupAuthRoutes(app *fiber.App) {
+	app.Post("/api/auth/register", handleRegister)
+	app.Post("/api/auth/login", handleLogin)
+}
@@ -0,0 +1,305 @@
+// client.go - Connected clients and their outbound frame queues
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// The websocket library allows only one concurrent writer per connection, so
+// every frame for a client goes through its queue and a single writer
+// goroutine. Other clients never block on a slow client: when a queue is full,
+// presence frames are dropped (the next one supersedes them) and anything
+// else disconnects the client, which then catches up from history. Replies
+// sent from the client's own read loop wait for room instead, so a large
+// history replay only slows down the client that asked for it.
+//
+// The writer also pings every PingInterval. A client that sends nothing, not
+// even a pong, for PongTimeout is taken for dead: its read deadline expires and
+// it is cleaned up like any other disconnect.
+//
+// Only the connection handler and the writer touch Conn. The handler waits for
+// the writer to exit before returning, since the connection is recycled as
+// soon as it does; anyone else who wants the connection closed asks the writer
+// to send the close frame.
+
+// connectionConfig holds the tunables for client connections
+type connectionConfig struct {
+	SendQueue    int           // frames buffered per client
+	WriteTimeout time.Duration // deadline for writing one frame
+	PingInterval time.Duration // time between pings
+	PongTimeout  time.Duration // silence after which a client is dropped
+}
+
+var wsConfig = connectionConfig{
+	SendQueue:    256,
+	WriteTimeout: 10 * time.Second,
+	PingInterval: 25 * time.Second,
+	PongTimeout:  60 * time.Second,
+}
+
+// Client is one connected device of a user
+type Client struct {
+	ID       string // user id
+	DeviceID string // empty for devices that did not identify themselves
+	Conn     *websocket.Conn
+
+	send       chan interface{}
+	done       chan struct{}
+	closeOnce  sync.Once
+	draining   chan struct{} // closed to make the writer flush the queue and hang up
+	drainOnce  sync.Once
+	readMu     sync.Mutex    // orders read deadline changes against stopReading
+	writerDone chan struct{} // closed once the writer no longer uses Conn
+
+	hangUpMu    sync.Mutex
+	closeCode   int // close frame the writer sends when it stops, if set
+	closeReason string
+}
+
+// newClient wraps conn and starts its writer. The caller registers it in clients.
+func newClient(userID, deviceID string, conn *websocket.Conn) *Client {
+	client := &Client{
+		ID:         userID,
+		DeviceID:   deviceID,
+		Conn:       conn,
+		send:       make(chan interface{}, wsConfig.SendQueue),
+		done:       make(chan struct{}),
+		draining:   make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+	go client.writePump()
+	return client
+}
+
+// writePump writes queued frames and pings until the client is closed
+func (c *Client) writePump() {
+	defer close(c.writerDone)
+	ticker := time.NewTicker(wsConfig.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case frame := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(wsConfig.WriteTimeout))
+			err = c.Conn.WriteJSON(frame)
+		case <-ticker.C:
+			err = c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsConfig.WriteTimeout))
+		case <-c.draining:
+			c.flush()
+			return
+		case <-c.done:
+			c.sendClose()
+			return
+		}
+		if err != nil {
+			log.Printf("Error writing to %s, disconnecting: %v", c.ID, err)
+			c.close()
+			c.stopReading()
+			return
+		}
+	}
+}
+
+// flush writes what is still queued, then closes the connection as going away
+func (c *Client) flush() {
+	for {
+		select {
+		case frame := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(wsConfig.WriteTimeout))
+			if err := c.Conn.WriteJSON(frame); err != nil {
+				log.Printf("Error flushing to %s: %v", c.ID, err)
+				c.close()
+				c.stopReading()
+				return
+			}
+		default:
+			c.hangUp(websocket.CloseGoingAway, "Server is shutting down")
+			c.sendClose()
+			return
+		}
+	}
+}
+
+// goAway queues a final frame and makes the writer flush and hang up
+func (c *Client) goAway(frame interface{}) {
+	c.enqueue(frame)
+	c.drainOnce.Do(func() { close(c.draining) })
+}
+
+// keepAlive arms the read deadline that reaps dead connections. Pongs and
+// frames from the client push it back.
+func (c *Client) keepAlive() {
+	c.Conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+	c.extendReadDeadline()
+}
+
+// extendReadDeadline gives the client another PongTimeout to show it is alive
+func (c *Client) extendReadDeadline() {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if !c.closed() {
+		c.Conn.SetReadDeadline(time.Now().Add(wsConfig.PongTimeout))
+	}
+}
+
+// Send queues a frame that must not be lost. A client whose queue is full is
+// disconnected. It reports whether the frame was queued.
+func (c *Client) Send(frame interface{}) bool {
+	if c.enqueue(frame) {
+		return true
+	}
+	if !c.closed() {
+		log.Printf("Send queue of %s is full, disconnecting", c.ID)
+		c.hangUp(websocket.CloseTryAgainLater, "Send queue overflow")
+	}
+	return false
+}
+
+// SendPresence queues a presence or typing frame, dropping it if the queue is
+// full
+func (c *Client) SendPresence(frame interface{}) bool {
+	if c.enqueue(frame) {
+		return true
+	}
+	if !c.closed() {
+		log.Printf("Send queue of %s is full, dropping presence update", c.ID)
+	}
+	return false
+}
+
+// SendWait queues a frame, waiting while the queue is full. Only the client's
+// own read loop may wait on it; the write deadline bounds the wait.
+func (c *Client) SendWait(frame interface{}) bool {
+	select {
+	case c.send <- frame:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Client) enqueue(frame interface{}) bool {
+	if c.closed() {
+		return false
+	}
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the writer; frames still queued are discarded
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// hangUp closes the client and has the writer send a close frame with code.
+// The first code given wins.
+func (c *Client) hangUp(code int, reason string) {
+	c.hangUpMu.Lock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeReason = code, reason
+	}
+	c.hangUpMu.Unlock()
+	c.close()
+}
+
+// sendClose sends the close frame asked for by hangUp, if any, and ends the
+// read loop in handleWebSocket, which then cleans the client up. Only the
+// writer calls it.
+func (c *Client) sendClose() {
+	c.hangUpMu.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.hangUpMu.Unlock()
+
+	if code != 0 {
+		deadline := time.Now().Add(wsConfig.WriteTimeout)
+		c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	}
+	c.stopReading()
+}
+
+// stopReading makes the pending read fail. Closing the connection would not:
+// fasthttp only closes hijacked connections once the handler returns.
+func (c *Client) stopReading() {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+// registerClient adds a device and reports whether it is the user's first
+func registerClient(client *Client) bool {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	clients[client.ID] = append(clients[client.ID], client)
+	return len(clients[client.ID]) == 1
+}
+
+// unregisterClient removes a device and reports whether it was the user's last
+func unregisterClient(client *Client) bool {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	devices := clients[client.ID]
+	for i, device := range devices {
+		if device == client {
+			devices = append(devices[:i:i], devices[i+1:]...)
+			break
+		}
+	}
+	if len(devices) == 0 {
+		delete(clients, client.ID)
+		return true
+	}
+	clients[client.ID] = devices
+	return false
+}
+
+// userClients returns the connected devices of a user. Devices that
+// disconnect meanwhile are closed first, so frames sent to them are dropped.
+func userClients(userID string) []*Client {
+	clientsMux.RLock()
+	defer clientsMux.RUnlock()
+	return clients[userID]
+}
+
+// sendToUser queues a frame on every device of a user and reports whether any
+// device took it
+func sendToUser(userID string, frame interface{}) bool {
+	sent := false
+	for _, device := range userClients(userID) {
+		if device.Send(frame) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+// sendToOtherDevices queues a frame on the user's devices other than client,
+// keeping them in step with what was done on client
+func sendToOtherDevices(client *Client, frame interface{}) {
+	for _, device := range userClients(client.ID) {
+		if device != client {
+			device.Send(frame)
+		}
+	}
+}
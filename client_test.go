@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestFanOutWhileDevicesComeAndGo(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	aliceConn := dial(t, addr, alice)
+
+	var dialers, senders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		dialers.Add(1)
+		go func() {
+			defer dialers.Done()
+			for j := 0; j < 10; j++ {
+				conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/"+bob.UserID+"?token="+bob.Token, nil)
+				if err != nil {
+					t.Errorf("dialing as bob: %v", err)
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	done := make(chan struct{})
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
+		event := TypingEvent{MessageType: "typing", FromID: alice.UserID, ToID: bob.UserID}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				sendToUser(bob.UserID, event)
+				sendTypingEvent(bob.UserID, event)
+			}
+		}
+	}()
+
+	for j := 0; j < 20; j++ {
+		msg := Message{ID: "m" + string(rune('a'+j)), FromID: alice.UserID, ToID: bob.UserID, Content: "hi"}
+		if err := aliceConn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		readUntil(t, aliceConn, func(f map[string]interface{}) bool { return f["messageType"] == "ack" && f["id"] == msg.ID })
+	}
+	dialers.Wait()
+	close(done)
+	senders.Wait()
+}
+
+// queuedClient is a client whose writer never runs, so its queue fills up
+func queuedClient(size int) *Client {
+	return &Client{ID: "bob", send: make(chan interface{}, size), done: make(chan struct{})}
+}
+
+func TestFullSendQueue(t *testing.T) {
+	t.Run("presence is dropped", func(t *testing.T) {
+		client := queuedClient(1)
+		if !client.SendPresence("first") || client.SendPresence("second") {
+			t.Error("the second presence frame was queued")
+		}
+		if client.closed() {
+			t.Error("a dropped presence frame disconnected the client")
+		}
+	})
+	t.Run("anything else disconnects", func(t *testing.T) {
+		client := queuedClient(2)
+		for i := 0; i < 2; i++ {
+			if !client.Send(i) {
+				t.Fatalf("frame %d did not fit the queue", i)
+			}
+		}
+		if client.Send(2) {
+			t.Fatal("a frame beyond the queue was taken")
+		}
+		if !client.closed() || client.closeCode != websocket.CloseTryAgainLater {
+			t.Errorf("overflow left the client closed=%v with close code %d", client.closed(), client.closeCode)
+		}
+		if client.Send(3) || client.SendPresence(4) || client.SendWait(5) {
+			t.Error("a disconnected client took another frame")
+		}
+	})
+}
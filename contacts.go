@@ -0,0 +1,236 @@
+// contacts.go - Contact lists and blocking
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Blocking is one-sided: once A blocks B, B's direct messages, calls and
+// group invitations no longer reach A. B is not told. B's messages are stored
+// like any other, with a sequence number, and show on B's devices and in B's
+// history, but are hidden from A; edits B makes are not pushed or listed to
+// A. B cannot tell a block from a recipient who never comes online.
+
+// maxNicknameLength bounds the nickname given to a contact
+const maxNicknameLength = 64
+
+// Contact is an entry in a user's contact list
+type Contact struct {
+	ContactID   string    `json:"contactId"`
+	Nickname    string    `json:"nickname"`
+	AddedAt     time.Time `json:"addedAt"`
+	DisplayName string    `json:"displayName,omitempty"` // from the contact's profile
+}
+
+// BlockedUser is an entry in a user's block list
+type BlockedUser struct {
+	UserID    string    `json:"userId"`
+	BlockedAt time.Time `json:"blockedAt"`
+}
+
+// blockedBy reports whether recipientID has blocked senderID. Traffic is let
+// through when the block list cannot be read.
+func blockedBy(recipientID, senderID string) bool {
+	if recipientID == senderID {
+		return false
+	}
+	blocked, err := contactStore.IsBlocked(recipientID, senderID)
+	if err != nil {
+		log.Printf("Error checking whether %s blocked %s: %v", recipientID, senderID, err)
+		return false
+	}
+	return blocked
+}
+
+// visibleTo reports whether userID may see the message: hidden messages exist
+// only for their sender
+func (m *Message) visibleTo(userID string) bool {
+	return !m.Hidden || m.FromID == userID
+}
+
+// visibleTo reports whether userID may see the edit
+func (e *MessageEdit) visibleTo(userID string) bool {
+	return !e.Hidden || e.FromID == userID
+}
+
+// withoutBlockers drops the users that have blocked senderID
+func withoutBlockers(userIDs []string, senderID string) []string {
+	allowed := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if blockedBy(userID, senderID) {
+			log.Printf("Not inviting %s, who blocked %s", userID, senderID)
+			continue
+		}
+		allowed = append(allowed, userID)
+	}
+	return allowed
+}
+
+// Refusals for contact and block targets, answered through denyRequest
+var (
+	errSelfTarget  = &denial{400, "Cannot add or block yourself"}
+	errUnknownUser = &denial{404, "User not found"}
+)
+
+// checkTarget makes sure a contact or block target is another, real user
+func checkTarget(callerID, targetID string) error {
+	if targetID == callerID {
+		return errSelfTarget
+	}
+	issued, err := idStore.IsIssued(targetID)
+	if err != nil {
+		return err
+	}
+	if !issued {
+		return errUnknownUser
+	}
+	return nil
+}
+
+// handleGetContacts lists the caller's contacts
+func handleGetContacts(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	contacts, err := contactStore.GetContacts(userID)
+	if err != nil {
+		log.Printf("Error loading contacts of %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	contactIDs := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		contactIDs = append(contactIDs, contact.ContactID)
+	}
+	names := displayNames(contactIDs)
+	for i := range contacts {
+		contacts[i].DisplayName = names[contacts[i].ContactID]
+	}
+	return c.JSON(contacts)
+}
+
+// handlePutContact adds a contact or changes its nickname
+func handlePutContact(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	contactID := c.Params("contactId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	var req struct {
+		Nickname string `json:"nickname"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	req.Nickname = strings.TrimSpace(req.Nickname)
+	if utf8.RuneCountInString(req.Nickname) > maxNicknameLength {
+		return c.Status(400).JSON(fiber.Map{"error": "Nickname is too long"})
+	}
+	if err := checkTarget(userID, contactID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	contact, err := contactStore.SaveContact(userID, contactID, req.Nickname)
+	if err != nil {
+		log.Printf("Error saving contact %s of %s: %v", contactID, userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	contact.DisplayName = displayName(contactID)
+	republishPresence(userID)
+	return c.JSON(contact)
+}
+
+// handleDeleteContact removes a contact
+func handleDeleteContact(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	contactID := c.Params("contactId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	err := contactStore.RemoveContact(userID, contactID)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Contact not found"})
+	}
+	if err != nil {
+		log.Printf("Error removing contact %s of %s: %v", contactID, userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	republishPresence(userID)
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// handleGetBlocks lists the users the caller has blocked
+func handleGetBlocks(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	blocked, err := contactStore.GetBlocked(userID)
+	if err != nil {
+		log.Printf("Error loading blocks of %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(blocked)
+}
+
+// handleBlockUser blocks a user
+func handleBlockUser(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	blockedID := c.Params("blockedId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+	if err := checkTarget(userID, blockedID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	if err := contactStore.Block(userID, blockedID); err != nil {
+		log.Printf("Error blocking %s for %s: %v", blockedID, userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	log.Printf("User %s blocked %s", userID, blockedID)
+	republishPresence(userID)
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// handleUnblockUser lifts a block
+func handleUnblockUser(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	blockedID := c.Params("blockedId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	err := contactStore.Unblock(userID, blockedID)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "User is not blocked"})
+	}
+	if err != nil {
+		log.Printf("Error unblocking %s for %s: %v", blockedID, userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	republishPresence(userID)
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// setupContactRoutes registers the contact and block list routes
+func setupContactRoutes(app *fiber.App) {
+	app.Get("/api/users/:userId/contacts", handleGetContacts)
+	app.Put("/api/users/:userId/contacts/:contactId", handlePutContact)
+	app.Delete("/api/users/:userId/contacts/:contactId", handleDeleteContact)
+	app.Get("/api/users/:userId/blocks", handleGetBlocks)
+	app.Put("/api/users/:userId/blocks/:blockedId", handleBlockUser)
+	app.Delete("/api/users/:userId/blocks/:blockedId", handleUnblockUser)
+}
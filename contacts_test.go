@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// historyIDs joins the ids in session's history with contactID
+func historyIDs(t *testing.T, app *fiber.App, session Session, contactID string) string {
+	t.Helper()
+	var history struct {
+		Messages []Message `json:"messages"`
+	}
+	path := "/api/messages/" + session.UserID + "?contactId=" + contactID
+	if status := callAPI(t, app, "GET", path, session.Token, nil, &history); status != 200 {
+		t.Fatalf("history answered %d", status)
+	}
+	var ids []string
+	for _, msg := range history.Messages {
+		ids = append(ids, msg.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestBlockedSenderIsHidden(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	aliceConn, bobConn := dialQuery(t, addr, alice, "&sync=true"), dialQuery(t, addr, bob, "&sync=true")
+	isAck := func(frame map[string]interface{}) bool { return frame["messageType"] == "ack" }
+
+	sendFrame(t, aliceConn, Message{ID: "before", ToID: bob.UserID, Content: "hi"})
+	readUntil(t, aliceConn, isAck)
+	readUntil(t, bobConn, func(frame map[string]interface{}) bool { return frame["id"] == "before" })
+
+	if status := callAPI(t, app, "PUT", "/api/users/"+bob.UserID+"/blocks/"+alice.UserID, bob.Token, nil, nil); status != 200 {
+		t.Fatalf("blocking answered %d", status)
+	}
+
+	// Alice's message is acknowledged like any other but never reaches bob
+	sendFrame(t, aliceConn, Message{ID: "blocked", ToID: bob.UserID, Content: "are you there?"})
+	ack := readUntil(t, aliceConn, isAck)
+	if ack["id"] != "blocked" || ack["seq"] != float64(2) {
+		t.Errorf("ack of the hidden message: %v", ack)
+	}
+	sendFrame(t, bobConn, Message{ID: "marker", ToID: alice.UserID, Content: "hello?"})
+	readUntil(t, bobConn, func(frame map[string]interface{}) bool {
+		if frame["id"] == "blocked" {
+			t.Errorf("bob got the message of a blocked sender: %v", frame)
+		}
+		return isAck(frame)
+	})
+
+	if got := historyIDs(t, app, alice, bob.UserID); got != "before,blocked,marker" {
+		t.Errorf("alice's history: %s", got)
+	}
+	if got := historyIDs(t, app, bob, alice.UserID); got != "before,marker" {
+		t.Errorf("bob's history: %s", got)
+	}
+	if ids, _ := syncOnce(t, bobConn, SyncRequest{Cursors: map[string]int64{alice.UserID: 0}}); ids != "before,marker" {
+		t.Errorf("bob's sync sent %s", ids)
+	}
+
+	// Unblocking lets new messages through but keeps the hidden one hidden
+	if status := callAPI(t, app, "DELETE", "/api/users/"+bob.UserID+"/blocks/"+alice.UserID, bob.Token, nil, nil); status != 200 {
+		t.Fatalf("unblocking answered %d", status)
+	}
+	sendFrame(t, aliceConn, Message{ID: "after", ToID: bob.UserID, Content: "hi again"})
+	readUntil(t, bobConn, func(frame map[string]interface{}) bool { return frame["id"] == "after" })
+	if got := historyIDs(t, app, bob, alice.UserID); got != "before,marker,after" {
+		t.Errorf("bob's history after unblocking: %s", got)
+	}
+}
@@ -0,0 +1,294 @@
+// editing.go - Editing sent direct and group messages
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The sender of a message may change its content for editWindow after sending
+// it, with an edit frame over the WebSocket or a PUT on the REST API. The
+// message keeps its id and place in the conversation and is flagged as edited;
+// the content it replaced goes to the edit log, which also serves its history.
+//
+// Each edit is pushed as a message_edited frame to every device of both sides
+// of a direct conversation, or of every group member. Devices that missed it
+// get it on their next sync: sync_complete carries an editCursor into the
+// edit log, which the client sends back with its next sync frame (devices
+// with a deviceId have it remembered) to receive the edits made since.
+
+// editWindow is how long after sending a message its sender may edit it
+var editWindow = 15 * time.Minute
+
+// EditRequest is sent by a client to change the content of one of its messages
+type EditRequest struct {
+	MessageType string      `json:"messageType"` // "edit"
+	ID          string      `json:"id"`          // the message to edit
+	ToID        string      `json:"toId"`        // the message's recipient or group
+	Content     interface{} `json:"content"`
+}
+
+// MessageEdit is one entry of the edit log
+type MessageEdit struct {
+	Seq             int64     `json:"-"` // position in the edit log
+	MessageID       string    `json:"messageId"`
+	GroupID         string    `json:"groupId,omitempty"`
+	FromID          string    `json:"fromId"`
+	ToID            string    `json:"toId"` // recipient, or the group for group messages
+	PreviousContent string    `json:"previousContent"`
+	Content         string    `json:"content"`
+	EditedAt        time.Time `json:"editedAt"`
+	Hidden          bool      `json:"-"` // kept from the recipient, who blocked the sender
+}
+
+// EditEvent tells clients that a message they hold was edited
+type EditEvent struct {
+	MessageType string    `json:"messageType"` // "message_edited"
+	ID          string    `json:"id"`
+	FromID      string    `json:"fromId"`
+	ToID        string    `json:"toId"`
+	Content     string    `json:"content"`
+	EditedAt    time.Time `json:"editedAt"`
+}
+
+// Refusals specific to edits, answered through denyRequest or as nacks
+var (
+	errMessageNotFound = &denial{404, "Message not found"}
+	errEmptyEdit       = &denial{400, "Content is required"}
+)
+
+// event is the frame pushing the edit to clients
+func (e MessageEdit) event() EditEvent {
+	return EditEvent{
+		MessageType: "message_edited",
+		ID:          e.MessageID,
+		FromID:      e.FromID,
+		ToID:        e.ToID,
+		Content:     e.Content,
+		EditedAt:    e.EditedAt,
+	}
+}
+
+// editMessage applies an edit by callerID, tells everyone holding the message
+// and returns the edit
+func editMessage(callerID string, req EditRequest) (MessageEdit, error) {
+	content := encodeContent(req.Content)
+	if strings.TrimSpace(content) == "" {
+		return MessageEdit{}, errEmptyEdit
+	}
+
+	groupID := ""
+	var sender string
+	var sentAt time.Time
+	hidden := false
+	if strings.HasPrefix(req.ToID, "GROUP_") {
+		groupID = req.ToID
+		member, err := activeMember(callerID, groupID)
+		if err != nil {
+			return MessageEdit{}, err
+		}
+		if member.IsMuted {
+			return MessageEdit{}, errMuted
+		}
+		msg, err := groupStore.GetGroupMessage(groupID, req.ID)
+		if err == ErrNotFound {
+			return MessageEdit{}, errMessageNotFound
+		}
+		if err != nil {
+			return MessageEdit{}, err
+		}
+		sender, sentAt = msg.FromID, msg.Timestamp
+	} else {
+		msg, err := messageStore.GetMessage(req.ID)
+		if err == ErrNotFound {
+			return MessageEdit{}, errMessageNotFound
+		}
+		if err != nil {
+			return MessageEdit{}, err
+		}
+		// Messages of other conversations, and those hidden from the caller,
+		// do not exist as far as the caller knows
+		if directConversationID(msg.FromID, msg.ToID) != directConversationID(callerID, req.ToID) || !msg.visibleTo(callerID) {
+			return MessageEdit{}, errMessageNotFound
+		}
+		sender, sentAt = msg.FromID, msg.Timestamp
+		// Edits reach a recipient who blocked the sender no more than messages do
+		hidden = msg.Hidden || blockedBy(req.ToID, callerID)
+	}
+	if err := canEditMessage(callerID, sender, sentAt); err != nil {
+		return MessageEdit{}, err
+	}
+
+	edit, err := editStore.EditMessage(groupID, req.ID, content, time.Now(), hidden)
+	if err == ErrNotFound {
+		return MessageEdit{}, errMessageNotFound
+	}
+	if err != nil {
+		return MessageEdit{}, err
+	}
+	log.Printf("User %s edited message %s", callerID, req.ID)
+	publishEdit(edit)
+	return edit, nil
+}
+
+// publishEdit pushes an edit to the connected devices of both sides of a
+// direct conversation, or of all group members. Hidden edits only go to the
+// sender.
+func publishEdit(edit MessageEdit) {
+	event := edit.event()
+	if edit.GroupID == "" {
+		sendToUser(edit.FromID, event)
+		if !edit.Hidden {
+			sendToUser(edit.ToID, event)
+		}
+		return
+	}
+
+	memberIDs, err := groupStore.GetActiveMemberIDs(edit.GroupID)
+	if err != nil {
+		log.Printf("Error loading members of %s for edit of %s: %v", edit.GroupID, edit.MessageID, err)
+		return
+	}
+	for _, memberID := range memberIDs {
+		sendToUser(memberID, event)
+	}
+}
+
+// handleEdit applies an edit frame from client. The sender's devices get the
+// message_edited frame like everyone else, which confirms the edit.
+func handleEdit(client *Client, req EditRequest) {
+	if req.ID == "" || req.ToID == "" {
+		sendNack(client, req.ID, nackInvalidPayload, "Message id and toId are required")
+		return
+	}
+
+	_, err := editMessage(client.ID, req)
+	if err == nil {
+		return
+	}
+	d, denied := err.(*denial)
+	if !denied {
+		log.Printf("Error editing message %s for %s: %v", req.ID, client.ID, err)
+		sendNack(client, req.ID, nackStorageFailed, "Edit could not be stored")
+		return
+	}
+	code := nackInvalidPayload
+	switch d {
+	case errNotMember:
+		code = nackNotMember
+	case errMuted:
+		code = nackMuted
+	case errMessageNotFound:
+		code = nackNotFound
+	case errNotSender:
+		code = nackNotSender
+	case errEditWindow:
+		code = nackEditWindow
+	}
+	sendNack(client, req.ID, code, d.message)
+}
+
+// handleEditDirectMessage edits a message the caller sent to contactId
+func handleEditDirectMessage(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+	return editFromRequest(c, userID, c.Params("contactId"))
+}
+
+// handleEditGroupMessage edits a message the caller sent to a group
+func handleEditGroupMessage(c *fiber.Ctx) error {
+	return editFromRequest(c, authUser(c), c.Params("groupId"))
+}
+
+// editFromRequest applies the edit in the request body and returns it
+func editFromRequest(c *fiber.Ctx, callerID, toID string) error {
+	var body struct {
+		Content interface{} `json:"content"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	messageID := c.Params("messageId")
+	edit, err := editMessage(callerID, EditRequest{ID: messageID, ToID: toID, Content: body.Content})
+	if err != nil {
+		if _, denied := err.(*denial); denied {
+			return denyRequest(c, err)
+		}
+		log.Printf("Error editing message %s for %s: %v", messageID, callerID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(edit)
+}
+
+// handleGetDirectMessageEdits lists the edits of a message in the caller's
+// conversation with contactId
+func handleGetDirectMessageEdits(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	messageID := c.Params("messageId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	msg, err := messageStore.GetMessage(messageID)
+	if err == ErrNotFound || (err == nil && (directConversationID(msg.FromID, msg.ToID) != directConversationID(userID, c.Params("contactId")) || !msg.visibleTo(userID))) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err != nil {
+		log.Printf("Error loading message %s: %v", messageID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return sendMessageEdits(c, userID, "", messageID)
+}
+
+// handleGetGroupMessageEdits lists the edits of a group message
+func handleGetGroupMessageEdits(c *fiber.Ctx) error {
+	groupID := c.Params("groupId")
+	messageID := c.Params("messageId")
+	if err := canReadGroup(authUser(c), groupID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	_, err := groupStore.GetGroupMessage(groupID, messageID)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err != nil {
+		log.Printf("Error loading message %s: %v", messageID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return sendMessageEdits(c, authUser(c), groupID, messageID)
+}
+
+// sendMessageEdits answers with the edit history of a message as viewerID
+// may see it
+func sendMessageEdits(c *fiber.Ctx, viewerID, groupID, messageID string) error {
+	edits, err := editStore.GetMessageEdits(groupID, messageID)
+	if err != nil {
+		log.Printf("Error querying edits of %s: %v", messageID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	visible := make([]MessageEdit, 0, len(edits))
+	for _, e := range edits {
+		if e.visibleTo(viewerID) {
+			visible = append(visible, e)
+		}
+	}
+	return c.JSON(fiber.Map{
+		"messageId": messageID,
+		"edits":     visible,
+	})
+}
+
+// setupEditRoutes registers the message editing routes
+func setupEditRoutes(app *fiber.App) {
+	app.Put("/api/messages/:userId/:contactId/:messageId", handleEditDirectMessage)
+	app.Get("/api/messages/:userId/:contactId/:messageId/edits", handleGetDirectMessageEdits)
+	app.Put("/api/groups/:groupId/messages/:messageId", handleEditGroupMessage)
+	app.Get("/api/groups/:groupId/messages/:messageId/edits", handleGetGroupMessageEdits)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEditWindowAndSender(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	for _, msg := range []Message{
+		{ID: "old", Timestamp: time.Now().Add(-editWindow - time.Minute)},
+		{ID: "fresh", Timestamp: time.Now()},
+	} {
+		msg.FromID, msg.ToID, msg.Content = alice.UserID, bob.UserID, "first"
+		if _, err := messageStore.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceConn, bobConn := dialQuery(t, addr, alice, "&sync=true"), dialQuery(t, addr, bob, "&sync=true")
+	isNack := func(frame map[string]interface{}) bool { return frame["messageType"] == "nack" }
+
+	sendFrame(t, aliceConn, EditRequest{MessageType: "edit", ID: "old", ToID: bob.UserID, Content: "second"})
+	if nack := readUntil(t, aliceConn, isNack); nack["code"] != nackEditWindow || nack["id"] != "old" {
+		t.Errorf("editing after the window: %v", nack)
+	}
+	path := "/api/messages/" + alice.UserID + "/" + bob.UserID + "/old"
+	if status := callAPI(t, app, "PUT", path, alice.Token, EditRequest{Content: "second"}, nil); status != 403 {
+		t.Errorf("editing after the window over REST answered %d, want 403", status)
+	}
+	sendFrame(t, bobConn, EditRequest{MessageType: "edit", ID: "fresh", ToID: alice.UserID, Content: "second"})
+	if nack := readUntil(t, bobConn, isNack); nack["code"] != nackNotSender {
+		t.Errorf("editing someone else's message: %v", nack)
+	}
+
+	// Both sides get the edit, and the replaced content goes to the edit log
+	sendFrame(t, aliceConn, EditRequest{MessageType: "edit", ID: "fresh", ToID: bob.UserID, Content: "second"})
+	isEdit := func(frame map[string]interface{}) bool { return frame["messageType"] == "message_edited" }
+	for name, event := range map[string]map[string]interface{}{"alice": readUntil(t, aliceConn, isEdit), "bob": readUntil(t, bobConn, isEdit)} {
+		if event["id"] != "fresh" || event["content"] != "second" {
+			t.Errorf("%s got edit %v", name, event)
+		}
+	}
+	var history struct {
+		Edits []MessageEdit `json:"edits"`
+	}
+	path = "/api/messages/" + bob.UserID + "/" + alice.UserID + "/fresh/edits"
+	if status := callAPI(t, app, "GET", path, bob.Token, nil, &history); status != 200 {
+		t.Fatalf("edit history answered %d", status)
+	}
+	if len(history.Edits) != 1 || history.Edits[0].PreviousContent != "first" || history.Edits[0].Content != "second" {
+		t.Errorf("edit history: %+v", history.Edits)
+	}
+	msg, err := messageStore.GetMessage("old")
+	if err != nil || msg.Content != "first" || msg.Edited {
+		t.Errorf("the refused edit changed the message: %+v, %v", msg, err)
+	}
+}
+
+func TestSyncReplaysMissedEdits(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	if _, err := messageStore.SaveMessage(Message{ID: "m1", FromID: alice.UserID, ToID: bob.UserID, Content: "first", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	edit := func(content string) {
+		t.Helper()
+		if _, err := editMessage(alice.UserID, EditRequest{ID: "m1", ToID: bob.UserID, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit("second")
+
+	// The first sync sends the edited message and starts the edit cursor at
+	// the end of the log
+	conn := dialQuery(t, addr, bob, "&sync=true&deviceId=phone")
+	ids, done := syncOnce(t, conn, SyncRequest{})
+	if ids != "m1" || done.EditCursor != 1 {
+		t.Errorf("first sync sent %s with edit cursor %d", ids, done.EditCursor)
+	}
+	conn.Close()
+
+	// Edits made while the device was away come with its next sync
+	edit("third")
+	conn = dialQuery(t, addr, bob, "&sync=true&deviceId=phone")
+	ids, done = syncOnce(t, conn, SyncRequest{})
+	if ids != "edited m1" || done.EditCursor != 2 {
+		t.Errorf("sync after reconnecting sent %s with edit cursor %d", ids, done.EditCursor)
+	}
+
+	// An explicit cursor replays the log from there
+	zero := int64(0)
+	ids, done = syncOnce(t, conn, SyncRequest{Cursors: done.Cursors, EditCursor: &zero})
+	if ids != "edited m1,edited m1" || done.EditCursor != 2 {
+		t.Errorf("sync from edit cursor 0 sent %s with edit cursor %d", ids, done.EditCursor)
+	}
+}
@@ -136,7 +136,7 @@ export const fetchGroupMessagesAsync = createAsyncThunk(
                 return { groupId, messages: localMessages };
             }
 
-            const serverMessages: GroupMessage[] = await response.json();
+            const { messages: serverMessages }: { messages: GroupMessage[] } = await response.json();
 
             // Merge server messages with local (server takes precedence for conflicts)
             const messageMap = new Map<string, GroupMessage>();
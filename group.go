@@ -2,8 +2,7 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -38,8 +37,9 @@ type GroupMember struct {
 // GroupMemberWithDetails includes user information
 type GroupMemberWithDetails struct {
 	GroupMember
-	Username string `json:"username,omitempty"`
-	IsOnline bool   `json:"isOnline"`
+	Username  string `json:"username,omitempty"` // display name from the user's profile
+	AvatarURL string `json:"avatarUrl,omitempty"`
+	IsOnline  bool   `json:"isOnline"`
 }
 
 // GroupMessage represents a message in a group
@@ -53,6 +53,12 @@ type GroupMessage struct {
 	ReadBy    []string       `json:"readBy"`
 	Status    string         `json:"status"`
 	ReplyTo   *ReplyMetadata `json:"replyTo,omitempty"`
+	Seq       int64          `json:"seq,omitempty"`
+	Edited    bool           `json:"edited,omitempty"`
+	EditedAt  *time.Time     `json:"editedAt,omitempty"` // time of the latest edit
+
+	SenderName string `json:"senderName,omitempty"` // filled in from the sender's profile, not stored
+	ClientID   string `json:"-"`                    // the sender's id for the message, when it is stored under another
 }
 
 // AdminAction represents an admin action in a group
@@ -75,68 +81,6 @@ type GroupNotification struct {
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
 }
 
-// Initialize group-related database tables
-func initGroupDB() {
-	// Create groups table
-	createGroupsTableSQL := `
-	CREATE TABLE IF NOT EXISTS groups (
-		id TEXT PRIMARY KEY,
-		name TEXT NOT NULL,
-		description TEXT,
-		created_by TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		avatar_url TEXT
-	);`
-
-	_, err := db.Exec(createGroupsTableSQL)
-	if err != nil {
-		log.Fatal("Error creating groups table:", err)
-	}
-
-	// Create group members table
-	createMembersTableSQL := `
-	CREATE TABLE IF NOT EXISTS group_members (
-		group_id TEXT NOT NULL,
-		user_id TEXT NOT NULL,
-		role TEXT DEFAULT 'member',
-		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		is_muted BOOLEAN DEFAULT FALSE,
-		is_banned BOOLEAN DEFAULT FALSE,
-		PRIMARY KEY (group_id, user_id),
-		FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
-	);`
-
-	_, err = db.Exec(createMembersTableSQL)
-	if err != nil {
-		log.Fatal("Error creating group_members table:", err)
-	}
-
-	// Create group messages table
-	createGroupMessagesTableSQL := `
-	CREATE TABLE IF NOT EXISTS group_messages (
-		id TEXT PRIMARY KEY,
-		group_id TEXT NOT NULL,
-		from_id TEXT NOT NULL,
-		content TEXT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-		delivered BOOLEAN DEFAULT TRUE,
-		read_by TEXT DEFAULT '[]',
-		status TEXT DEFAULT 'sent',
-		reply_to TEXT,
-		FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
-	);`
-
-	_, err = db.Exec(createGroupMessagesTableSQL)
-	if err != nil {
-		log.Fatal("Error creating group_messages table:", err)
-	}
-
-	// Create indexes for performance
-	db.Exec("CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members(user_id)")
-	db.Exec("CREATE INDEX IF NOT EXISTS idx_group_messages_group ON group_messages(group_id)")
-	db.Exec("CREATE INDEX IF NOT EXISTS idx_group_messages_timestamp ON group_messages(timestamp)")
-}
-
 // API Handlers
 
 // handleCreateGroup creates a new group
@@ -151,49 +95,12 @@ func handleCreateGroup(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	req.CreatedBy = authUser(c)
+	req.InitialMembers = withoutBlockers(req.InitialMembers, req.CreatedBy)
 
 	// Generate group ID
 	groupID := "GROUP_" + generateShortID()
 
-	// Start transaction
-	tx, err := db.Begin()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
-	}
-
-	// Create group
-	_, err = tx.Exec(
-		"INSERT INTO groups (id, name, description, created_by) VALUES (?, ?, ?, ?)",
-		groupID, req.Name, req.Description, req.CreatedBy,
-	)
-	if err != nil {
-		tx.Rollback()
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to create group"})
-	}
-
-	// Add creator as admin
-	_, err = tx.Exec(
-		"INSERT INTO group_members (group_id, user_id, role) VALUES (?, ?, 'admin')",
-		groupID, req.CreatedBy,
-	)
-	if err != nil {
-		tx.Rollback()
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to add creator"})
-	}
-
-	// Add initial members
-	for _, userID := range req.InitialMembers {
-		if userID != req.CreatedBy && userID != "" {
-			_, err = tx.Exec(
-				"INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)",
-				groupID, userID,
-			)
-			if err != nil {
-				log.Printf("Failed to add member %s: %v", userID, err)
-			}
-		}
-	}
-
 	group := Group{
 		ID:          groupID,
 		Name:        req.Name,
@@ -203,19 +110,10 @@ func handleCreateGroup(c *fiber.Ctx) error {
 		MemberCount: len(req.InitialMembers) + 1,
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to commit"})
-	}
-
-	// Get the created group with member count
-	group = Group{
-		ID:          groupID,
-		Name:        req.Name,
-		Description: req.Description,
-		CreatedBy:   req.CreatedBy,
-		CreatedAt:   time.Now(),
-		MemberCount: len(req.InitialMembers) + 1,
+	// Create group with the creator as admin and the initial members
+	if err := groupStore.CreateGroup(group, req.InitialMembers); err != nil {
+		log.Printf("Failed to create group %s: %v", groupID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create group"})
 	}
 
 	allMembers := append(req.InitialMembers, req.CreatedBy)
@@ -249,23 +147,14 @@ func handleCreateGroup(c *fiber.Ctx) error {
 }
 
 func notifyUser(userID string, notification GroupNotification) {
-	clientsMux.RLock()
-	client, exists := clients[userID]
-	clientsMux.RUnlock()
-
-	if exists && client.IsOnline {
-		message := map[string]interface{}{
-			"messageType": "group_notification",
-			"groupId":     notification.GroupID,
-			"data":        notification,
-		}
+	message := map[string]interface{}{
+		"messageType": "group_notification",
+		"groupId":     notification.GroupID,
+		"data":        notification,
+	}
 
-		err := client.Conn.WriteJSON(message)
-		if err != nil {
-			log.Printf("Error sending notification to user %s: %v", userID, err)
-		} else {
-			log.Printf("Successfully sent group notification to user %s", userID)
-		}
+	if sendToUser(userID, message) {
+		log.Printf("Successfully sent group notification to user %s", userID)
 	} else {
 		log.Printf("User %s is not online, cannot send notification", userID)
 	}
@@ -274,33 +163,15 @@ func notifyUser(userID string, notification GroupNotification) {
 // handleGetUserGroups returns all groups a user is a member of
 func handleGetUserGroups(c *fiber.Ctx) error {
 	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
 
-	query := `
-		SELECT g.id, g.name, g.description, g.created_by, g.created_at, g.avatar_url,
-			   COUNT(gm.user_id) as member_count
-		FROM groups g
-		JOIN group_members gm ON g.id = gm.group_id
-		WHERE g.id IN (
-			SELECT group_id FROM group_members WHERE user_id = ? AND is_banned = FALSE
-		)
-		GROUP BY g.id
-	`
-
-	rows, err := db.Query(query, userID)
+	groups, err := groupStore.GetUserGroups(userID)
 	if err != nil {
+		log.Printf("Error querying groups for %s: %v", userID, err)
 		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
 	}
-	defer rows.Close()
-
-	var groups []Group
-	for rows.Next() {
-		var g Group
-		err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt, &g.AvatarURL, &g.MemberCount)
-		if err != nil {
-			continue
-		}
-		groups = append(groups, g)
-	}
 
 	return c.JSON(groups)
 }
@@ -308,128 +179,82 @@ func handleGetUserGroups(c *fiber.Ctx) error {
 // handleGetGroupMembers returns all members of a group
 func handleGetGroupMembers(c *fiber.Ctx) error {
 	groupID := c.Params("groupId")
+	if err := canReadGroup(authUser(c), groupID); err != nil {
+		return denyRequest(c, err)
+	}
 
 	// First check if the group exists
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE id = ?)", groupID).Scan(&exists)
+	_, err := groupStore.GetGroup(groupID)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Group not found"})
+	}
 	if err != nil {
 		log.Printf("Error checking group existence: %v", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
 	}
-	if !exists {
-		return c.Status(404).JSON(fiber.Map{"error": "Group not found"})
-	}
-
-	// Updated query - removed the invalid u.id as username part
-	query := `
-        SELECT gm.group_id, gm.user_id, gm.role, gm.joined_at, gm.is_muted, gm.is_banned
-        FROM group_members gm
-        WHERE gm.group_id = ?
-        ORDER BY gm.role DESC, gm.joined_at ASC
-    `
 
-	rows, err := db.Query(query, groupID)
+	groupMembers, err := groupStore.GetMembers(groupID)
 	if err != nil {
 		log.Printf("Error querying group members for %s: %v", groupID, err)
 		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
 	}
-	defer rows.Close()
-
-	var members []GroupMemberWithDetails
-	for rows.Next() {
-		var m GroupMemberWithDetails
-		err := rows.Scan(
-			&m.GroupID, &m.UserID, &m.Role, &m.JoinedAt,
-			&m.IsMuted, &m.IsBanned,
-		)
-		if err != nil {
-			log.Printf("Error scanning member row: %v", err)
-			continue
-		}
 
-		// Check if user is online
-		clientsMux.RLock()
-		_, m.IsOnline = clients[m.UserID]
-		clientsMux.RUnlock()
+	memberIDs := make([]string, 0, len(groupMembers))
+	for _, member := range groupMembers {
+		memberIDs = append(memberIDs, member.UserID)
+	}
+	profiles, err := profileStore.GetProfiles(memberIDs)
+	if err != nil {
+		log.Printf("Error loading member profiles for %s: %v", groupID, err)
+	}
+
+	// If no members array was created, return empty array instead of null
+	members := make([]GroupMemberWithDetails, 0, len(groupMembers))
+	for _, member := range groupMembers {
+		m := GroupMemberWithDetails{GroupMember: member}
 
-		// For now, use UserID as username since we don't have a users table
+		// Online as far as the member lets the caller see it
+		m.IsOnline = presenceFor(authUser(c), m.UserID).Online
+
+		// Members without a profile are shown by their id
 		m.Username = m.UserID
+		if profile, ok := profiles[m.UserID]; ok {
+			m.Username = profile.name()
+			m.AvatarURL = profile.AvatarURL
+		}
 
 		members = append(members, m)
 	}
 
-	// If no members array was created, return empty array instead of null
-	if members == nil {
-		members = []GroupMemberWithDetails{}
-	}
-
 	return c.JSON(members)
 }
 
-// handleGetGroupMessages returns messages for a group
+// handleGetGroupMessages returns one page of a group's messages, paged like
+// handleGetAllMessages with the before, after and limit query parameters
 func handleGetGroupMessages(c *fiber.Ctx) error {
 	groupID := c.Params("groupId")
-	userID := c.Query("userId")
-
-	// Check if user is a member
-	var isMember bool
-	err := db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM group_members WHERE group_id = ? AND user_id = ? AND is_banned = FALSE)",
-		groupID, userID,
-	).Scan(&isMember)
-
-	if err != nil || !isMember {
-		return c.Status(403).JSON(fiber.Map{"error": "Not a member"})
+	if err := canReadGroup(authUser(c), groupID); err != nil {
+		return denyRequest(c, err)
 	}
 
-	query := `
-		SELECT id, group_id, from_id, content, timestamp, delivered, read_by, status, reply_to
-		FROM group_messages
-		WHERE group_id = ?
-		ORDER BY timestamp DESC
-		LIMIT 100
-	`
-
-	rows, err := db.Query(query, groupID)
+	q, err := parseHistoryQuery(c)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
-	defer rows.Close()
-
-	var messages []GroupMessage
-	for rows.Next() {
-		var m GroupMessage
-		var readByJSON string
-		var replyToJSON sql.NullString
-
-		err := rows.Scan(
-			&m.ID, &m.GroupID, &m.FromID, &m.Content,
-			&m.Timestamp, &m.Delivered, &readByJSON, &m.Status, &replyToJSON,
-		)
-		if err != nil {
-			continue
-		}
-
-		// Parse read_by JSON
-		json.Unmarshal([]byte(readByJSON), &m.ReadBy)
 
-		// Parse reply_to if exists
-		if replyToJSON.Valid {
-			var replyTo ReplyMetadata
-			if err := json.Unmarshal([]byte(replyToJSON.String), &replyTo); err == nil {
-				m.ReplyTo = &replyTo
-			}
-		}
-
-		messages = append(messages, m)
+	messages, hasMore, err := groupStore.GetGroupMessagePage(groupID, q)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
 	}
-
-	// Reverse to get chronological order
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	if messages == nil {
+		messages = []GroupMessage{}
 	}
+	messages = withSenderNames(messages)
 
-	return c.JSON(messages)
+	return c.JSON(fiber.Map{
+		"messages":   messages,
+		"nextCursor": nextPageCursor(messages, groupMessageCursor, q, hasMore),
+	})
 }
 
 // handleAddGroupMembers adds new members to a group
@@ -443,31 +268,24 @@ func handleAddGroupMembers(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	req.AddedBy = authUser(c)
 
-	// Check if requester is admin (or remove this check if you want any member to add)
-	var isAdmin bool
-	err := db.QueryRow(
-		"SELECT role = 'admin' FROM group_members WHERE group_id = ? AND user_id = ?",
-		groupID, req.AddedBy,
-	).Scan(&isAdmin)
-
-	// For now, allow any member to add others (you can re-enable admin check later)
-	// if err != nil || !isAdmin {
-	//     return c.Status(403).JSON(fiber.Map{"error": "Not authorized"})
-	// }
+	if err := canAddMembers(req.AddedBy, groupID); err != nil {
+		return denyRequest(c, err)
+	}
+	req.UserIDs = withoutBlockers(req.UserIDs, req.AddedBy)
 
 	// Get group name for notification
 	var groupName string
-	db.QueryRow("SELECT name FROM groups WHERE id = ?", groupID).Scan(&groupName)
+	if group, err := groupStore.GetGroup(groupID); err == nil {
+		groupName = group.Name
+	}
 
 	// Add members
 	successCount := 0
 	for _, userID := range req.UserIDs {
 		if userID != "" {
-			_, err = db.Exec(
-				"INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)",
-				groupID, userID,
-			)
+			err := groupStore.AddMember(groupID, userID)
 			if err == nil {
 				successCount++
 
@@ -514,52 +332,29 @@ func handleAdminAction(c *fiber.Ctx) error {
 	if err := c.BodyParser(&action); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	action.PerformedBy = authUser(c)
 
-	// Verify performer is admin
-	var isAdmin bool
-	err := db.QueryRow(
-		"SELECT role = 'admin' FROM group_members WHERE group_id = ? AND user_id = ?",
-		groupID, action.PerformedBy,
-	).Scan(&isAdmin)
-
-	if err != nil || !isAdmin {
-		return c.Status(403).JSON(fiber.Map{"error": "Not authorized"})
+	if err := canAdministerMember(action.PerformedBy, groupID, action.TargetUserID); err != nil {
+		return denyRequest(c, err)
 	}
 
 	// Perform action
+	var err error
 	switch action.Type {
 	case "mute":
-		_, err = db.Exec(
-			"UPDATE group_members SET is_muted = TRUE WHERE group_id = ? AND user_id = ?",
-			groupID, action.TargetUserID,
-		)
+		err = groupStore.SetMuted(groupID, action.TargetUserID, true)
 	case "unmute":
-		_, err = db.Exec(
-			"UPDATE group_members SET is_muted = FALSE WHERE group_id = ? AND user_id = ?",
-			groupID, action.TargetUserID,
-		)
+		err = groupStore.SetMuted(groupID, action.TargetUserID, false)
 	case "ban":
-		_, err = db.Exec(
-			"UPDATE group_members SET is_banned = TRUE WHERE group_id = ? AND user_id = ?",
-			groupID, action.TargetUserID,
-		)
+		err = groupStore.SetBanned(groupID, action.TargetUserID, true)
 		// Disconnect banned user
 		disconnectUserFromGroup(action.TargetUserID, groupID)
 	case "unban":
-		_, err = db.Exec(
-			"UPDATE group_members SET is_banned = FALSE WHERE group_id = ? AND user_id = ?",
-			groupID, action.TargetUserID,
-		)
+		err = groupStore.SetBanned(groupID, action.TargetUserID, false)
 	case "promote":
-		_, err = db.Exec(
-			"UPDATE group_members SET role = 'admin' WHERE group_id = ? AND user_id = ?",
-			groupID, action.TargetUserID,
-		)
+		err = groupStore.SetRole(groupID, action.TargetUserID, "admin")
 	case "demote":
-		_, err = db.Exec(
-			"UPDATE group_members SET role = 'member' WHERE group_id = ? AND user_id = ?",
-			groupID, action.TargetUserID,
-		)
+		err = groupStore.SetRole(groupID, action.TargetUserID, "member")
 	default:
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid action"})
 	}
@@ -591,33 +386,23 @@ func handleLeaveGroup(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	req.UserID = authUser(c)
 
-	// Check if user is the only admin
-	var adminCount int
-	err := db.QueryRow(
-		"SELECT COUNT(*) FROM group_members WHERE group_id = ? AND role = 'admin'",
-		groupID,
-	).Scan(&adminCount)
+	if err := canLeaveGroup(req.UserID, groupID); err != nil {
+		return denyRequest(c, err)
+	}
 
+	// Check if user is the only admin
+	adminCount, err := groupStore.CountAdmins(groupID)
 	if err == nil && adminCount == 1 {
-		var isAdmin bool
-		db.QueryRow(
-			"SELECT role = 'admin' FROM group_members WHERE group_id = ? AND user_id = ?",
-			groupID, req.UserID,
-		).Scan(&isAdmin)
-
-		if isAdmin {
+		member, err := groupStore.GetMember(groupID, req.UserID)
+		if err == nil && member.Role == "admin" {
 			return c.Status(400).JSON(fiber.Map{"error": "Cannot leave - you are the only admin"})
 		}
 	}
 
 	// Remove from group
-	_, err = db.Exec(
-		"DELETE FROM group_members WHERE group_id = ? AND user_id = ?",
-		groupID, req.UserID,
-	)
-
-	if err != nil {
+	if err := groupStore.RemoveMember(groupID, req.UserID); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to leave group"})
 	}
 
@@ -636,140 +421,85 @@ func handleLeaveGroup(c *fiber.Ctx) error {
 
 // WebSocket message handling for groups
 
-func handleGroupMessage(msg Message) {
+func handleGroupMessage(sender *Client, msg Message) {
 	// Extract group ID from toId (format: GROUP_XXXX)
 	groupID := msg.ToID
 	log.Printf("Handling group message for group: %s from user: %s", groupID, msg.FromID)
 
 	// Check if sender is a valid member and not muted/banned
-	var canSend bool
-	var isMuted bool
-	err := db.QueryRow(
-		"SELECT is_muted = FALSE AND is_banned = FALSE, is_muted FROM group_members WHERE group_id = ? AND user_id = ?",
-		groupID, msg.FromID,
-	).Scan(&canSend, &isMuted)
-
+	member, err := activeMember(msg.FromID, groupID)
 	if err != nil {
-		log.Printf("Error checking member status: %v", err)
-		// Send error back to sender
-		clientsMux.RLock()
-		sender := clients[msg.FromID]
-		clientsMux.RUnlock()
-
-		if sender != nil {
-			errorMsg := "You are not a member of this group"
-			sender.Conn.WriteJSON(Message{
-				ID:      "error_" + msg.ID,
-				Content: errorMsg,
-				FromID:  "system",
-				ToID:    msg.FromID,
-			})
-		}
+		log.Printf("Rejecting group message from non-member %s: %v", msg.FromID, err)
+		sendNack(sender, msg.ID, nackNotMember, "You are not a member of this group")
 		return
 	}
-
-	if !canSend {
-		// Send error back to sender
-		clientsMux.RLock()
-		sender := clients[msg.FromID]
-		clientsMux.RUnlock()
-
-		if sender != nil {
-			errorMsg := "You are not a member of this group"
-			if isMuted {
-				errorMsg = "You are muted in this group"
-			}
-			sender.Conn.WriteJSON(Message{
-				ID:      "error_" + msg.ID,
-				Content: errorMsg,
-				FromID:  "system",
-				ToID:    msg.FromID,
-			})
-		}
+	if member.IsMuted {
+		sendNack(sender, msg.ID, nackMuted, "You are muted in this group")
 		return
 	}
 
 	// Store message
-	readByJSON, _ := json.Marshal([]string{msg.FromID})
-	var replyToJSON sql.NullString
-	if msg.ReplyTo != nil {
-		replyToBytes, _ := json.Marshal(msg.ReplyTo)
-		replyToJSON = sql.NullString{String: string(replyToBytes), Valid: true}
-	}
-
-	contentStr := ""
-	switch content := msg.Content.(type) {
-	case string:
-		contentStr = content
-	case map[string]interface{}:
-		contentBytes, _ := json.Marshal(content)
-		contentStr = string(contentBytes)
-	default:
-		contentBytes, _ := json.Marshal(content)
-		contentStr = string(contentBytes)
+	msg.Status = "sent"
+	groupMsg := GroupMessage{
+		ID:        msg.ID,
+		GroupID:   groupID,
+		FromID:    msg.FromID,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+		ReadBy:    []string{msg.FromID},
+		Status:    msg.Status,
+		ReplyTo:   msg.ReplyTo,
+	}
+	stored, err := groupStore.SaveGroupMessage(groupMsg)
+	if errors.Is(err, ErrMessageIDTaken) {
+		var id string
+		if id, err = newMessageID(msg.ID); err == nil {
+			groupMsg.ClientID, groupMsg.ID = msg.ID, id
+			msg.ClientID, msg.ID = groupMsg.ClientID, groupMsg.ID
+			stored, err = groupStore.SaveGroupMessage(groupMsg)
+		}
 	}
-
-	_, err = db.Exec(
-		"INSERT INTO group_messages (id, group_id, from_id, content, timestamp, read_by, status, reply_to) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		msg.ID, groupID, msg.FromID, contentStr, msg.Timestamp, string(readByJSON), msg.Status, replyToJSON,
-	)
-
 	if err != nil {
 		log.Printf("Failed to store group message: %v", err)
+		answerStoreError(sender, senderMessageID(msg.ID, msg.ClientID), groupMessageForUser(stored, msg.FromID), err)
 		return
 	}
 
 	log.Printf("Stored group message %s in database", msg.ID)
+	msg.Seq = stored.Seq
+	sendAck(sender, msg)
 
 	// Get all group members
-	rows, err := db.Query(
-		"SELECT user_id FROM group_members WHERE group_id = ? AND is_banned = FALSE",
-		groupID,
-	)
+	memberIDs, err := groupStore.GetActiveMemberIDs(groupID)
 	if err != nil {
 		log.Printf("Failed to get group members: %v", err)
 		return
 	}
-	defer rows.Close()
-
-	// Collect all member IDs
-	var memberIDs []string
-	for rows.Next() {
-		var memberID string
-		if err := rows.Scan(&memberID); err != nil {
-			continue
-		}
-		memberIDs = append(memberIDs, memberID)
-	}
 
 	log.Printf("Broadcasting to %d group members", len(memberIDs))
+	senderName := displayName(msg.FromID)
 
 	// Broadcast to all online members
-	clientsMux.RLock()
-	defer clientsMux.RUnlock()
-
 	successCount := 0
 	for _, memberID := range memberIDs {
-		if client, exists := clients[memberID]; exists && client.IsOnline {
-			// Send as regular message so existing client code can handle it
-			err := client.Conn.WriteJSON(Message{
-				ID:         msg.ID,
-				FromID:     msg.FromID,
-				ToID:       groupID,
-				Content:    msg.Content,
-				Timestamp:  msg.Timestamp,
-				Delivered:  true,
-				ReadStatus: memberID == msg.FromID,
-				Status:     "delivered",
-				ReplyTo:    msg.ReplyTo,
-			})
+		// Send as regular message so existing client code can handle it
+		queued := sendToUser(memberID, Message{
+			ID:         msg.ID,
+			FromID:     msg.FromID,
+			ToID:       groupID,
+			Content:    msg.Content,
+			Timestamp:  msg.Timestamp,
+			Delivered:  true,
+			ReadStatus: memberID == msg.FromID,
+			Status:     "delivered",
+			ReplyTo:    msg.ReplyTo,
+			Seq:        msg.Seq,
+			SenderName: senderName,
+		})
 
-			if err != nil {
-				log.Printf("Error sending to member %s: %v", memberID, err)
-			} else {
-				successCount++
-				log.Printf("Successfully sent to member %s", memberID)
-			}
+		if queued {
+			successCount++
+			log.Printf("Successfully sent to member %s", memberID)
 		} else {
 			log.Printf("Member %s is not online", memberID)
 		}
@@ -791,59 +521,37 @@ func generateShortID() string {
 
 func notifyGroupMembers(groupID string, notification GroupNotification) {
 	// Get all group members
-	rows, err := db.Query(
-		"SELECT user_id FROM group_members WHERE group_id = ? AND is_banned = FALSE",
-		groupID,
-	)
+	memberIDs, err := groupStore.GetActiveMemberIDs(groupID)
 	if err != nil {
 		return
 	}
-	defer rows.Close()
 
-	clientsMux.RLock()
-	defer clientsMux.RUnlock()
-
-	for rows.Next() {
-		var memberID string
-		if err := rows.Scan(&memberID); err != nil {
-			continue
-		}
-
-		if client, exists := clients[memberID]; exists && client.IsOnline {
-			client.Conn.WriteJSON(map[string]interface{}{
-				"messageType": "group_notification",
-				"groupId":     groupID,
-				"data":        notification,
-			})
-		}
+	for _, memberID := range memberIDs {
+		sendToUser(memberID, map[string]interface{}{
+			"messageType": "group_notification",
+			"groupId":     groupID,
+			"data":        notification,
+		})
 	}
 }
 
 func disconnectUserFromGroup(userID, groupID string) {
-	clientsMux.RLock()
-	client, exists := clients[userID]
-	clientsMux.RUnlock()
-
-	if exists && client.IsOnline {
-		// Send disconnect notification
-		client.Conn.WriteJSON(map[string]interface{}{
-			"messageType": "group_disconnect",
-			"groupId":     groupID,
-			"reason":      "banned",
-		})
-	}
+	// Send disconnect notification
+	sendToUser(userID, map[string]interface{}{
+		"messageType": "group_disconnect",
+		"groupId":     groupID,
+		"reason":      "banned",
+	})
 }
 
-// Add these routes in main() after initDB()
+// setupGroupRoutes registers the group API routes
 func setupGroupRoutes(app *fiber.App) {
-	// Initialize group database
-	initGroupDB()
-
 	// Group API routes
 	app.Post("/api/groups", handleCreateGroup)
 	app.Get("/api/users/:userId/groups", handleGetUserGroups)
 	app.Get("/api/groups/:groupId/members", handleGetGroupMembers)
 	app.Get("/api/groups/:groupId/messages", handleGetGroupMessages)
+	app.Get("/api/groups/:groupId/messages/:messageId/receipts", handleGetGroupMessageReceipts)
 	app.Post("/api/groups/:groupId/members", handleAddGroupMembers)
 	app.Post("/api/groups/:groupId/admin", handleAdminAction)
 	app.Post("/api/groups/:groupId/leave", handleLeaveGroup)
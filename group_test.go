@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// changedIDs joins the ids of the messages a receipt changed, or describes
+// the error recording it
+func changedIDs(changed []GroupMessage, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	var ids []string
+	for _, msg := range changed {
+		ids = append(ids, msg.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestGroupReadBy(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		group := Group{ID: testGroup, Name: "Test", CreatedBy: "alice", CreatedAt: time.Now()}
+		if err := groupStore.CreateGroup(group, []string{"bob", "carol"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []GroupMessage{
+			{ID: "g1", FromID: "alice"},
+			{ID: "g2", FromID: "alice"},
+			{ID: "g3", FromID: "bob"},
+		} {
+			msg.GroupID, msg.Content, msg.Timestamp = testGroup, msg.ID, time.Now()
+			if _, err := groupStore.SaveGroupMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Members never mark their own messages, and each change is reported once
+		if got := changedIDs(groupStore.MarkGroupReceiptsUpTo(testGroup, "bob", 3, false)); got != "g1,g2" {
+			t.Errorf("bob's delivery up to 3 changed %s", got)
+		}
+		if got := changedIDs(groupStore.MarkGroupReceipts(testGroup, "bob", []string{"g1"}, true)); got != "g1" {
+			t.Errorf("bob reading g1 changed %s", got)
+		}
+		if got := changedIDs(groupStore.MarkGroupReceipts(testGroup, "bob", []string{"g1"}, true)); got != "" {
+			t.Errorf("bob reading g1 again changed %s", got)
+		}
+		if got := changedIDs(groupStore.MarkGroupReceiptsUpTo(testGroup, "carol", 3, true)); got != "g1,g2,g3" {
+			t.Errorf("carol's read up to 3 changed %s", got)
+		}
+
+		wantReadBy := map[string]string{"g1": "bob,carol", "g2": "carol", "g3": "carol"}
+		for id, want := range wantReadBy {
+			msg, err := groupStore.GetGroupMessage(testGroup, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBy := append([]string(nil), msg.ReadBy...)
+			sort.Strings(readBy)
+			if got := strings.Join(readBy, ","); got != want {
+				t.Errorf("%s read by %s, want %s", id, got, want)
+			}
+		}
+
+		receipts, err := groupStore.GetGroupMessageReceipts(testGroup, "g2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := make(map[string]string)
+		for _, receipt := range receipts {
+			switch {
+			case receipt.ReadAt != nil:
+				states[receipt.UserID] = "read"
+			case receipt.DeliveredAt != nil:
+				states[receipt.UserID] = "delivered"
+			}
+		}
+		if len(states) != 2 || states["bob"] != "delivered" || states["carol"] != "read" {
+			t.Errorf("receipts of g2: %v", states)
+		}
+		if _, err := groupStore.GetGroupMessageReceipts(testGroup, "missing"); err != ErrNotFound {
+			t.Errorf("receipts of a missing message returned %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestGroupReceiptEvents(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob, carol := registerUser(t, app), registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	group := Group{ID: testGroup, Name: "Test", CreatedBy: alice.UserID, CreatedAt: time.Now()}
+	if err := groupStore.CreateGroup(group, []string{bob.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := groupStore.SaveGroupMessage(GroupMessage{ID: "g1", GroupID: testGroup, FromID: alice.UserID, Content: "hi", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	aliceConn, bobConn := dialQuery(t, addr, alice, "&sync=true"), dialQuery(t, addr, bob, "&sync=true")
+
+	sendFrame(t, bobConn, ReceiptRequest{MessageType: "receipt", Status: "read", GroupID: testGroup, MessageIDs: []string{"g1"}})
+	event := readUntil(t, aliceConn, isReceipt)
+	if event["groupId"] != testGroup || event["fromId"] != bob.UserID || receiptIDs(event) != "g1" {
+		t.Errorf("group receipt event: %v", event)
+	}
+
+	var history struct {
+		Messages []GroupMessage `json:"messages"`
+	}
+	if status := callAPI(t, app, "GET", "/api/groups/"+testGroup+"/messages", alice.Token, nil, &history); status != 200 {
+		t.Fatalf("group history answered %d", status)
+	}
+	if len(history.Messages) != 1 || strings.Join(history.Messages[0].ReadBy, ",") != bob.UserID {
+		t.Errorf("group history: %+v", history.Messages)
+	}
+
+	path := "/api/groups/" + testGroup + "/messages/g1/receipts"
+	if status := callAPI(t, app, "GET", path, alice.Token, nil, nil); status != 200 {
+		t.Errorf("receipts for a member answered %d", status)
+	}
+	if status := callAPI(t, app, "GET", path, carol.Token, nil, nil); status != 403 {
+		t.Errorf("receipts for a stranger answered %d, want 403", status)
+	}
+}
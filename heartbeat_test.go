@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useShortHeartbeat pings every 100ms and drops clients silent for 400ms
+func useShortHeartbeat(t *testing.T) {
+	saved := wsConfig
+	wsConfig.PingInterval, wsConfig.PongTimeout = 100*time.Millisecond, 400*time.Millisecond
+	t.Cleanup(func() { wsConfig = saved })
+}
+
+func TestHeartbeatKeepsAnsweringClients(t *testing.T) {
+	useShortHeartbeat(t)
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	conn := dialQuery(t, addr, alice, "&sync=true")
+
+	// The reader answers pings while the client sends nothing for a second
+	var pings atomic.Int32
+	defaultPing := conn.PingHandler()
+	conn.SetPingHandler(func(data string) error {
+		pings.Add(1)
+		return defaultPing(data)
+	})
+	frames := make(chan map[string]interface{})
+	go func() {
+		defer close(frames)
+		for {
+			var frame map[string]interface{}
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	time.Sleep(time.Second)
+	if n := pings.Load(); n < 5 {
+		t.Errorf("got %d pings in a second, want about 10", n)
+	}
+
+	sendFrame(t, conn, Message{ID: "m1", ToID: bob.UserID, Content: "still here"})
+	for frame := range frames {
+		if frame["messageType"] == "ack" {
+			return
+		}
+	}
+	t.Error("the connection was dropped although it answered every ping")
+}
+
+func TestHeartbeatDropsSilentClients(t *testing.T) {
+	useShortHeartbeat(t)
+	app := newTestApp(t)
+	alice := registerUser(t, app)
+	addr := serve(t, app)
+	conn := dialQuery(t, addr, alice, "&sync=true")
+
+	// Pings go unanswered
+	conn.SetPingHandler(func(string) error { return nil })
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("the server kept a silent client for 5s")
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("the silent client was dropped after %v, before the pong timeout", elapsed)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(userClients(alice.UserID)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(userClients(alice.UserID)) > 0 {
+		t.Error("the dropped client is still registered")
+	}
+}
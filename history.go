@@ -0,0 +1,186 @@
+// history.go - Cursor based paging through direct and group message history
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// historyCursor identifies a position in a history ordered by (timestamp, id)
+type historyCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// String encodes the cursor as an opaque URL-safe token
+func (c historyCursor) String() string {
+	raw := c.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseHistoryCursor(token string) (*historyCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	timestamp, id, found := strings.Cut(string(raw), "|")
+	if !found {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	ts, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor timestamp")
+	}
+	return &historyCursor{Timestamp: ts, ID: id}, nil
+}
+
+// historyQuery selects one page of history. Without cursors it returns the
+// newest messages; with After alone it walks forward from the cursor, otherwise
+// it walks backward. Pages are always returned in chronological order.
+type historyQuery struct {
+	Before *historyCursor // only messages strictly older than this
+	After  *historyCursor // only messages strictly newer than this
+	Limit  int
+}
+
+func (q historyQuery) forward() bool {
+	return q.After != nil && q.Before == nil
+}
+
+// parseHistoryQuery reads the before, after and limit query parameters
+func parseHistoryQuery(c *fiber.Ctx) (historyQuery, error) {
+	q := historyQuery{Limit: defaultHistoryLimit}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid limit")
+		}
+		q.Limit = min(n, maxHistoryLimit)
+	}
+
+	var err error
+	if before := c.Query("before"); before != "" {
+		if q.Before, err = parseHistoryCursor(before); err != nil {
+			return q, err
+		}
+	}
+	if after := c.Query("after"); after != "" {
+		if q.After, err = parseHistoryCursor(after); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// nextPageCursor returns the cursor continuing past page in the direction of
+// q, or an empty string when there is nothing more to load
+func nextPageCursor[T any](page []T, key func(T) historyCursor, q historyQuery, hasMore bool) string {
+	if !hasMore || len(page) == 0 {
+		return ""
+	}
+	if q.forward() {
+		return key(page[len(page)-1]).String()
+	}
+	return key(page[0]).String()
+}
+
+// sqlClause returns the cursor conditions (prefixed with AND) and the ordering
+// for a query over a table with timestamp and id columns
+func (q historyQuery) sqlClause() (string, []interface{}, string) {
+	var conds strings.Builder
+	var args []interface{}
+	if q.Before != nil {
+		conds.WriteString(" AND (timestamp < ? OR (timestamp = ? AND id < ?))")
+		ts := q.Before.Timestamp.UTC()
+		args = append(args, ts, ts, q.Before.ID)
+	}
+	if q.After != nil {
+		conds.WriteString(" AND (timestamp > ? OR (timestamp = ? AND id > ?))")
+		ts := q.After.Timestamp.UTC()
+		args = append(args, ts, ts, q.After.ID)
+	}
+
+	order := "timestamp DESC, id DESC"
+	if q.forward() {
+		order = "timestamp ASC, id ASC"
+	}
+	return conds.String(), args, order
+}
+
+// trimPage cuts a result fetched with Limit+1 rows in the query order down to
+// the page, reports whether more rows exist and restores chronological order
+func trimPage[T any](items []T, q historyQuery) ([]T, bool) {
+	hasMore := len(items) > q.Limit
+	if hasMore {
+		items = items[:q.Limit]
+	}
+	if !q.forward() {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	return items, hasMore
+}
+
+// trimSeqPage cuts a result fetched with limit+1 rows down to limit and
+// reports whether more rows exist
+func trimSeqPage[T any](items []T, limit int) ([]T, bool) {
+	if len(items) > limit {
+		return items[:limit], true
+	}
+	return items, false
+}
+
+// pageInMemory applies q to an unsorted slice, for stores without a query engine
+func pageInMemory[T any](items []T, key func(T) historyCursor, q historyQuery) ([]T, bool) {
+	less := func(a, b historyCursor) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return a.ID < b.ID
+	}
+
+	var selected []T
+	for _, item := range items {
+		k := key(item)
+		if q.Before != nil && !less(k, *q.Before) {
+			continue
+		}
+		if q.After != nil && !less(*q.After, k) {
+			continue
+		}
+		selected = append(selected, item)
+	}
+
+	// Sort in query order so trimPage keeps the right end of the range
+	sort.SliceStable(selected, func(i, j int) bool {
+		if q.forward() {
+			return less(key(selected[i]), key(selected[j]))
+		}
+		return less(key(selected[j]), key(selected[i]))
+	})
+	if len(selected) > q.Limit+1 {
+		selected = selected[:q.Limit+1]
+	}
+	return trimPage(selected, q)
+}
+
+func messageCursor(msg Message) historyCursor {
+	return historyCursor{Timestamp: msg.Timestamp, ID: msg.ID}
+}
+
+func groupMessageCursor(msg GroupMessage) historyCursor {
+	return historyCursor{Timestamp: msg.Timestamp, ID: msg.ID}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// historyPage is the part of a history answer the tests look at
+type historyPage struct {
+	Messages []struct {
+		ID string `json:"id"`
+	} `json:"messages"`
+	NextCursor string `json:"nextCursor"`
+}
+
+// walkHistory follows nextCursor through path from the first page in the
+// direction of param ("before" or "after") and returns the ids of every page
+func walkHistory(t *testing.T, app *fiber.App, path, token, param, cursor string) [][]string {
+	t.Helper()
+	var pages [][]string
+	for i := 0; i < 10; i++ {
+		url := path + "limit=2"
+		if cursor != "" {
+			url += "&" + param + "=" + cursor
+		}
+		var page historyPage
+		if status := callAPI(t, app, "GET", url, token, nil, &page); status != 200 {
+			t.Fatalf("GET %s answered %d", url, status)
+		}
+		var ids []string
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		pages = append(pages, ids)
+		if page.NextCursor == "" {
+			return pages
+		}
+		cursor = page.NextCursor
+	}
+	t.Fatalf("GET %s never ran out of pages", path)
+	return nil
+}
+
+// pagesString renders pages like "m4,m5|m2,m3|m1"
+func pagesString(pages [][]string) string {
+	parts := make([]string, len(pages))
+	for i, ids := range pages {
+		parts[i] = strings.Join(ids, ",")
+	}
+	return strings.Join(parts, "|")
+}
+
+func TestHistoryCursorRoundTrip(t *testing.T) {
+	cursor := historyCursor{Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC), ID: "a|b"}
+	parsed, err := parseHistoryCursor(cursor.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Timestamp.Equal(cursor.Timestamp) || parsed.ID != cursor.ID {
+		t.Errorf("parsed %v, want %v", *parsed, cursor)
+	}
+	for _, token := range []string{"!!", "bm8tc2VwYXJhdG9y", "bm90IGEgdGltZXxpZA"} {
+		if _, err := parseHistoryCursor(token); err == nil {
+			t.Errorf("parseHistoryCursor(%q) accepted a malformed cursor", token)
+		}
+	}
+}
+
+func TestDirectHistoryPages(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+
+	// m2 and m3 share a timestamp and are ordered by id
+	start := time.Now().Add(-time.Hour)
+	for i, at := range []time.Duration{0, time.Minute, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		msg := Message{ID: "m" + string(rune('1'+i)), FromID: alice.UserID, ToID: bob.UserID, Content: "hi", Timestamp: start.Add(at)}
+		if _, err := messageStore.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := "/api/messages/" + bob.UserID + "?contactId=" + alice.UserID + "&"
+
+	backward := walkHistory(t, app, path, bob.Token, "before", "")
+	if got := pagesString(backward); got != "m4,m5|m2,m3|m1" {
+		t.Errorf("paging backward gave %s", got)
+	}
+
+	first := historyCursor{Timestamp: start, ID: "m1"}.String()
+	forward := walkHistory(t, app, path, bob.Token, "after", first)
+	if got := pagesString(forward); got != "m2,m3|m4,m5" {
+		t.Errorf("paging forward from m1 gave %s", got)
+	}
+
+	if status := callAPI(t, app, "GET", path+"before=!!", bob.Token, nil, nil); status != 400 {
+		t.Errorf("a malformed cursor answered %d, want 400", status)
+	}
+}
+
+func TestGroupHistoryPages(t *testing.T) {
+	app := newTestApp(t)
+	alice := registerUser(t, app)
+	group := Group{ID: testGroup, Name: "Test", CreatedBy: alice.UserID, CreatedAt: time.Now()}
+	if err := groupStore.CreateGroup(group, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		msg := GroupMessage{ID: "g" + string(rune('1'+i)), GroupID: testGroup, FromID: alice.UserID, Content: "hi", Timestamp: start.Add(time.Duration(i) * time.Minute)}
+		if _, err := groupStore.SaveGroupMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages := walkHistory(t, app, "/api/groups/"+testGroup+"/messages?", alice.Token, "before", "")
+	if got := pagesString(pages); got != "g4,g5|g2,g3|g1" {
+		t.Errorf("paging backward gave %s", got)
+	}
+}
@@ -0,0 +1,161 @@
+// ids.go - Issuing user ids from a persistent registry
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every user id is recorded in a registry when it is handed out by
+// /api/generate-id. Generated ids come from crypto/rand and are reserved with
+// a single insert, so two callers can never be given the same id; on a
+// collision a new candidate is drawn.
+//
+// Only the caller who was handed an id can register it: /api/generate-id
+// returns a claim, a one-time secret stored hashed like session tokens, which
+// registration requires within idClaimTTL. Ids in use before accounts
+// existed have no claim; an operator issues one for the rightful owner with
+// `claim-id <id>`.
+
+// idConfig describes the shape of generated user ids
+type idConfig struct {
+	Length   int
+	Alphabet string
+}
+
+var userIDConfig = idConfig{
+	Length:   8,
+	Alphabet: "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+}
+
+// maxIDAttempts bounds the candidates drawn for one id before giving up
+const maxIDAttempts = 20
+
+// idClaimTTL is how long a claim can be redeemed at registration
+var idClaimTTL = 24 * time.Hour
+
+// errIDSpaceExhausted is returned when every candidate drawn was already taken
+var errIDSpaceExhausted = errors.New("no free user id found")
+
+// validate checks the configuration given on the command line
+func (cfg idConfig) validate() error {
+	if cfg.Length < 4 || cfg.Length > 64 {
+		return fmt.Errorf("-id-length must be between 4 and 64")
+	}
+	if len(cfg.Alphabet) < 2 {
+		return fmt.Errorf("-id-alphabet needs at least two characters")
+	}
+	seen := make(map[rune]bool)
+	for _, r := range cfg.Alphabet {
+		if r > 127 || r <= ' ' || r == '/' || r == '?' || r == '#' || r == '%' {
+			return fmt.Errorf("-id-alphabet may only contain printable ASCII characters that are safe in a URL path")
+		}
+		if r == ':' {
+			// Conversation ids and sync cursor keys join user ids with ':'
+			return fmt.Errorf("-id-alphabet may not contain ':'")
+		}
+		if seen[r] {
+			return fmt.Errorf("-id-alphabet contains %q twice", r)
+		}
+		seen[r] = true
+	}
+	return nil
+}
+
+// randomID draws a candidate id with a uniform distribution over the alphabet
+func (cfg idConfig) randomID() (string, error) {
+	size := big.NewInt(int64(len(cfg.Alphabet)))
+	b := make([]byte, cfg.Length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		b[i] = cfg.Alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// IssuedID is what /api/generate-id returns
+type IssuedID struct {
+	ID             string    `json:"id"`
+	Claim          string    `json:"claim"` // required to register the id
+	ClaimExpiresAt time.Time `json:"claimExpiresAt"`
+}
+
+// newClaim draws a claim token and returns it with its expiry
+func newClaim() (string, time.Time, error) {
+	claim, err := randomToken()
+	return claim, time.Now().Add(idClaimTTL).UTC(), err
+}
+
+// issueUserID reserves a user id nobody has been given before and returns it
+// with its claim
+func issueUserID() (IssuedID, error) {
+	claim, expiresAt, err := newClaim()
+	if err != nil {
+		return IssuedID{}, err
+	}
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := userIDConfig.randomID()
+		if err != nil {
+			return IssuedID{}, err
+		}
+		if strings.HasPrefix(id, "GROUP_") {
+			continue
+		}
+		reserved, err := idStore.ReserveID(id, hashToken(claim), expiresAt)
+		if err != nil {
+			return IssuedID{}, err
+		}
+		if reserved {
+			return IssuedID{ID: id, Claim: claim, ClaimExpiresAt: expiresAt}, nil
+		}
+	}
+	return IssuedID{}, errIDSpaceExhausted
+}
+
+// claimLegacyID gives an issued id that has no account a fresh claim and
+// returns it
+func claimLegacyID(ids IDStore, id string) (string, time.Time, error) {
+	claim, expiresAt, err := newClaim()
+	if err != nil {
+		return "", expiresAt, err
+	}
+	err = ids.SetClaim(id, hashToken(claim), expiresAt)
+	if err == ErrNotFound {
+		return "", expiresAt, fmt.Errorf("%s was never issued or already has an account", id)
+	}
+	return claim, expiresAt, err
+}
+
+// checkClaim reports whether claim lets its holder register id
+func checkClaim(id, claim string) (bool, error) {
+	claimHash, expiresAt, err := idStore.GetClaim(id)
+	if err == ErrNotFound || claim == "" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	valid := subtle.ConstantTimeCompare([]byte(claimHash), []byte(hashToken(claim))) == 1
+	return valid && time.Now().Before(expiresAt), nil
+}
+
+// handleGenerateID hands out a fresh user id with its claim
+func handleGenerateID(c *fiber.Ctx) error {
+	issued, err := issueUserID()
+	if err != nil {
+		log.Printf("Error issuing user id: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Could not issue a user id"})
+	}
+	return c.JSON(issued)
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestIDConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     idConfig
+		wantErr bool
+	}{
+		{"defaults", userIDConfig, false},
+		{"too short", idConfig{Length: 3, Alphabet: "AB"}, true},
+		{"too long", idConfig{Length: 65, Alphabet: "AB"}, true},
+		{"one character", idConfig{Length: 8, Alphabet: "A"}, true},
+		{"repeated character", idConfig{Length: 8, Alphabet: "ABA"}, true},
+		{"space", idConfig{Length: 8, Alphabet: "AB "}, true},
+		{"slash", idConfig{Length: 8, Alphabet: "AB/"}, true},
+		{"non-ASCII", idConfig{Length: 8, Alphabet: "ABé"}, true},
+		{"colon", idConfig{Length: 8, Alphabet: "AB:"}, true},
+		{"punctuation", idConfig{Length: 8, Alphabet: "AB-_."}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,21 +1,22 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"log"
-	"math/rand"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type MessageContent struct {
@@ -58,21 +59,19 @@ type Message struct {
 	Delivered  bool           `json:"delivered"`
 	ReadStatus bool           `json:"readStatus"`
 	Status     string         `json:"status"`
-	ReplyTo    *ReplyMetadata `json:"replyTo,omitempty"` // New field for reply information
-}
-
-// Client represents a connected websocket client
-type Client struct {
-	ID       string
-	Conn     *websocket.Conn
-	IsOnline bool
+	ReplyTo    *ReplyMetadata `json:"replyTo,omitempty"`    // New field for reply information
+	Seq        int64          `json:"seq,omitempty"`        // Server assigned, increasing within the conversation
+	SenderName string         `json:"senderName,omitempty"` // Display name of the sender, set on group messages
+	Edited     bool           `json:"edited,omitempty"`
+	EditedAt   *time.Time     `json:"editedAt,omitempty"` // time of the latest edit
+	Hidden     bool           `json:"-"`                  // kept from the recipient, who blocked the sender
+	ClientID   string         `json:"-"`                  // the sender's id for the message, when it is stored under another
 }
 
 // Global variables
 var (
-	clients    = make(map[string]*Client)
+	clients    = make(map[string][]*Client) // user id -> connected devices
 	clientsMux sync.RWMutex
-	db         *sql.DB
 )
 
 type MessageType struct {
@@ -84,8 +83,36 @@ func main() {
 	port := flag.String("port", "443", "Port to run the server on")
 	certFile := flag.String("cert", "", "TLS certificate file path")
 	keyFile := flag.String("key", "", "TLS key file path")
+	storeBackend := flag.String("store", "", "Storage backend: sqlite, postgres or memory (default postgres if -dsn is set, else sqlite)")
+	dbPath := flag.String("db", "./messages.db", "SQLite database file path")
+	dsn := flag.String("dsn", "", "PostgreSQL connection string")
+	autoMigrate := flag.Bool("auto-migrate", true, "Apply pending schema migrations on startup")
+	flag.IntVar(&wsConfig.SendQueue, "send-queue", wsConfig.SendQueue, "Frames buffered per websocket client before it counts as too slow")
+	flag.DurationVar(&wsConfig.WriteTimeout, "write-timeout", wsConfig.WriteTimeout, "Deadline for writing one frame to a websocket client")
+	flag.DurationVar(&wsConfig.PingInterval, "ping-interval", wsConfig.PingInterval, "Time between pings to websocket clients")
+	flag.DurationVar(&wsConfig.PongTimeout, "pong-timeout", wsConfig.PongTimeout, "Silence after which a websocket client is considered dead")
+	flag.DurationVar(&typingSettings.Throttle, "typing-throttle", typingSettings.Throttle, "Minimum time between forwarded typing refreshes per device and chat")
+	flag.DurationVar(&typingSettings.Timeout, "typing-timeout", typingSettings.Timeout, "Time without a typing refresh after which typing stops")
+	flag.DurationVar(&editWindow, "edit-window", editWindow, "How long after sending a message its sender may edit it")
+	flag.DurationVar(&sessionTTL, "session-ttl", sessionTTL, "How long a login session stays valid")
+	flag.IntVar(&userIDConfig.Length, "id-length", userIDConfig.Length, "Length of generated user ids")
+	flag.StringVar(&userIDConfig.Alphabet, "id-alphabet", userIDConfig.Alphabet, "Characters generated user ids are drawn from")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "Time allowed for draining connections on shutdown")
 	flag.Parse()
 
+	if wsConfig.PingInterval <= 0 || wsConfig.PingInterval >= wsConfig.PongTimeout {
+		log.Fatalf("-ping-interval must be positive and shorter than -pong-timeout")
+	}
+	if typingSettings.Throttle < 0 || typingSettings.Throttle >= typingSettings.Timeout {
+		log.Fatalf("-typing-throttle must be shorter than -typing-timeout")
+	}
+	if editWindow <= 0 {
+		log.Fatalf("-edit-window must be positive")
+	}
+	if err := userIDConfig.validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Override with environment variables if present
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		*port = envPort
@@ -96,17 +123,78 @@ func main() {
 	if envKey := os.Getenv("TLS_KEY"); envKey != "" {
 		*keyFile = envKey
 	}
+	if envStore := os.Getenv("STORE_BACKEND"); envStore != "" {
+		*storeBackend = envStore
+	}
+	if envDB := os.Getenv("DB_PATH"); envDB != "" {
+		*dbPath = envDB
+	}
+	if envDSN := os.Getenv("DATABASE_URL"); envDSN != "" {
+		*dsn = envDSN
+	}
+
+	storage := storeConfig{
+		Backend:     *storeBackend,
+		SQLitePath:  *dbPath,
+		PostgresDSN: *dsn,
+		AutoMigrate: *autoMigrate,
+	}
+
+	// `migrate [up|down|status] [version]` manages the schema and exits
+	if flag.Arg(0) == "migrate" {
+		if err := migrateStore(storage, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// `claim-id <id>` prints a claim to register an id that has none and exits
+	if flag.Arg(0) == "claim-id" {
+		if err := claimStoredID(storage, flag.Args()[1:]); err != nil {
+			log.Fatalf("Claim failed: %v", err)
+		}
+		return
+	}
+
+	// Initialize storage
+	initStores(storage)
+
+	app := newApp()
+
+	// Create proper address string
+	addr := fmt.Sprintf("0.0.0.0:%s", *port)
+
+	// Log the server mode and address
+	listenErr := make(chan error, 1)
+	if *certFile != "" && *keyFile != "" {
+		log.Printf("Server starting with HTTPS on %s", addr)
+		go func() { listenErr <- app.ListenTLS(addr, *certFile, *keyFile) }()
+	} else {
+		log.Printf("Server starting on %s (HTTP)", addr)
+		go func() { listenErr <- app.Listen(addr) }()
+	}
 
-	// Initialize random seed
-	rand.Seed(time.Now().UnixNano())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	// Initialize SQLite database
-	initDB()
+	select {
+	case err := <-listenErr:
+		log.Fatalf("Error starting server: %v", err)
+	case sig := <-signals:
+		log.Printf("Received %v", sig)
+		shutdownServer(app, *shutdownTimeout)
+	}
+}
 
+// newApp builds the HTTP application with all routes; the stores must be initialized first
+func newApp() *fiber.App {
 	app := fiber.New(fiber.Config{
 		// Add generous timeouts for WebSocket connections
 		ReadTimeout:  time.Minute * 2,
 		WriteTimeout: time.Minute * 2,
+		// Params and bodies are kept past the request, e.g. as map keys of the
+		// memory store, so they must not alias fasthttp's reused buffers
+		Immutable: true,
 	})
 
 	// Add CORS middleware with permissive settings for development
@@ -121,43 +209,56 @@ func main() {
 	// Serve static files from the build directory
 	app.Static("/", "./build")
 
-	// WebSocket upgrade middleware
+	// WebSocket upgrade middleware; a session may only connect as its own user
 	app.Use("/ws/:id", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			c.Locals("allowed", true)
-			return c.Next()
+		if shuttingDown() {
+			c.Set(fiber.HeaderRetryAfter, "5")
+			return c.Status(503).JSON(fiber.Map{"error": "Server is shutting down"})
+		}
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
 		}
-		return fiber.ErrUpgradeRequired
+		return requireSocketAuth(c)
+	}, func(c *fiber.Ctx) error {
+		if err := canAccessUserData(authUser(c), c.Params("id")); err != nil {
+			return denyRequest(c, err)
+		}
+		issued, err := idStore.IsIssued(c.Params("id"))
+		if err != nil {
+			log.Printf("Error checking user id %s: %v", c.Params("id"), err)
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if !issued {
+			return c.Status(403).JSON(fiber.Map{"error": "User id was never issued"})
+		}
+		c.Locals("allowed", true)
+		return c.Next()
 	})
 
+	// Routes that work without a session; everything else under /api needs one
+	setupAuthRoutes(app)
+	app.Get("/api/generate-id", handleGenerateID)
+	app.Use("/api", requireAuth)
+
 	// API Routes
+	app.Post("/api/auth/logout", handleLogout)
+	setupProfileRoutes(app)
+	setupContactRoutes(app)
+	setupPresenceRoutes(app)
+	setupEditRoutes(app)
 	setupGroupRoutes(app)
 	app.Get("/ws/:id", websocket.New(handleWebSocket))
-	app.Get("/api/generate-id", handleGenerateID)
 	app.Get("/api/status/:id", handleUserStatus)
 	app.Get("/api/messages/:userId", handleGetAllMessages)
 	app.Delete("/api/messages/:userId/:contactId", handleDeleteMessages)
+	app.Get("/api/search", handleSearch)
 
 	// Catch-all route to serve index.html for client-side routing
 	app.Get("/*", func(c *fiber.Ctx) error {
 		return c.SendFile("./build/index.html")
 	})
 
-	// Create proper address string
-	addr := fmt.Sprintf("0.0.0.0:%s", *port)
-
-	// Log the server mode and address
-	if *certFile != "" && *keyFile != "" {
-		log.Printf("Server starting with HTTPS on %s", addr)
-		if err := app.ListenTLS(addr, *certFile, *keyFile); err != nil {
-			log.Fatalf("Error starting HTTPS server: %v", err)
-		}
-	} else {
-		log.Printf("Server starting on %s (HTTP)", addr)
-		if err := app.Listen(addr); err != nil {
-			log.Fatalf("Error starting HTTP server: %v", err)
-		}
-	}
+	return app
 }
 
 func getMessageContentString(content interface{}) string {
@@ -174,171 +275,109 @@ func getMessageContentString(content interface{}) string {
 	}
 }
 
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", "./messages.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Create messages table if it doesn't exist
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS messages (
-        id TEXT PRIMARY KEY,
-        from_id TEXT,
-        to_id TEXT,
-        content TEXT,
-        timestamp DATETIME,
-        delivered BOOLEAN,
-        read_status BOOLEAN,
-        status TEXT DEFAULT 'sent',
-        reply_to TEXT DEFAULT NULL
-    );`
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Add migration to add reply_to column to existing tables
-	_, err = db.Exec("ALTER TABLE messages ADD COLUMN reply_to TEXT DEFAULT NULL")
-	if err != nil {
-		// Column might already exist, ignore the error
-		log.Printf("Column reply_to might already exist: %v", err)
-	}
-}
-
 func handleDeleteMessages(c *fiber.Ctx) error {
 	userID := c.Params("userId")
 	contactID := c.Params("contactId")
-
-	// Start a transaction
-	tx, err := db.Begin()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to start transaction",
-		})
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
 	}
 
 	// Delete messages in both directions
-	deleteQuery := `
-        DELETE FROM messages 
-        WHERE (from_id = ? AND to_id = ?) 
-           OR (from_id = ? AND to_id = ?)
-    `
-
-	_, err = tx.Exec(deleteQuery, userID, contactID, contactID, userID)
-	if err != nil {
-		tx.Rollback()
+	if err := messageStore.DeleteConversation(userID, contactID); err != nil {
+		log.Printf("Error deleting messages between %s and %s: %v", userID, contactID, err)
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete messages",
 		})
 	}
 
-	// Commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to commit transaction",
-		})
-	}
-
 	return c.JSON(fiber.Map{
 		"success": true,
 	})
 }
 
+// handleGetAllMessages returns one page of a user's direct message history.
+// contactId restricts it to a single conversation; before/after take the
+// nextCursor of a previous response and limit caps the page size.
 func handleGetAllMessages(c *fiber.Ctx) error {
 	userID := c.Params("userId")
+	contactID := c.Query("contactId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
 
-	query := `
-    SELECT id, from_id, to_id, content, timestamp, delivered, read_status, reply_to
-    FROM messages
-    WHERE from_id = ? OR to_id = ?
-    ORDER BY timestamp ASC
-    `
+	q, err := parseHistoryQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
-	rows, err := db.Query(query, userID, userID)
+	messages, hasMore, err := messageStore.GetMessagePage(userID, contactID, q)
 	if err != nil {
+		log.Printf("Error fetching messages for %s: %v", userID, err)
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch messages",
 		})
 	}
-	defer rows.Close()
-
-	var messages []Message
-	for rows.Next() {
-		var msg Message
-		var replyToJSON sql.NullString
-		err := rows.Scan(
-			&msg.ID,
-			&msg.FromID,
-			&msg.ToID,
-			&msg.Content,
-			&msg.Timestamp,
-			&msg.Delivered,
-			&msg.ReadStatus,
-			&replyToJSON,
-		)
-		if err != nil {
-			continue
-		}
-
-		// Parse reply_to if it exists
-		if replyToJSON.Valid {
-			var replyTo ReplyMetadata
-			if err := json.Unmarshal([]byte(replyToJSON.String), &replyTo); err == nil {
-				msg.ReplyTo = &replyTo
-			}
-		}
-
-		messages = append(messages, msg)
+	if messages == nil {
+		messages = []Message{}
 	}
 
-	return c.JSON(messages)
-}
-
-func handleGenerateID(c *fiber.Ctx) error {
-	// Generate a 4-character ID
-	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 4)
-	for i := range b {
-		b[i] = chars[rand.Intn(len(chars))]
-	}
 	return c.JSON(fiber.Map{
-		"id": string(b),
+		"messages":   messages,
+		"nextCursor": nextPageCursor(messages, messageCursor, q, hasMore),
 	})
 }
 
 func handleUserStatus(c *fiber.Ctx) error {
 	userID := c.Params("id")
-	clientsMux.RLock()
-	client, exists := clients[userID]
-	clientsMux.RUnlock()
-
-	return c.JSON(fiber.Map{
-		"online": exists && client.IsOnline,
-	})
+	presence := presenceFor(authUser(c), userID)
+	status := fiber.Map{
+		"online":      presence.Online,
+		"displayName": userID,
+	}
+	if presence.State != "" {
+		status["state"] = presence.State
+	}
+	if presence.StatusText != "" {
+		status["statusText"] = presence.StatusText
+	}
+	if presence.LastSeen != nil {
+		status["lastSeen"] = presence.LastSeen
+	}
+	profile, err := profileStore.GetProfile(userID)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error loading profile of %s: %v", userID, err)
+	}
+	if err == nil {
+		status["displayName"] = profile.name()
+		status["avatarUrl"] = profile.AvatarURL
+	}
+	return c.JSON(status)
 }
 
 func handleWebSocket(c *websocket.Conn) {
 	userID := c.Params("id")
 	log.Printf("New WebSocket connection established for user: %s", userID)
 
-	// Register new client
-	client := &Client{
-		ID:       userID,
-		Conn:     c,
-		IsOnline: true,
+	// Upgrades that slipped in as shutdown began are turned away
+	if !trackHandler() {
+		c.WriteJSON(goingAwayFrame())
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down"))
+		return
 	}
+	defer handlerDone()
+
+	// Register new client; a user can be connected from several devices
+	client := newClient(userID, c.Query("deviceId"), c)
+	client.keepAlive()
+	firstDevice := registerClient(client)
 
-	clientsMux.Lock()
-	clients[userID] = client
+	clientsMux.RLock()
 	totalClients := len(clients)
-	clientsMux.Unlock()
+	clientsMux.RUnlock()
 
-	log.Printf("Registered client %s. Total connected clients: %d", userID, totalClients)
+	log.Printf("Registered client %s (device %q). Total connected users: %d", userID, client.DeviceID, totalClients)
 
 	// List all connected clients for debugging
 	clientsMux.RLock()
@@ -349,32 +388,43 @@ func handleWebSocket(c *websocket.Conn) {
 	clientsMux.RUnlock()
 	log.Printf("Currently connected users: %v", connectedUsers)
 
-	// REMOVE THIS LINE - it's trying to unlock an already unlocked mutex
-	// clientsMux.Unlock()
-
-	// Broadcast that user is online
-	log.Printf("Broadcasting online status for user: %s", userID)
-	broadcastUserStatus(userID, true)
+	// The user comes online with their first device
+	if firstDevice {
+		if err := presenceStore.SetOnline(userID); err != nil {
+			log.Printf("Error recording presence for %s: %v", userID, err)
+		}
 
-	// Send all messages
-	log.Printf("Sending all messages for user: %s", userID)
-	sendAllMessages(userID)
+		log.Printf("Broadcasting online status for user: %s", userID)
+		broadcastUserStatus(userID)
+	}
 
-	// Send group messages for user
-	log.Printf("Sending group messages for user: %s", userID)
-	sendGroupMessagesToUser(userID)
+	// Syncing clients ask for what they are missing with a sync frame instead
+	if c.Query("sync") != "true" {
+		// Send all messages
+		log.Printf("Sending all messages for user: %s", userID)
+		sendAllMessages(client)
 
-	// Send current online users status
-	log.Printf("Sending online users status to user: %s", userID)
-	sendCurrentOnlineUsers(client)
+		// Send group messages for user
+		log.Printf("Sending group messages for user: %s", userID)
+		sendGroupMessagesToUser(client)
+	}
 
 	// WebSocket message handling loop
 	for {
 		_, rawMessage, err := c.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			var netErr net.Error
+			switch {
+			case client.closed():
+				log.Printf("Connection of %s closed by the server", userID)
+			case errors.As(err, &netErr) && netErr.Timeout():
+				log.Printf("No heartbeat from %s within %v, dropping connection", userID, wsConfig.PongTimeout)
+			default:
+				log.Printf("Error reading message: %v", err)
+			}
 			break
 		}
+		client.extendReadDeadline()
 
 		var msgTypeCheck map[string]interface{}
 		if err := json.Unmarshal(rawMessage, &msgTypeCheck); err == nil {
@@ -384,9 +434,56 @@ func handleWebSocket(c *websocket.Conn) {
 					log.Printf("Processing WebRTC signaling message from %s", userID)
 					var sigMsg SignalingMessage
 					if err := json.Unmarshal(rawMessage, &sigMsg); err == nil {
+						sigMsg.FromID = userID
 						handleSignalingMessage(sigMsg)
 					}
 					continue
+				case "typing":
+					var req TypingRequest
+					if err := json.Unmarshal(rawMessage, &req); err != nil {
+						sendNack(client, "", nackInvalidPayload, "Invalid typing payload")
+						continue
+					}
+					handleTyping(client, req)
+					continue
+				case "edit":
+					var req EditRequest
+					if err := json.Unmarshal(rawMessage, &req); err != nil {
+						sendNack(client, "", nackInvalidPayload, "Invalid edit payload")
+						continue
+					}
+					handleEdit(client, req)
+					continue
+				case "sync":
+					var req SyncRequest
+					if err := json.Unmarshal(rawMessage, &req); err == nil {
+						handleSync(client, req)
+					}
+					continue
+				case "presence_state":
+					var req PresenceStateRequest
+					if err := json.Unmarshal(rawMessage, &req); err != nil {
+						sendNack(client, "", nackInvalidPayload, "Invalid presence state")
+						continue
+					}
+					handlePresenceState(client, req)
+					continue
+				case "presence_subscribe", "presence_unsubscribe":
+					var req PresenceSubscription
+					if err := json.Unmarshal(rawMessage, &req); err != nil {
+						sendNack(client, "", nackInvalidPayload, "Invalid presence subscription")
+						continue
+					}
+					handlePresenceSubscription(client, req)
+					continue
+				case "receipt":
+					var req ReceiptRequest
+					if err := json.Unmarshal(rawMessage, &req); err != nil {
+						sendNack(client, "", nackInvalidPayload, "Invalid receipt payload")
+						continue
+					}
+					handleReceipt(client, req)
+					continue
 				}
 			}
 		}
@@ -395,15 +492,22 @@ func handleWebSocket(c *websocket.Conn) {
 		var msg Message
 		if err := json.Unmarshal(rawMessage, &msg); err != nil {
 			log.Printf("Error parsing message: %v", err)
+			messageID, _ := msgTypeCheck["id"].(string)
+			sendNack(client, messageID, nackInvalidPayload, "Invalid message payload")
+			continue
+		}
+		if msg.ID == "" || msg.ToID == "" {
+			sendNack(client, msg.ID, nackInvalidPayload, "Message id and toId are required")
 			continue
 		}
 
+		// Messages always come from the authenticated user, whatever the client claims
+		msg.FromID = userID
+
 		log.Printf("Processing message from %s to %s: %+v", msg.FromID, msg.ToID, msg)
 
-		// Ensure timestamp is set
-		if msg.Timestamp.IsZero() {
-			msg.Timestamp = time.Now()
-		}
+		// The server clock orders messages; client timestamps can be skewed
+		msg.Timestamp = time.Now()
 
 		// Ensure status is set
 		if msg.Status == "" {
@@ -413,35 +517,22 @@ func handleWebSocket(c *websocket.Conn) {
 		// Check if this is a group message
 		if strings.HasPrefix(msg.ToID, "GROUP_") {
 			log.Printf("Detected group message - routing to group handler: %s", msg.ToID)
-			handleGroupMessage(msg)
+			stopTyping(client, msg.ToID, false)
+			handleGroupMessage(client, msg)
 			log.Printf("Group message handling complete for message %s", msg.ID)
 			continue
 		}
 
 		switch content := getMessageContentString(msg.Content); content {
-		case "delivered":
-			// Handle delivery confirmation
-			log.Printf("Processing delivery confirmation from %s for message to %s",
-				msg.FromID, msg.ToID)
-			updateMessageStatus(msg.ToID, true, false)
-			msg.Status = "delivered"
-			delivered := deliverMessage(msg)
-			if !delivered {
-				log.Printf("Storing undelivered delivery confirmation")
-				storeMessage(msg)
-			}
-
-		case "read":
-			// Handle read receipt
-			log.Printf("Processing read receipt from %s for message to %s",
-				msg.FromID, msg.ToID)
-			updateMessageStatus(msg.ToID, true, true)
-			msg.Status = "read"
-			delivered := deliverMessage(msg)
-			if !delivered {
-				log.Printf("Storing undelivered read receipt")
-				storeMessage(msg)
-			}
+		case "delivered", "read":
+			// Per-message receipt from an older client: it is taken as a
+			// receipt frame, so the sender gets a receipt event like any other
+			log.Printf("Processing %s receipt from %s for message to %s", content, msg.FromID, msg.ToID)
+			handleReceipt(client, ReceiptRequest{
+				Status:     content,
+				MessageIDs: []string{legacyReceiptTarget(msg.ID)},
+			})
+			continue
 
 		case "status_update":
 			log.Printf("Processing status update from %s", msg.FromID)
@@ -449,150 +540,86 @@ func handleWebSocket(c *websocket.Conn) {
 
 		default:
 			log.Printf("Processing regular message from %s to %s", msg.FromID, msg.ToID)
-			delivered := deliverMessage(msg)
-			if !delivered {
-				log.Printf("Storing undelivered message")
-				storeMessage(msg)
+			stopTyping(client, msg.ToID, false)
+			// Persist before fan-out so history is complete regardless of presence
+			msg.Status = "sent"
+			if err := storeMessage(&msg); err != nil {
+				log.Printf("Not delivering message %s: %v", msg.ID, err)
+				answerStoreError(client, senderMessageID(msg.ID, msg.ClientID), msg, err)
+				continue
 			}
+			if !msg.Hidden && deliverMessage(msg) {
+				updateMessageStatus(msg.ID, true, false)
+				msg.Status = "delivered"
+			}
+			sendAck(client, msg)
+			sendToOtherDevices(client, msg)
 		}
 	}
 
 	// Cleanup when connection closes
-	clientsMux.Lock()
-	if client, exists := clients[userID]; exists {
-		client.IsOnline = false
-		delete(clients, userID)
+	client.close()
+	// The connection is released when this handler returns
+	<-client.writerDone
+	unsubscribePresence(client, nil)
+	stopAllTyping(client)
+	if !unregisterClient(client) {
+		log.Printf("WebSocket connection closed for a device of user: %s", userID)
+		return
+	}
+
+	// The user goes offline with their last device
+	if err := presenceStore.SetOffline(userID, time.Now()); err != nil {
+		log.Printf("Error recording presence for %s: %v", userID, err)
 	}
-	clientsMux.Unlock()
 
 	// Broadcast that user is offline
-	broadcastUserStatus(userID, false)
+	broadcastUserStatus(userID)
 	log.Printf("WebSocket connection closed for user: %s", userID)
 }
 
 func handleSignalingMessage(msg SignalingMessage) {
 	log.Printf("Handling WebRTC signaling message: %v", msg)
-	clientsMux.RLock()
-	recipient, exists := clients[msg.ToID]
-	clientsMux.RUnlock()
-
-	if exists && recipient.Conn != nil {
-		if err := recipient.Conn.WriteJSON(msg); err != nil {
-			log.Printf("Error sending signaling message: %v", err)
-		}
-	} else {
-		log.Printf("Recipient %s not available for signaling message", msg.ToID)
-	}
-}
-
-func broadcastUserStatus(userID string, online bool) {
-	// Create a custom status message structure
-	statusMsg := map[string]interface{}{
-		"id":        "status_" + userID,
-		"content":   "status_update",
-		"fromId":    userID,
-		"toId":      "", // Empty for broadcast messages
-		"status":    map[bool]string{true: "online", false: "offline"}[online],
-		"timestamp": time.Now(),
+	if blockedBy(msg.ToID, msg.FromID) {
+		log.Printf("Dropping signaling message from %s, who is blocked by %s", msg.FromID, msg.ToID)
+		return
 	}
-
-	clientsMux.RLock()
-	defer clientsMux.RUnlock()
-
-	// Broadcast to all connected clients except the user themselves
-	for _, client := range clients {
-		if client.IsOnline && client.ID != userID {
-			err := client.Conn.WriteJSON(statusMsg)
-			if err != nil {
-				log.Printf("Error broadcasting status to %s: %v", client.ID, err)
-			}
-		}
+	if !sendToUser(msg.ToID, msg) {
+		log.Printf("Recipient %s not available for signaling message", msg.ToID)
 	}
 }
 
-func sendAllMessages(userID string) {
-	query := `
-    SELECT id, from_id, to_id, content, timestamp, delivered, read_status, reply_to
-    FROM messages
-    WHERE from_id = ? OR to_id = ?
-    ORDER BY timestamp ASC
-    `
-
-	rows, err := db.Query(query, userID, userID)
+func sendAllMessages(recipient *Client) {
+	messages, err := messageStore.GetUserMessages(recipient.ID)
 	if err != nil {
 		log.Printf("Error querying all messages: %v", err)
 		return
 	}
-	defer rows.Close()
-
-	clientsMux.RLock()
-	recipient := clients[userID]
-	clientsMux.RUnlock()
-
-	if recipient == nil {
-		return
-	}
-
-	// Prepare a transaction for updating message status
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
-		return
-	}
-
-	updateStmt, err := tx.Prepare(`
-        UPDATE messages
-        SET delivered = true
-        WHERE id = ? AND to_id = ? AND delivered = false
-    `)
-	if err != nil {
-		log.Printf("Error preparing update statement: %v", err)
-		tx.Rollback()
-		return
-	}
-	defer updateStmt.Close()
 
-	for rows.Next() {
-		var msg Message
-		var replyToJSON sql.NullString
-		err := rows.Scan(
-			&msg.ID,
-			&msg.FromID,
-			&msg.ToID,
-			&msg.Content,
-			&msg.Timestamp,
-			&msg.Delivered,
-			&msg.ReadStatus,
-			&replyToJSON,
-		)
-		if err != nil {
-			log.Printf("Error scanning message: %v", err)
-			continue
-		}
-
-		// Parse reply_to if it exists
-		if replyToJSON.Valid {
-			var replyTo ReplyMetadata
-			if err := json.Unmarshal([]byte(replyToJSON.String), &replyTo); err == nil {
-				msg.ReplyTo = &replyTo
-			}
-		}
+	sendDirectMessages(recipient, messages)
+}
 
+// sendDirectMessages writes messages to the recipient, marking the ones
+// addressed to them as delivered and confirming delivery to the senders
+func sendDirectMessages(recipient *Client, messages []Message) {
+	userID := recipient.ID
+	for _, msg := range messages {
 		// Send message to user
-		err = recipient.Conn.WriteJSON(msg)
-		if err != nil {
-			log.Printf("Error sending message: %v", err)
-			continue
+		if !recipient.SendWait(msg) {
+			return
 		}
 
 		// If this is a received message that hasn't been delivered yet
 		if msg.ToID == userID && !msg.Delivered {
 			// Mark as delivered in database
-			_, err = updateStmt.Exec(msg.ID, userID)
+			updated, err := messageStore.MarkDelivered(msg.ID, userID)
 			if err != nil {
 				log.Printf("Error updating message status: %v", err)
 				continue
 			}
+			if !updated {
+				continue
+			}
 
 			// Send delivery confirmation to original sender
 			deliveryConfirmation := Message{
@@ -605,67 +632,22 @@ func sendAllMessages(userID string) {
 				Status:    "delivered",
 			}
 
-			clientsMux.RLock()
-			sender := clients[msg.FromID]
-			clientsMux.RUnlock()
-
-			if sender != nil {
-				sender.Conn.WriteJSON(deliveryConfirmation)
-			}
-		}
-	}
-
-	// Commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		tx.Rollback()
-	}
-}
-
-func sendCurrentOnlineUsers(newClient *Client) {
-	clientsMux.RLock()
-	defer clientsMux.RUnlock()
-
-	// Send status of all online users to the new client
-	for clientID, client := range clients {
-		if client.IsOnline && clientID != newClient.ID {
-			statusMsg := Message{
-				ID:      "status_" + clientID,
-				Content: "status_update",
-				FromID:  clientID,
-				Status:  "online",
-			}
-			newClient.Conn.WriteJSON(statusMsg)
+			sendToUser(msg.FromID, deliveryConfirmation)
 		}
 	}
 }
 
 func updateMessageStatus(messageID string, delivered bool, read bool) {
-	query := `
-    UPDATE messages 
-    SET delivered = ?, read_status = ?
-    WHERE id = ?
-    `
-
-	_, err := db.Exec(query, delivered, read, messageID)
-	if err != nil {
+	if err := messageStore.UpdateMessageStatus(messageID, delivered, read); err != nil {
 		log.Printf("Error updating message status: %v", err)
 	}
 }
 
 func deliverMessage(msg Message) bool {
-	clientsMux.RLock()
-	recipient, exists := clients[msg.ToID]
-	clientsMux.RUnlock()
-
-	if exists && recipient.IsOnline {
-		err := recipient.Conn.WriteJSON(msg)
-		if err != nil {
-			log.Printf("Error sending message: %v", err)
-			return false
-		}
-
+	if blockedBy(msg.ToID, msg.FromID) {
+		return false
+	}
+	if sendToUser(msg.ToID, msg) {
 		// Send delivery confirmation to sender if this is a regular message
 		if msg.Content != "delivered" && msg.Content != "read" {
 			deliveryConfirmation := Message{
@@ -678,18 +660,7 @@ func deliverMessage(msg Message) bool {
 				Status:    "delivered",
 			}
 
-			clientsMux.RLock()
-			sender := clients[msg.FromID]
-			clientsMux.RUnlock()
-
-			if sender != nil {
-				sender.Conn.WriteJSON(deliveryConfirmation)
-			}
-		}
-
-		// If this is a read receipt, update the message status in the database
-		if msg.Content == "read" {
-			updateMessageStatus(msg.ID, true, true)
+			sendToUser(msg.FromID, deliveryConfirmation)
 		}
 
 		return true
@@ -697,251 +668,126 @@ func deliverMessage(msg Message) bool {
 	return false
 }
 
-func storeMessage(msg Message) {
-	contentStr := ""
-	switch content := msg.Content.(type) {
-	case string:
-		contentStr = content
-	case map[string]interface{}:
-		contentBytes, err := json.Marshal(content)
-		if err == nil {
-			contentStr = string(contentBytes)
-		}
+// storeMessage persists msg and fills in its sequence number. If the sender
+// already submitted this id, msg is replaced by the stored original and
+// ErrDuplicateMessage is returned; if another sender did, msg is stored under
+// a new id. Messages to a recipient who blocked the sender are stored hidden
+// from the recipient.
+func storeMessage(msg *Message) error {
+	if blockedBy(msg.ToID, msg.FromID) {
+		log.Printf("Hiding message %s from %s, who blocked %s", msg.ID, msg.ToID, msg.FromID)
+		msg.Hidden = true
 	}
-
-	// Convert ReplyTo to JSON string if it exists
-	var replyToJSON sql.NullString
-	if msg.ReplyTo != nil {
-		replyToBytes, err := json.Marshal(msg.ReplyTo)
-		if err == nil {
-			replyToJSON = sql.NullString{String: string(replyToBytes), Valid: true}
+	stored, err := messageStore.SaveMessage(*msg)
+	if errors.Is(err, ErrMessageIDTaken) {
+		var id string
+		if id, err = newMessageID(msg.ID); err == nil {
+			msg.ClientID, msg.ID = msg.ID, id
+			stored, err = messageStore.SaveMessage(*msg)
 		}
 	}
-
-	query := `
-        INSERT INTO messages (id, from_id, to_id, content, timestamp, delivered, read_status, status, reply_to)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-    `
-
-	_, err := db.Exec(query,
-		msg.ID,
-		msg.FromID,
-		msg.ToID,
-		contentStr,
-		msg.Timestamp,
-		msg.Delivered,
-		msg.ReadStatus,
-		msg.Status,
-		replyToJSON,
-	)
-
+	if errors.Is(err, ErrDuplicateMessage) {
+		*msg = stored
+		return err
+	}
 	if err != nil {
 		log.Printf("Error storing message: %v", err)
+		return err
 	}
+	msg.Seq = stored.Seq
+	return nil
 }
 
-func sendOfflineMessages(userID string) {
-	// First, get all undelivered messages
-	query := `
-    SELECT id, from_id, to_id, content, timestamp, delivered, read_status, reply_to
-    FROM messages
-    WHERE to_id = ? AND delivered = false
-    `
-
-	rows, err := db.Query(query, userID)
+// newMessageID returns an id for a message whose own id another sender took
+func newMessageID(taken string) (string, error) {
+	id, err := randomToken()
 	if err != nil {
-		log.Printf("Error querying offline messages: %v", err)
-		return
+		return "", err
 	}
-	defer rows.Close()
-
-	clientsMux.RLock()
-	recipient := clients[userID]
-	clientsMux.RUnlock()
+	log.Printf("Message id %s is taken by another sender, storing the message as %s", taken, id)
+	return id, nil
+}
 
-	// Prepare a transaction for updating multiple messages
-	tx, err := db.Begin()
+func sendOfflineMessages(userID string) {
+	// First, get all undelivered messages
+	messages, err := messageStore.GetUndeliveredMessages(userID)
 	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
+		log.Printf("Error querying offline messages: %v", err)
 		return
 	}
 
-	updateStmt, err := tx.Prepare(`
-        UPDATE messages
-        SET delivered = true
-        WHERE id = ?
-    `)
-	if err != nil {
-		log.Printf("Error preparing update statement: %v", err)
-		tx.Rollback()
-		return
-	}
-	defer updateStmt.Close()
+	for _, msg := range messages {
+		// Send stored message to now-online user
+		if !sendToUser(userID, msg) {
+			return
+		}
 
-	for rows.Next() {
-		var msg Message
-		var replyToJSON sql.NullString
-		err := rows.Scan(
-			&msg.ID,
-			&msg.FromID,
-			&msg.ToID,
-			&msg.Content,
-			&msg.Timestamp,
-			&msg.Delivered,
-			&msg.ReadStatus,
-			&replyToJSON,
-		)
+		// Mark message as delivered
+		updated, err := messageStore.MarkDelivered(msg.ID, userID)
 		if err != nil {
-			log.Printf("Error scanning message: %v", err)
+			log.Printf("Error updating message status: %v", err)
 			continue
 		}
-
-		// Parse reply_to if it exists
-		if replyToJSON.Valid {
-			var replyTo ReplyMetadata
-			if err := json.Unmarshal([]byte(replyToJSON.String), &replyTo); err == nil {
-				msg.ReplyTo = &replyTo
-			}
+		if !updated {
+			continue
 		}
 
-		// Send stored message to now-online user
-		if recipient != nil {
-			err = recipient.Conn.WriteJSON(msg)
-			if err != nil {
-				log.Printf("Error sending stored message: %v", err)
-				continue
-			}
-
-			// Mark message as delivered within the transaction
-			_, err = updateStmt.Exec(msg.ID)
-			if err != nil {
-				log.Printf("Error updating message status: %v", err)
-				continue
-			}
-
-			// Send delivery confirmation to original sender
-			deliveryConfirmation := Message{
-				ID:        "delivery_" + msg.ID,
-				FromID:    msg.ToID,
-				ToID:      msg.FromID,
-				Content:   "delivered",
-				Timestamp: time.Now(),
-				Delivered: true,
-			}
-
-			clientsMux.RLock()
-			sender := clients[msg.FromID]
-			clientsMux.RUnlock()
-
-			if sender != nil {
-				sender.Conn.WriteJSON(deliveryConfirmation)
-			}
+		// Send delivery confirmation to original sender
+		deliveryConfirmation := Message{
+			ID:        "delivery_" + msg.ID,
+			FromID:    msg.ToID,
+			ToID:      msg.FromID,
+			Content:   "delivered",
+			Timestamp: time.Now(),
+			Delivered: true,
 		}
-	}
 
-	// Commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		tx.Rollback()
+		sendToUser(msg.FromID, deliveryConfirmation)
 	}
 }
 
-func sendGroupMessagesToUser(userID string) {
+func sendGroupMessagesToUser(client *Client) {
+	userID := client.ID
+
 	// Get all groups the user is a member of
-	groupRows, err := db.Query(
-		"SELECT group_id FROM group_members WHERE user_id = ? AND is_banned = FALSE",
-		userID,
-	)
+	groupIDs, err := groupStore.GetUserGroupIDs(userID)
 	if err != nil {
 		log.Printf("Error getting user groups: %v", err)
 		return
 	}
-	defer groupRows.Close()
-
-	clientsMux.RLock()
-	client := clients[userID]
-	clientsMux.RUnlock()
-
-	if client == nil {
-		return
-	}
 
 	// For each group, send recent messages
-	for groupRows.Next() {
-		var groupID string
-		if err := groupRows.Scan(&groupID); err != nil {
-			continue
-		}
-
-		// Get recent messages for this group
-		msgQuery := `
-            SELECT id, group_id, from_id, content, timestamp, delivered, read_by, status, reply_to
-            FROM group_messages
-            WHERE group_id = ?
-            ORDER BY timestamp DESC
-            LIMIT 50
-        `
-
-		msgRows, err := db.Query(msgQuery, groupID)
+	for _, groupID := range groupIDs {
+		groupMessages, err := groupStore.GetRecentGroupMessages(groupID, 50)
 		if err != nil {
+			log.Printf("Error getting messages for group %s: %v", groupID, err)
 			continue
 		}
 
-		for msgRows.Next() {
-			var groupMsgID, groupMsgGroupID, groupMsgFromID, groupMsgContent string
-			var groupMsgTimestamp time.Time
-			var groupMsgDelivered bool
-			var readByJSON string
-			var groupMsgStatus string
-			var replyToJSON sql.NullString
-
-			err := msgRows.Scan(
-				&groupMsgID, &groupMsgGroupID, &groupMsgFromID, &groupMsgContent,
-				&groupMsgTimestamp, &groupMsgDelivered, &readByJSON, &groupMsgStatus, &replyToJSON,
-			)
-			if err != nil {
-				continue
-			}
-
-			// Parse read_by to check if current user has read it
-			var readBy []string
-			json.Unmarshal([]byte(readByJSON), &readBy)
-
-			hasRead := false
-			for _, reader := range readBy {
-				if reader == userID {
-					hasRead = true
-					break
-				}
-			}
-
-			// Parse reply_to if exists
-			var replyTo *ReplyMetadata
-			if replyToJSON.Valid {
-				var reply ReplyMetadata
-				if err := json.Unmarshal([]byte(replyToJSON.String), &reply); err == nil {
-					replyTo = &reply
-				}
-			}
-
-			// Send as regular Message format that the client expects
-			msg := Message{
-				ID:         groupMsgID,
-				FromID:     groupMsgFromID,
-				ToID:       groupMsgGroupID, // The group ID goes in ToID
-				Content:    groupMsgContent,
-				Timestamp:  groupMsgTimestamp,
-				Delivered:  true,
-				ReadStatus: hasRead,
-				Status:     groupMsgStatus,
-				ReplyTo:    replyTo,
-			}
-
-			// Send to client
-			client.Conn.WriteJSON(msg)
+		for _, groupMsg := range withSenderNames(groupMessages) {
+			client.SendWait(groupMessageForUser(groupMsg, userID))
 		}
-		msgRows.Close()
+	}
+}
+
+// groupMessageForUser converts a stored group message into the regular Message
+// format that the client expects, with the group ID in ToID
+func groupMessageForUser(groupMsg GroupMessage, userID string) Message {
+	return Message{
+		ID:         groupMsg.ID,
+		FromID:     groupMsg.FromID,
+		ToID:       groupMsg.GroupID,
+		Content:    groupMsg.Content,
+		Timestamp:  groupMsg.Timestamp,
+		Delivered:  true,
+		ReadStatus: contains(groupMsg.ReadBy, userID),
+		Status:     groupMsg.Status,
+		ReplyTo:    groupMsg.ReplyTo,
+		Seq:        groupMsg.Seq,
+		SenderName: groupMsg.SenderName,
+		Edited:     groupMsg.Edited,
+		EditedAt:   groupMsg.EditedAt,
+		ClientID:   groupMsg.ClientID,
 	}
 }
 
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTestApp builds the server on fresh memory stores
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+	useMemoryStore(t)
+	return newApp()
+}
+
+// callAPI sends a request through app and decodes the JSON answer into out,
+// returning the status
+func callAPI(t *testing.T, app *fiber.App, method, path, token string, body, out interface{}) int {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding answer: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// registerUser has the server issue an id and registers it
+func registerUser(t *testing.T, app *fiber.App) Session {
+	t.Helper()
+	var issued IssuedID
+	if status := callAPI(t, app, "GET", "/api/generate-id", "", nil, &issued); status != 200 {
+		t.Fatalf("generate-id answered %d", status)
+	}
+	var session Session
+	creds := credentials{UserID: issued.ID, Password: "correct horse battery", Claim: issued.Claim}
+	if status := callAPI(t, app, "POST", "/api/auth/register", "", creds, &session); status != 201 {
+		t.Fatalf("register answered %d", status)
+	}
+	return session
+}
+
+// serve runs app on a local port until the test ends and returns its address.
+// Connections dialed later are closed first, and their handlers are waited
+// for, so nothing touches the stores once the test is over.
+func serve(t *testing.T, app *fiber.App) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() {
+		lifecycle.handlers.Wait()
+		app.ShutdownWithTimeout(time.Second)
+	})
+	return ln.Addr().String()
+}
+
+// dial connects session's user over the WebSocket
+func dial(t *testing.T, addr string, session Session) *websocket.Conn {
+	t.Helper()
+	return dialQuery(t, addr, session, "")
+}
+
+// dialQuery is dial with extra query parameters, such as "&sync=true"
+func dialQuery(t *testing.T, addr string, session Session, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/"+session.UserID+"?token="+session.Token+query, nil)
+	if err != nil {
+		t.Fatalf("dialing as %s: %v", session.UserID, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readUntil reads frames from conn until match accepts one
+func readUntil(t *testing.T, conn *websocket.Conn, match func(frame map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame map[string]interface{}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for a frame: %v", err)
+		}
+		if match(frame) {
+			return frame
+		}
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	app := newTestApp(t)
+	session := registerUser(t, app)
+
+	var login Session
+	creds := credentials{UserID: session.UserID, Password: "correct horse battery"}
+	if status := callAPI(t, app, "POST", "/api/auth/login", "", creds, &login); status != 200 {
+		t.Fatalf("login answered %d", status)
+	}
+	path := "/api/users/" + session.UserID + "/profile"
+	if status := callAPI(t, app, "GET", path, login.Token, nil, nil); status != 200 {
+		t.Errorf("profile with a session answered %d", status)
+	}
+	if status := callAPI(t, app, "GET", path, "", nil, nil); status != 401 {
+		t.Errorf("profile without a session answered %d, want 401", status)
+	}
+}
+
+func TestDirectMessageOverWebSocket(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	aliceConn, bobConn := dial(t, addr, alice), dial(t, addr, bob)
+
+	send := Message{ID: "m1", FromID: alice.UserID, ToID: bob.UserID, Content: "hello"}
+	if err := aliceConn.WriteJSON(send); err != nil {
+		t.Fatal(err)
+	}
+	ack := readUntil(t, aliceConn, func(f map[string]interface{}) bool { return f["messageType"] == "ack" })
+	if ack["id"] != "m1" || ack["seq"] != float64(1) {
+		t.Errorf("ack = %v", ack)
+	}
+	got := readUntil(t, bobConn, func(f map[string]interface{}) bool { return f["id"] == "m1" })
+	if got["content"] != "hello" || got["fromId"] != alice.UserID {
+		t.Errorf("bob got %v", got)
+	}
+
+	// A retry is acknowledged again and stored once
+	if err := aliceConn.WriteJSON(send); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, aliceConn, func(f map[string]interface{}) bool { return f["messageType"] == "ack" })
+	var history struct {
+		Messages []Message `json:"messages"`
+	}
+	if status := callAPI(t, app, "GET", "/api/messages/"+bob.UserID, bob.Token, nil, &history); status != 200 {
+		t.Fatalf("history answered %d", status)
+	}
+	if len(history.Messages) != 1 {
+		t.Errorf("bob's history has %d messages, want 1", len(history.Messages))
+	}
+}
@@ -0,0 +1,746 @@
+// migrations.go - Versioned schema migrations for the SQL store
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is one ordered, reversible schema change
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// SearchUp and SearchDown change the SQLite FTS5 search index. They run
+	// after Up and before Down, and are skipped where SQLite lacks FTS5;
+	// ensureSearchIndex builds the index once a build with FTS5 opens the database.
+	SearchUp   string
+	SearchDown string
+}
+
+// sqliteMigrations and postgresMigrations must stay ordered by version and never
+// be edited once released; add a new migration instead. SQLite version 1 uses
+// IF NOT EXISTS so that databases created before migrations existed are adopted as-is.
+var sqliteMigrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_messages",
+		Up: `CREATE TABLE IF NOT EXISTS messages (
+			id TEXT PRIMARY KEY,
+			from_id TEXT,
+			to_id TEXT,
+			content TEXT,
+			timestamp DATETIME,
+			delivered BOOLEAN,
+			read_status BOOLEAN,
+			status TEXT DEFAULT 'sent',
+			reply_to TEXT DEFAULT NULL
+		);`,
+		Down: `DROP TABLE IF EXISTS messages;`,
+	},
+	{
+		Version: 2,
+		Name:    "create_groups",
+		Up: `CREATE TABLE IF NOT EXISTS groups (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT,
+			created_by TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			avatar_url TEXT
+		);`,
+		Down: `DROP TABLE IF EXISTS groups;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_group_members",
+		Up: `CREATE TABLE IF NOT EXISTS group_members (
+			group_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT DEFAULT 'member',
+			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			is_muted BOOLEAN DEFAULT FALSE,
+			is_banned BOOLEAN DEFAULT FALSE,
+			PRIMARY KEY (group_id, user_id),
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members(user_id);`,
+		Down: `DROP TABLE IF EXISTS group_members;`,
+	},
+	{
+		Version: 4,
+		Name:    "create_group_messages",
+		Up: `CREATE TABLE IF NOT EXISTS group_messages (
+			id TEXT PRIMARY KEY,
+			group_id TEXT NOT NULL,
+			from_id TEXT NOT NULL,
+			content TEXT,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delivered BOOLEAN DEFAULT TRUE,
+			read_by TEXT DEFAULT '[]',
+			status TEXT DEFAULT 'sent',
+			reply_to TEXT,
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_group_messages_group ON group_messages(group_id);
+		CREATE INDEX IF NOT EXISTS idx_group_messages_timestamp ON group_messages(timestamp);`,
+		Down: `DROP TABLE IF EXISTS group_messages;`,
+	},
+	{
+		Version: 5,
+		Name:    "create_user_presence",
+		Up: `CREATE TABLE IF NOT EXISTS user_presence (
+			user_id TEXT PRIMARY KEY,
+			online BOOLEAN DEFAULT FALSE,
+			last_seen DATETIME
+		);`,
+		Down: `DROP TABLE IF EXISTS user_presence;`,
+	},
+	{
+		// The FTS tables share rowids with the tables they index and are kept
+		// in sync by triggers, so every write path is covered
+		Version:    6,
+		Name:       "create_message_search",
+		SearchUp:   sqliteRowidSearchIndex,
+		SearchDown: dropSQLiteSearchIndex,
+	},
+	{
+		// Sequence numbers give each conversation (direct pair or group) a
+		// server-assigned order; existing rows are numbered by timestamp
+		Version: 7,
+		Name:    "add_message_sequences",
+		Up: `ALTER TABLE messages ADD COLUMN conversation_id TEXT;
+		ALTER TABLE messages ADD COLUMN seq INTEGER;
+		UPDATE messages SET conversation_id = CASE WHEN from_id < to_id
+			THEN from_id || ':' || to_id ELSE to_id || ':' || from_id END;
+		UPDATE messages SET seq = r.rn FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY timestamp, id) AS rn FROM messages
+		) AS r WHERE r.id = messages.id;
+		CREATE UNIQUE INDEX idx_messages_conversation_seq ON messages(conversation_id, seq);
+
+		ALTER TABLE group_messages ADD COLUMN seq INTEGER;
+		UPDATE group_messages SET seq = r.rn FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY group_id ORDER BY timestamp, id) AS rn FROM group_messages
+		) AS r WHERE r.id = group_messages.id;
+		CREATE UNIQUE INDEX idx_group_messages_seq ON group_messages(group_id, seq);
+
+		CREATE TABLE conversation_sequences (
+			conversation_id TEXT PRIMARY KEY,
+			last_seq INTEGER NOT NULL
+		);
+		INSERT INTO conversation_sequences (conversation_id, last_seq)
+			SELECT conversation_id, MAX(seq) FROM messages GROUP BY conversation_id;
+		INSERT INTO conversation_sequences (conversation_id, last_seq)
+			SELECT group_id, MAX(seq) FROM group_messages GROUP BY group_id;`,
+		Down: `DROP TABLE IF EXISTS conversation_sequences;
+		DROP INDEX IF EXISTS idx_group_messages_seq;
+		ALTER TABLE group_messages DROP COLUMN seq;
+		DROP INDEX IF EXISTS idx_messages_conversation_seq;
+		ALTER TABLE messages DROP COLUMN seq;
+		ALTER TABLE messages DROP COLUMN conversation_id;`,
+	},
+	{
+		// Per-member receipts for group messages, superseding read_by, which
+		// is backfilled into it
+		Version: 8,
+		Name:    "create_group_message_receipts",
+		Up: `CREATE TABLE group_message_receipts (
+			message_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			delivered_at DATETIME,
+			read_at DATETIME,
+			PRIMARY KEY (message_id, user_id),
+			FOREIGN KEY (message_id) REFERENCES group_messages(id) ON DELETE CASCADE
+		);
+		INSERT INTO group_message_receipts (message_id, user_id, delivered_at, read_at)
+			SELECT DISTINCT gm.id, j.value, gm.timestamp, gm.timestamp
+			FROM group_messages gm, json_each(gm.read_by) j
+			WHERE j.type = 'text';`,
+		Down: `DROP TABLE IF EXISTS group_message_receipts;`,
+	},
+	{
+		// How far each device of a user has synced, per conversation
+		Version: 9,
+		Name:    "create_sync_cursors",
+		Up: `CREATE TABLE sync_cursors (
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			conversation_id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, device_id, conversation_id)
+		);`,
+		Down: `DROP TABLE IF EXISTS sync_cursors;`,
+	},
+	{
+		// Registered users and their login sessions
+		Version: 10,
+		Name:    "create_users_and_sessions",
+		Up: `CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_sessions_user ON sessions(user_id);`,
+		Down: `DROP TABLE IF EXISTS sessions;
+		DROP TABLE IF EXISTS users;`,
+	},
+	{
+		// Profile fields shown to other users
+		Version: 11,
+		Name:    "add_user_profiles",
+		Up: `ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';`,
+		Down: `ALTER TABLE users DROP COLUMN bio;
+		ALTER TABLE users DROP COLUMN avatar_url;
+		ALTER TABLE users DROP COLUMN display_name;`,
+	},
+	{
+		// Registry of issued user ids, backfilled with every id already in use
+		Version: 12,
+		Name:    "create_user_ids",
+		Up: `CREATE TABLE user_ids (
+			id TEXT PRIMARY KEY,
+			issued_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO user_ids (id)
+			SELECT id FROM (
+				SELECT id FROM users
+				UNION SELECT from_id FROM messages
+				UNION SELECT to_id FROM messages
+				UNION SELECT user_id FROM group_members
+				UNION SELECT from_id FROM group_messages
+				UNION SELECT user_id FROM user_presence
+			) used
+			WHERE id <> '' AND id NOT LIKE 'GROUP%';`,
+		Down: `DROP TABLE IF EXISTS user_ids;`,
+	},
+	{
+		// Per-user contact lists with nicknames, and the users each user has blocked
+		Version: 13,
+		Name:    "create_contacts_and_blocks",
+		Up: `CREATE TABLE contacts (
+			owner_id TEXT NOT NULL,
+			contact_id TEXT NOT NULL,
+			nickname TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (owner_id, contact_id)
+		);
+		CREATE TABLE blocks (
+			blocker_id TEXT NOT NULL,
+			blocked_id TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (blocker_id, blocked_id)
+		);`,
+		Down: `DROP TABLE IF EXISTS blocks;
+		DROP TABLE IF EXISTS contacts;`,
+	},
+	{
+		// Per-user privacy settings; presence is shown to contacts and group co-members by default
+		Version: 14,
+		Name:    "create_privacy_settings",
+		Up: `CREATE TABLE privacy_settings (
+			user_id TEXT PRIMARY KEY,
+			presence TEXT NOT NULL DEFAULT 'contacts',
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		Down: `DROP TABLE IF EXISTS privacy_settings;`,
+	},
+	{
+		// Chosen presence state and custom status text, kept across connections
+		Version: 15,
+		Name:    "add_presence_state",
+		Up: `ALTER TABLE user_presence ADD COLUMN state TEXT NOT NULL DEFAULT 'available';
+		ALTER TABLE user_presence ADD COLUMN status_text TEXT NOT NULL DEFAULT '';`,
+		Down: `ALTER TABLE user_presence DROP COLUMN status_text;
+		ALTER TABLE user_presence DROP COLUMN state;`,
+	},
+	{
+		// Edit flag on messages and the log of edits, which keeps the replaced content
+		// and doubles as the feed offline devices catch up from
+		Version: 16,
+		Name:    "add_message_edits",
+		Up: `ALTER TABLE messages ADD COLUMN edited_at DATETIME;
+		ALTER TABLE group_messages ADD COLUMN edited_at DATETIME;
+		CREATE TABLE message_edits (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT NOT NULL,
+			group_id TEXT NOT NULL DEFAULT '',
+			from_id TEXT NOT NULL,
+			to_id TEXT NOT NULL,
+			previous_content TEXT NOT NULL,
+			content TEXT NOT NULL,
+			edited_at DATETIME NOT NULL
+		);
+		CREATE INDEX idx_message_edits_message ON message_edits(group_id, message_id);`,
+		Down: `DROP TABLE IF EXISTS message_edits;
+		ALTER TABLE group_messages DROP COLUMN edited_at;
+		ALTER TABLE messages DROP COLUMN edited_at;`,
+	},
+	{
+		// Rowids of tables with a TEXT primary key are not stable: VACUUM may
+		// renumber them and detach the FTS rows from their messages. The index
+		// is rebuilt keyed by search_id, an integer column the insert trigger
+		// assigns once and nothing changes afterwards.
+		Version: searchIDVersion,
+		Name:    "key_message_search_by_search_id",
+		Up: `ALTER TABLE messages ADD COLUMN search_id INTEGER;
+		UPDATE messages SET search_id = rowid;
+		CREATE UNIQUE INDEX idx_messages_search_id ON messages(search_id);
+		ALTER TABLE group_messages ADD COLUMN search_id INTEGER;
+		UPDATE group_messages SET search_id = rowid;
+		CREATE UNIQUE INDEX idx_group_messages_search_id ON group_messages(search_id);`,
+		Down: `DROP INDEX IF EXISTS idx_messages_search_id;
+		ALTER TABLE messages DROP COLUMN search_id;
+		DROP INDEX IF EXISTS idx_group_messages_search_id;
+		ALTER TABLE group_messages DROP COLUMN search_id;`,
+		SearchUp:   dropSQLiteSearchIndex + sqliteSearchIndex("messages") + sqliteSearchIndex("group_messages"),
+		SearchDown: dropSQLiteSearchIndex + sqliteRowidSearchIndex,
+	},
+	{
+		// Messages sent to a recipient who blocked the sender, and edits made while
+		// blocked, are kept for the sender but hidden from the recipient
+		Version: 18,
+		Name:    "add_hidden_messages",
+		Up: `ALTER TABLE messages ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE message_edits ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;`,
+		Down: `ALTER TABLE message_edits DROP COLUMN hidden;
+		ALTER TABLE messages DROP COLUMN hidden;`,
+	},
+	{
+		// Claims let whoever was handed an id register it; ids without one, such as
+		// those backfilled in version 12, need a claim issued with the claim-id command
+		Version: 19,
+		Name:    "add_id_claims",
+		Up: `ALTER TABLE user_ids ADD COLUMN claim_hash TEXT;
+		ALTER TABLE user_ids ADD COLUMN claim_expires_at DATETIME;`,
+		Down: `ALTER TABLE user_ids DROP COLUMN claim_expires_at;
+		ALTER TABLE user_ids DROP COLUMN claim_hash;`,
+	},
+	{
+		// Senders pick message ids themselves, so retries are recognised by sender and
+		// client id; a message whose id another sender took is stored under a new one
+		Version: 20,
+		Name:    "add_message_client_ids",
+		Up: `ALTER TABLE messages ADD COLUMN client_id TEXT;
+		UPDATE messages SET client_id = id;
+		CREATE UNIQUE INDEX idx_messages_client_id ON messages(from_id, client_id);
+		ALTER TABLE group_messages ADD COLUMN client_id TEXT;
+		UPDATE group_messages SET client_id = id;
+		CREATE UNIQUE INDEX idx_group_messages_client_id ON group_messages(from_id, client_id);`,
+		Down: `DROP INDEX IF EXISTS idx_group_messages_client_id;
+		ALTER TABLE group_messages DROP COLUMN client_id;
+		DROP INDEX IF EXISTS idx_messages_client_id;
+		ALTER TABLE messages DROP COLUMN client_id;`,
+	},
+}
+
+// sqliteRowidSearchIndex is the search index of migration 6, keyed by rowid
+var sqliteRowidSearchIndex = `CREATE VIRTUAL TABLE messages_fts USING fts5(body, has_file UNINDEXED, tokenize = 'unicode61 remove_diacritics 2');
+		INSERT INTO messages_fts (rowid, body, has_file)
+			SELECT rowid, ` + sqliteSearchText("content") + `, ` + sqliteHasFile("content") + ` FROM messages;
+		CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, body, has_file)
+			VALUES (new.rowid, ` + sqliteSearchText("new.content") + `, ` + sqliteHasFile("new.content") + `);
+		END;
+		CREATE TRIGGER messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			UPDATE messages_fts SET body = ` + sqliteSearchText("new.content") + `, has_file = ` + sqliteHasFile("new.content") + `
+			WHERE rowid = new.rowid;
+		END;
+		CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+			DELETE FROM messages_fts WHERE rowid = old.rowid;
+		END;
+
+		CREATE VIRTUAL TABLE group_messages_fts USING fts5(body, has_file UNINDEXED, tokenize = 'unicode61 remove_diacritics 2');
+		INSERT INTO group_messages_fts (rowid, body, has_file)
+			SELECT rowid, ` + sqliteSearchText("content") + `, ` + sqliteHasFile("content") + ` FROM group_messages;
+		CREATE TRIGGER group_messages_fts_insert AFTER INSERT ON group_messages BEGIN
+			INSERT INTO group_messages_fts (rowid, body, has_file)
+			VALUES (new.rowid, ` + sqliteSearchText("new.content") + `, ` + sqliteHasFile("new.content") + `);
+		END;
+		CREATE TRIGGER group_messages_fts_update AFTER UPDATE OF content ON group_messages BEGIN
+			UPDATE group_messages_fts SET body = ` + sqliteSearchText("new.content") + `, has_file = ` + sqliteHasFile("new.content") + `
+			WHERE rowid = new.rowid;
+		END;
+		CREATE TRIGGER group_messages_fts_delete AFTER DELETE ON group_messages BEGIN
+			DELETE FROM group_messages_fts WHERE rowid = old.rowid;
+		END;`
+
+// searchIDVersion is the SQLite migration keying the search index by search_id
+const searchIDVersion = 17
+
+// dropSQLiteSearchIndex removes the search index and its triggers
+const dropSQLiteSearchIndex = `DROP TRIGGER IF EXISTS messages_fts_insert;
+		DROP TRIGGER IF EXISTS messages_fts_update;
+		DROP TRIGGER IF EXISTS messages_fts_delete;
+		DROP TABLE IF EXISTS messages_fts;
+		DROP TRIGGER IF EXISTS group_messages_fts_insert;
+		DROP TRIGGER IF EXISTS group_messages_fts_update;
+		DROP TRIGGER IF EXISTS group_messages_fts_delete;
+		DROP TABLE IF EXISTS group_messages_fts;`
+
+// sqliteSearchIndex creates the FTS5 index of table, keyed by its search_id
+// column, with the triggers keeping it current. New rows get the next
+// search_id before they are indexed.
+func sqliteSearchIndex(table string) string {
+	return strings.NewReplacer("@t", table, "@body", sqliteSearchText("content"), "@file", sqliteHasFile("content"),
+		"@newBody", sqliteSearchText("new.content"), "@newFile", sqliteHasFile("new.content")).Replace(`
+		CREATE VIRTUAL TABLE @t_fts USING fts5(body, has_file UNINDEXED, tokenize = 'unicode61 remove_diacritics 2');
+		INSERT INTO @t_fts (rowid, body, has_file)
+			SELECT search_id, @body, @file FROM @t;
+		CREATE TRIGGER @t_fts_insert AFTER INSERT ON @t BEGIN
+			UPDATE @t SET search_id = (SELECT COALESCE(MAX(search_id), 0) + 1 FROM @t) WHERE rowid = new.rowid;
+			INSERT INTO @t_fts (rowid, body, has_file)
+			SELECT search_id, @newBody, @newFile FROM @t WHERE rowid = new.rowid;
+		END;
+		CREATE TRIGGER @t_fts_update AFTER UPDATE OF content ON @t BEGIN
+			UPDATE @t_fts SET body = @newBody, has_file = @newFile
+			WHERE rowid = new.search_id;
+		END;
+		CREATE TRIGGER @t_fts_delete AFTER DELETE ON @t BEGIN
+			DELETE FROM @t_fts WHERE rowid = old.search_id;
+		END;
+		`)
+}
+
+// sqliteSearchText is the SQL expression giving the searchable text of a
+// content column: the text and file name of MessageContent JSON, or the value
+// itself for plain string content
+func sqliteSearchText(column string) string {
+	return strings.ReplaceAll(`CASE WHEN json_valid(@c) AND json_type(@c) = 'object'
+			THEN trim(COALESCE(json_extract(@c, '$.text'), '') || ' ' || COALESCE(json_extract(@c, '$.file.name'), ''))
+			ELSE @c END`, "@c", column)
+}
+
+// sqliteHasFile is the SQL expression telling whether a content column carries a file
+func sqliteHasFile(column string) string {
+	return strings.ReplaceAll(`CASE WHEN json_valid(@c) AND json_type(@c) = 'object'
+			THEN COALESCE(json_type(@c, '$.file') = 'object', FALSE)
+			ELSE FALSE END`, "@c", column)
+}
+
+// migrator applies migrations to a database and records them in schema_migrations
+type migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB, dialect string) *migrator {
+	migrations := sqliteMigrations
+	if dialect == "postgres" {
+		migrations = postgresMigrations
+	}
+	return &migrator{db: db, dialect: dialect, migrations: migrations}
+}
+
+// migrationStatus describes whether a known migration has been applied
+type migrationStatus struct {
+	migration
+	AppliedAt *time.Time
+}
+
+func (m *migrator) ensureTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+func (m *migrator) latestVersion() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// currentVersion returns the highest applied migration, or 0 for an empty database
+func (m *migrator) currentVersion() (int, error) {
+	if err := m.ensureTable(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := m.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// checkVersion refuses to work with a database migrated by a newer binary
+func (m *migrator) checkVersion() (int, error) {
+	current, err := m.currentVersion()
+	if err != nil {
+		return 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	if current > m.latestVersion() {
+		return current, fmt.Errorf("database schema version %d is newer than the latest version %d known to this binary",
+			current, m.latestVersion())
+	}
+	return current, nil
+}
+
+// pending returns the migrations above the current version, oldest first
+func (m *migrator) pending() ([]migration, error) {
+	current, err := m.checkVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, mig := range m.migrations {
+		if mig.Version > current {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration up to and including target
+func (m *migrator) Up(target int) error {
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range pending {
+		if mig.Version > target {
+			break
+		}
+		script, err := m.script(mig, true)
+		if err != nil {
+			return err
+		}
+		err = m.apply(mig, script, func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				rebind(m.dialect, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+				mig.Version, mig.Name, time.Now().UTC(),
+			)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+		log.Printf("Applied migration %d: %s", mig.Version, mig.Name)
+	}
+	return m.ensureSearchIndex()
+}
+
+// Down reverts applied migrations, newest first, until the schema is at target
+func (m *migrator) Down(target int) error {
+	current, err := m.checkVersion()
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version > current {
+			continue
+		}
+		if mig.Version <= target {
+			break
+		}
+		script, err := m.script(mig, false)
+		if err != nil {
+			return err
+		}
+		err = m.apply(mig, script, func(tx *sql.Tx) error {
+			_, err := tx.Exec(rebind(m.dialect, "DELETE FROM schema_migrations WHERE version = ?"), mig.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+		log.Printf("Reverted migration %d: %s", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+// script returns the script migrating up or down through mig. The search
+// index changes are left out on a SQLite built without FTS5; such databases
+// search without the index.
+func (m *migrator) script(mig migration, up bool) (string, error) {
+	schema, search := mig.Down, mig.SearchDown
+	if up {
+		schema, search = mig.Up, mig.SearchUp
+	}
+	if search != "" {
+		enabled, err := sqliteHasFTS5(m.db)
+		if err != nil {
+			return "", err
+		}
+		if !enabled {
+			log.Printf("Skipping the search index changes of migration %d: SQLite was built without FTS5", mig.Version)
+			search = ""
+		}
+	}
+	if up {
+		return schema + "\n" + search, nil
+	}
+	return search + "\n" + schema, nil
+}
+
+// ensureSearchIndex builds the search index of a SQLite database migrated by
+// a build without FTS5 once a build with FTS5 opens it. Rows stored meanwhile
+// got no search_id from the missing trigger and are numbered first.
+func (m *migrator) ensureSearchIndex() error {
+	if m.dialect != "sqlite" {
+		return nil
+	}
+	current, err := m.currentVersion()
+	if err != nil || current < searchIDVersion {
+		return err
+	}
+	enabled, err := sqliteHasFTS5(m.db)
+	if err != nil || !enabled {
+		return err
+	}
+	indexed, err := sqliteHasSearchIndex(m.db)
+	if err != nil || indexed {
+		return err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"messages", "group_messages"} {
+		_, err := tx.Exec("UPDATE " + table + " SET search_id = rowid + (SELECT COALESCE(MAX(search_id), 0) FROM " + table + ") WHERE search_id IS NULL")
+		if err != nil {
+			return fmt.Errorf("numbering %s for the search index: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec(sqliteSearchIndex("messages") + sqliteSearchIndex("group_messages")); err != nil {
+		return fmt.Errorf("building the search index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Built the missing search index")
+	return nil
+}
+
+// apply runs a migration script and its bookkeeping in one transaction
+func (m *migrator) apply(mig migration, script string, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if script != "" {
+		if _, err := tx.Exec(script); err != nil {
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Status lists every known migration and when it was applied
+func (m *migrator) Status() ([]migrationStatus, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := migrationStatus{migration: mig}
+		if appliedAt, ok := applied[mig.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// runMigrateCommand implements `migrate [up [version] | down [version] | status]`.
+// "down" without a version reverts only the newest applied migration.
+func runMigrateCommand(m *migrator, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	parseTarget := func(fallback int) (int, error) {
+		if len(args) < 2 {
+			return fallback, nil
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			return 0, fmt.Errorf("invalid target version %q", args[1])
+		}
+		return version, nil
+	}
+
+	switch command {
+	case "up":
+		target, err := parseTarget(m.latestVersion())
+		if err != nil {
+			return err
+		}
+		return m.Up(target)
+	case "down":
+		current, err := m.checkVersion()
+		if err != nil {
+			return err
+		}
+		target, err := parseTarget(current - 1)
+		if err != nil {
+			return err
+		}
+		return m.Down(target)
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		current, _ := m.currentVersion()
+		fmt.Printf("Schema version %d (latest %d)\n", current, m.latestVersion())
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-32s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q (expected up, down or status)", command)
+	}
+}
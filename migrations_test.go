@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// newTestMigrator migrates a fresh SQLite database
+func newTestMigrator(t *testing.T) *migrator {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newMigrator(db, "sqlite")
+}
+
+// appliedVersions lists the versions recorded in schema_migrations
+func appliedVersions(t *testing.T, m *migrator) []int {
+	t.Helper()
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []int
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			versions = append(versions, status.Version)
+		}
+	}
+	return versions
+}
+
+// tableExists reports whether the database has a table called name
+func tableExists(t *testing.T, m *migrator, name string) bool {
+	t.Helper()
+	var count int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for dialect, migrations := range map[string][]migration{"sqlite": sqliteMigrations, "postgres": postgresMigrations} {
+		for i := 1; i < len(migrations); i++ {
+			if migrations[i].Version <= migrations[i-1].Version {
+				t.Errorf("%s migration %d follows %d", dialect, migrations[i].Version, migrations[i-1].Version)
+			}
+		}
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	m := newTestMigrator(t)
+	latest := m.latestVersion()
+
+	if err := m.Up(5); err != nil {
+		t.Fatalf("up to 5: %v", err)
+	}
+	if got := appliedVersions(t, m); len(got) != 5 || got[4] != 5 {
+		t.Errorf("after up to 5 applied %v", got)
+	}
+	if tableExists(t, m, "message_edits") {
+		t.Error("message_edits exists before its migration")
+	}
+
+	if err := m.Up(latest); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if got := appliedVersions(t, m); len(got) != len(m.migrations) {
+		t.Errorf("after up applied %v, want all %d migrations", got, len(m.migrations))
+	}
+	if current, _ := m.currentVersion(); current != latest {
+		t.Errorf("current version %d, want %d", current, latest)
+	}
+	for _, table := range []string{"messages", "group_messages", "message_edits", "user_ids"} {
+		if !tableExists(t, m, table) {
+			t.Errorf("no %s table after up", table)
+		}
+	}
+
+	if err := m.Down(5); err != nil {
+		t.Fatalf("down to 5: %v", err)
+	}
+	if current, _ := m.currentVersion(); current != 5 {
+		t.Errorf("current version %d after down to 5", current)
+	}
+	if tableExists(t, m, "message_edits") {
+		t.Error("message_edits survived down to 5")
+	}
+
+	if err := m.Down(0); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if got := appliedVersions(t, m); len(got) != 0 {
+		t.Errorf("after down applied %v", got)
+	}
+	if tableExists(t, m, "messages") {
+		t.Error("messages survived down to 0")
+	}
+
+	// Every down migration leaves a schema the up migration applies to again
+	if err := m.Up(latest); err != nil {
+		t.Fatalf("up after down: %v", err)
+	}
+	if current, _ := m.currentVersion(); current != latest {
+		t.Errorf("current version %d after up again, want %d", current, latest)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	m := newTestMigrator(t)
+	if err := m.Up(m.latestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from_the_future', CURRENT_TIMESTAMP)", m.latestVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(m.latestVersion()); err == nil {
+		t.Error("up accepted a schema newer than the binary")
+	}
+	if err := m.Down(0); err == nil {
+		t.Error("down accepted a schema newer than the binary")
+	}
+}
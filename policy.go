@@ -0,0 +1,259 @@
+// policy.go - Authorization rules shared by the REST and WebSocket handlers
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every handler asks one of the can* functions below before touching data
+// on behalf of the caller. They return nil when the action is allowed and a
+// denial otherwise, which denyRequest turns into the matching response:
+//
+//	401  no authenticated caller
+//	403  the caller may not do this (own data only, members only, admins only)
+//	404  the caller may know about the target, but it does not exist
+//
+// Group rules are checked against the caller's membership, so a group a
+// caller does not belong to looks the same whether or not it exists.
+
+// denial is a refused authorization with the status and message to answer with
+type denial struct {
+	status  int
+	message string
+}
+
+func (d *denial) Error() string {
+	return d.message
+}
+
+var (
+	errUnauthenticated = &denial{401, "Authentication required"}
+	errNotOwner        = &denial{403, "Not authorized"}
+	errNotMember       = &denial{403, "Not a member"}
+	errNotAdmin        = &denial{403, "Admin rights required"}
+	errTargetNotMember = &denial{404, "User is not a member of this group"}
+	errPresenceHidden  = &denial{403, "Presence is hidden"}
+	errMuted           = &denial{403, "You are muted in this group"}
+	errNotSender       = &denial{403, "Only the sender can edit a message"}
+	errEditWindow      = &denial{403, "Message can no longer be edited"}
+)
+
+// denyRequest answers a request that failed an authorization check. Errors
+// other than denials come from the stores and are reported as such.
+func denyRequest(c *fiber.Ctx, err error) error {
+	if d, ok := err.(*denial); ok {
+		return c.Status(d.status).JSON(fiber.Map{"error": d.message})
+	}
+	log.Printf("Error checking authorization for %s %s: %v", c.Method(), c.Path(), err)
+	return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+}
+
+// canAccessUserData allows callers to read and delete their own messages,
+// groups and settings, and nobody else's
+func canAccessUserData(callerID, userID string) error {
+	if callerID == "" {
+		return errUnauthenticated
+	}
+	if callerID != userID {
+		return errNotOwner
+	}
+	return nil
+}
+
+// activeMember returns the caller's membership of a group, or errNotMember
+// when they do not belong to it or are banned
+func activeMember(callerID, groupID string) (*GroupMember, error) {
+	if callerID == "" {
+		return nil, errUnauthenticated
+	}
+	member, err := groupStore.GetMember(groupID, callerID)
+	if err == ErrNotFound {
+		return nil, errNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if member.IsBanned {
+		return nil, errNotMember
+	}
+	return member, nil
+}
+
+// canReadGroup allows members to see a group's members, messages and receipts
+func canReadGroup(callerID, groupID string) error {
+	_, err := activeMember(callerID, groupID)
+	return err
+}
+
+// canLeaveGroup allows members to leave a group
+func canLeaveGroup(callerID, groupID string) error {
+	_, err := activeMember(callerID, groupID)
+	return err
+}
+
+// canAddMembers allows group admins to add members
+func canAddMembers(callerID, groupID string) error {
+	return requireAdmin(callerID, groupID)
+}
+
+// canAdministerMember allows group admins to mute, ban, promote or demote a
+// member of the group
+func canAdministerMember(callerID, groupID, targetID string) error {
+	if err := requireAdmin(callerID, groupID); err != nil {
+		return err
+	}
+	_, err := groupStore.GetMember(groupID, targetID)
+	if err == ErrNotFound {
+		return errTargetNotMember
+	}
+	return err
+}
+
+func requireAdmin(callerID, groupID string) error {
+	member, err := activeMember(callerID, groupID)
+	if err != nil {
+		return err
+	}
+	if member.Role != "admin" {
+		return errNotAdmin
+	}
+	return nil
+}
+
+// canEditMessage allows the sender of a message to change it for editWindow
+// after sending it
+func canEditMessage(callerID, senderID string, sentAt time.Time) error {
+	if callerID == "" {
+		return errUnauthenticated
+	}
+	if callerID != senderID {
+		return errNotSender
+	}
+	if time.Since(sentAt) > editWindow {
+		return errEditWindow
+	}
+	return nil
+}
+
+// canSeePresence allows viewerID to see whether userID is online, as far as
+// userID's privacy settings and block list allow
+func canSeePresence(viewerID, userID string) error {
+	if viewerID == "" {
+		return errUnauthenticated
+	}
+	if viewerID == userID {
+		return nil
+	}
+	blocked, err := contactStore.IsBlocked(userID, viewerID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errPresenceHidden
+	}
+
+	settings, err := privacyStore.GetPrivacy(userID)
+	if err != nil {
+		return err
+	}
+	switch settings.Presence {
+	case presenceEveryone:
+		return nil
+	case presenceNobody:
+		return errPresenceHidden
+	}
+
+	isContact, err := contactStore.IsContact(userID, viewerID)
+	if err != nil || isContact {
+		return err
+	}
+	shared, err := groupStore.ShareGroup(userID, viewerID)
+	if err != nil || shared {
+		return err
+	}
+	return errPresenceHidden
+}
+
+// presenceAudience holds what decides who may see a user's presence, loaded
+// once to check all the subscribers of a broadcast. canSeePresence is cheaper
+// for a single viewer.
+type presenceAudience struct {
+	userID    string
+	settings  PrivacySettings
+	blocked   map[string]bool
+	contacts  map[string]bool
+	coMembers map[string]bool // loaded on first use
+}
+
+// loadPresenceAudience loads the privacy settings, block list and contacts of userID
+func loadPresenceAudience(userID string) (*presenceAudience, error) {
+	settings, err := privacyStore.GetPrivacy(userID)
+	if err != nil {
+		return nil, err
+	}
+	audience := &presenceAudience{
+		userID:   userID,
+		settings: settings,
+		blocked:  make(map[string]bool),
+		contacts: make(map[string]bool),
+	}
+
+	blocked, err := contactStore.GetBlocked(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocked {
+		audience.blocked[b.UserID] = true
+	}
+	if settings.Presence != presenceContacts {
+		return audience, nil
+	}
+	contacts, err := contactStore.GetContacts(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range contacts {
+		audience.contacts[c.ContactID] = true
+	}
+	return audience, nil
+}
+
+// allows answers canSeePresence for viewerID from what was loaded
+func (a *presenceAudience) allows(viewerID string) error {
+	if viewerID == "" {
+		return errUnauthenticated
+	}
+	if viewerID == a.userID {
+		return nil
+	}
+	if a.blocked[viewerID] {
+		return errPresenceHidden
+	}
+	switch a.settings.Presence {
+	case presenceEveryone:
+		return nil
+	case presenceNobody:
+		return errPresenceHidden
+	}
+
+	if a.contacts[viewerID] {
+		return nil
+	}
+	if a.coMembers == nil {
+		coMemberIDs, err := groupStore.GetCoMemberIDs(a.userID)
+		if err != nil {
+			return err
+		}
+		a.coMembers = make(map[string]bool, len(coMemberIDs))
+		for _, id := range coMemberIDs {
+			a.coMembers[id] = true
+		}
+	}
+	if a.coMembers[viewerID] {
+		return nil
+	}
+	return errPresenceHidden
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// useMemoryStore points every store at a fresh memory store for the test
+func useMemoryStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := newMemoryStore()
+	messageStore, groupStore, presenceStore, searchStore, syncStore, editStore, authStore, profileStore, idStore, contactStore, privacyStore = store, store, store, store, store, store, store, store, store, store, store
+	return store
+}
+
+const testGroup = "GROUP_test"
+
+// seedGroup creates testGroup, owned by "owner", with an admin, a member, a
+// banned member and a member who left
+func seedGroup(t *testing.T, store *memoryStore) {
+	t.Helper()
+	group := Group{ID: testGroup, Name: "Test", CreatedBy: "owner", CreatedAt: time.Now()}
+	if err := store.CreateGroup(group, []string{"admin", "member", "banned", "left"}); err != nil {
+		t.Fatalf("creating group: %v", err)
+	}
+	store.SetRole(testGroup, "admin", "admin")
+	store.SetBanned(testGroup, "banned", true)
+	store.RemoveMember(testGroup, "left")
+}
+
+// failingGroupStore fails every membership lookup
+type failingGroupStore struct {
+	GroupStore
+}
+
+var errStoreDown = errors.New("store down")
+
+func (failingGroupStore) GetMember(groupID, userID string) (*GroupMember, error) {
+	return nil, errStoreDown
+}
+
+func TestCanAccessUserData(t *testing.T) {
+	tests := []struct {
+		name     string
+		callerID string
+		userID   string
+		want     error
+	}{
+		{"own data", "alice", "alice", nil},
+		{"someone else's data", "alice", "bob", errNotOwner},
+		{"unauthenticated", "", "alice", errUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canAccessUserData(tt.callerID, tt.userID); got != tt.want {
+				t.Errorf("canAccessUserData(%q, %q) = %v, want %v", tt.callerID, tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupRules(t *testing.T) {
+	seedGroup(t, useMemoryStore(t))
+
+	rules := []struct {
+		name  string
+		check func(callerID string) error
+	}{
+		{"canReadGroup", func(callerID string) error { return canReadGroup(callerID, testGroup) }},
+		{"canLeaveGroup", func(callerID string) error { return canLeaveGroup(callerID, testGroup) }},
+		{"canAddMembers", func(callerID string) error { return canAddMembers(callerID, testGroup) }},
+		{"requireAdmin", func(callerID string) error { return requireAdmin(callerID, testGroup) }},
+		{"canAdministerMember", func(callerID string) error { return canAdministerMember(callerID, testGroup, "member") }},
+	}
+	tests := []struct {
+		callerID string
+		want     map[string]error // by rule
+	}{
+		{"owner", map[string]error{}},
+		{"admin", map[string]error{}},
+		{"member", map[string]error{"canAddMembers": errNotAdmin, "requireAdmin": errNotAdmin, "canAdministerMember": errNotAdmin}},
+		{"banned", map[string]error{"canReadGroup": errNotMember, "canLeaveGroup": errNotMember, "canAddMembers": errNotMember, "requireAdmin": errNotMember, "canAdministerMember": errNotMember}},
+		{"left", map[string]error{"canReadGroup": errNotMember, "canLeaveGroup": errNotMember, "canAddMembers": errNotMember, "requireAdmin": errNotMember, "canAdministerMember": errNotMember}},
+		{"stranger", map[string]error{"canReadGroup": errNotMember, "canLeaveGroup": errNotMember, "canAddMembers": errNotMember, "requireAdmin": errNotMember, "canAdministerMember": errNotMember}},
+		{"", map[string]error{"canReadGroup": errUnauthenticated, "canLeaveGroup": errUnauthenticated, "canAddMembers": errUnauthenticated, "requireAdmin": errUnauthenticated, "canAdministerMember": errUnauthenticated}},
+	}
+	for _, rule := range rules {
+		for _, tt := range tests {
+			t.Run(rule.name+"/"+tt.callerID, func(t *testing.T) {
+				if got := rule.check(tt.callerID); got != tt.want[rule.name] {
+					t.Errorf("%s(%q) = %v, want %v", rule.name, tt.callerID, got, tt.want[rule.name])
+				}
+			})
+		}
+	}
+}
+
+func TestCanAdministerMemberTargets(t *testing.T) {
+	seedGroup(t, useMemoryStore(t))
+
+	tests := []struct {
+		targetID string
+		want     error
+	}{
+		{"owner", nil},
+		{"admin", nil},
+		{"member", nil},
+		{"banned", nil}, // so that they can be unbanned
+		{"left", errTargetNotMember},
+		{"stranger", errTargetNotMember},
+	}
+	for _, tt := range tests {
+		t.Run(tt.targetID, func(t *testing.T) {
+			if got := canAdministerMember("admin", testGroup, tt.targetID); got != tt.want {
+				t.Errorf("canAdministerMember(admin, %q) = %v, want %v", tt.targetID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupRulesReportStoreErrors(t *testing.T) {
+	store := useMemoryStore(t)
+	seedGroup(t, store)
+	groupStore = failingGroupStore{store}
+
+	checks := map[string]error{
+		"canReadGroup":        canReadGroup("member", testGroup),
+		"canLeaveGroup":       canLeaveGroup("member", testGroup),
+		"canAddMembers":       canAddMembers("admin", testGroup),
+		"canAdministerMember": canAdministerMember("admin", testGroup, "member"),
+	}
+	for name, err := range checks {
+		if err != errStoreDown {
+			t.Errorf("%s = %v, want the store error", name, err)
+		}
+	}
+}
+
+func TestCanEditMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		callerID string
+		sentAt   time.Time
+		want     error
+	}{
+		{"sender within the window", "alice", time.Now(), nil},
+		{"sender after the window", "alice", time.Now().Add(-editWindow - time.Minute), errEditWindow},
+		{"someone else", "bob", time.Now(), errNotSender},
+		{"unauthenticated", "", time.Now(), errUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canEditMessage(tt.callerID, "alice", tt.sentAt); got != tt.want {
+				t.Errorf("canEditMessage(%q) = %v, want %v", tt.callerID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanSeePresence(t *testing.T) {
+	tests := []struct {
+		name     string
+		presence string // alice's setting
+		viewerID string
+		want     error
+	}{
+		{"self", presenceNobody, "alice", nil},
+		{"unauthenticated", presenceEveryone, "", errUnauthenticated},
+		{"everyone, stranger", presenceEveryone, "stranger", nil},
+		{"everyone, blocked", presenceEveryone, "blocked", errPresenceHidden},
+		{"contacts, contact", presenceContacts, "contact", nil},
+		{"contacts, group member", presenceContacts, "member", nil},
+		{"contacts, banned group member", presenceContacts, "banned", errPresenceHidden},
+		{"contacts, left group member", presenceContacts, "left", errPresenceHidden},
+		{"contacts, stranger", presenceContacts, "stranger", errPresenceHidden},
+		{"contacts, blocked contact", presenceContacts, "blocked", errPresenceHidden},
+		{"nobody, contact", presenceNobody, "contact", errPresenceHidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useMemoryStore(t)
+			group := Group{ID: testGroup, Name: "Test", CreatedBy: "alice", CreatedAt: time.Now()}
+			store.CreateGroup(group, []string{"member", "banned", "left"})
+			store.SetBanned(testGroup, "banned", true)
+			store.RemoveMember(testGroup, "left")
+			store.SaveContact("alice", "contact", "")
+			store.SaveContact("alice", "blocked", "")
+			store.Block("alice", "blocked")
+			store.SavePrivacy("alice", PrivacySettings{Presence: tt.presence})
+
+			if got := canSeePresence(tt.viewerID, "alice"); got != tt.want {
+				t.Errorf("canSeePresence(%q, alice) = %v, want %v", tt.viewerID, got, tt.want)
+			}
+			// Broadcasts decide the same from the loaded audience
+			audience, err := loadPresenceAudience("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := audience.allows(tt.viewerID); got != tt.want {
+				t.Errorf("audience of alice allows(%q) = %v, want %v", tt.viewerID, got, tt.want)
+			}
+		})
+	}
+}
+
+// countingStore counts the reads behind presence checks
+type countingStore struct {
+	*memoryStore
+	reads int
+}
+
+func (s *countingStore) GetPrivacy(userID string) (PrivacySettings, error) {
+	s.reads++
+	return s.memoryStore.GetPrivacy(userID)
+}
+
+func (s *countingStore) GetBlocked(blockerID string) ([]BlockedUser, error) {
+	s.reads++
+	return s.memoryStore.GetBlocked(blockerID)
+}
+
+func (s *countingStore) GetContacts(ownerID string) ([]Contact, error) {
+	s.reads++
+	return s.memoryStore.GetContacts(ownerID)
+}
+
+func (s *countingStore) GetCoMemberIDs(userID string) ([]string, error) {
+	s.reads++
+	return s.memoryStore.GetCoMemberIDs(userID)
+}
+
+func TestPresenceAudienceLoadsOnce(t *testing.T) {
+	store := &countingStore{memoryStore: useMemoryStore(t)}
+	privacyStore, contactStore, groupStore = store, store, store
+	seedGroup(t, store.memoryStore)
+	store.SaveContact("owner", "contact", "")
+
+	audience, err := loadPresenceAudience("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, viewerID := range []string{"contact", "admin", "member", "banned", "left", "stranger"} {
+		audience.allows(viewerID)
+	}
+	if store.reads != 4 {
+		t.Errorf("checking 6 viewers took %d reads, want 4", store.reads)
+	}
+}
@@ -0,0 +1,357 @@
+// presence.go - Presence subscriptions and privacy settings
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Clients no longer receive every user's online and offline changes. A
+// connection subscribes to the users it cares about with a presence_subscribe
+// frame, gets their current state right away, and from then on only the
+// changes of those users. Whether a subscriber may see a user is checked each
+// time a state is sent, so a change of privacy settings, contacts or blocks
+// applies to existing subscriptions too. Single lookups ask canSeePresence;
+// a broadcast loads the user's settings, blocks and contacts once into a
+// presenceAudience for all its subscribers. Users hidden from a subscriber
+// appear offline.
+//
+// Besides being online, users pick a state and an optional status text with a
+// presence_state frame. Both are stored and survive reconnects. Invisible
+// users appear offline to everyone else and their connects and disconnects
+// are not published. Others see the state only while a user is online and the
+// last-seen time only while they are offline.
+
+// Presence visibility settings
+const (
+	presenceEveryone = "everyone"
+	presenceContacts = "contacts" // contacts and group co-members
+	presenceNobody   = "nobody"
+)
+
+// Presence states a user can choose
+const (
+	stateAvailable = "available"
+	stateAway      = "away"
+	stateBusy      = "busy"
+	stateInvisible = "invisible"
+)
+
+// maxPresenceSubscriptions bounds the users one connection may watch
+const maxPresenceSubscriptions = 1000
+
+// maxStatusTextLength bounds the custom status text
+const maxStatusTextLength = 140
+
+// PresenceInfo is a user's presence as stored, or as shown to one viewer
+type PresenceInfo struct {
+	Online     bool       `json:"online"`
+	State      string     `json:"state,omitempty"`
+	StatusText string     `json:"statusText,omitempty"`
+	LastSeen   *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceStateRequest sets the sender's state and status text; fields left
+// out keep their current value
+type PresenceStateRequest struct {
+	MessageType string  `json:"messageType"` // "presence_state"
+	State       string  `json:"state,omitempty"`
+	StatusText  *string `json:"statusText,omitempty"`
+}
+
+// PrivacySettings controls what other users can see about a user
+type PrivacySettings struct {
+	Presence string `json:"presence"` // "everyone", "contacts" or "nobody"
+}
+
+var defaultPrivacy = PrivacySettings{Presence: presenceContacts}
+
+// PresenceSubscription is sent by a client to start or stop watching users
+type PresenceSubscription struct {
+	MessageType string   `json:"messageType"` // "presence_subscribe" or "presence_unsubscribe"
+	UserIDs     []string `json:"userIds"`
+}
+
+// presenceSubs indexes subscriptions both ways so a connection's
+// subscriptions can be dropped when it closes
+var presenceSubs = struct {
+	sync.Mutex
+	byUser   map[string]map[*Client]bool // watched user -> subscribed connections
+	byClient map[*Client]map[string]bool // connection -> watched users
+}{
+	byUser:   make(map[string]map[*Client]bool),
+	byClient: make(map[*Client]map[string]bool),
+}
+
+// presenceFrame is the status update clients already understand, extended
+// with the state, status text and last-seen time shown to the receiver
+func presenceFrame(userID string, info PresenceInfo) map[string]interface{} {
+	frame := map[string]interface{}{
+		"id":        "status_" + userID,
+		"content":   "status_update",
+		"fromId":    userID,
+		"toId":      "",
+		"status":    map[bool]string{true: "online", false: "offline"}[info.Online],
+		"timestamp": time.Now(),
+	}
+	if info.State != "" {
+		frame["state"] = info.State
+	}
+	if info.StatusText != "" {
+		frame["statusText"] = info.StatusText
+	}
+	if info.LastSeen != nil {
+		frame["lastSeen"] = info.LastSeen
+	}
+	return frame
+}
+
+// shownPresence is the part of userID's presence viewerID gets to see, where
+// visible is what canSeePresence answers for them
+func shownPresence(viewerID, userID string, visible error, info PresenceInfo) PresenceInfo {
+	if viewerID == userID {
+		return info
+	}
+	if visible != nil {
+		if _, denied := visible.(*denial); !denied {
+			log.Printf("Error checking presence visibility of %s for %s: %v", userID, viewerID, visible)
+		}
+		return PresenceInfo{}
+	}
+	if info.State == stateInvisible {
+		return PresenceInfo{}
+	}
+	if info.Online {
+		info.LastSeen = nil
+	} else {
+		info.State = ""
+	}
+	return info
+}
+
+// presenceFor loads userID's presence as viewerID gets to see it
+func presenceFor(viewerID, userID string) PresenceInfo {
+	info, err := presenceStore.GetPresence(userID)
+	if err != nil {
+		log.Printf("Error loading presence of %s: %v", userID, err)
+		return PresenceInfo{}
+	}
+	return shownPresence(viewerID, userID, canSeePresence(viewerID, userID), info)
+}
+
+// subscribePresence adds subscriptions for client and sends it the current
+// state of each user
+func subscribePresence(client *Client, userIDs []string) {
+	presenceSubs.Lock()
+	watched := presenceSubs.byClient[client]
+	if watched == nil {
+		watched = make(map[string]bool)
+		presenceSubs.byClient[client] = watched
+	}
+	added := make([]string, 0, len(userIDs))
+	full := false
+	for _, userID := range userIDs {
+		if userID == "" || userID == client.ID || watched[userID] {
+			continue
+		}
+		if len(watched) >= maxPresenceSubscriptions {
+			full = true
+			break
+		}
+		watched[userID] = true
+		if presenceSubs.byUser[userID] == nil {
+			presenceSubs.byUser[userID] = make(map[*Client]bool)
+		}
+		presenceSubs.byUser[userID][client] = true
+		added = append(added, userID)
+	}
+	presenceSubs.Unlock()
+
+	if full {
+		sendNack(client, "", nackInvalidPayload, "Too many presence subscriptions")
+	}
+	for _, userID := range added {
+		client.SendWait(presenceFrame(userID, presenceFor(client.ID, userID)))
+	}
+}
+
+// unsubscribePresence drops subscriptions of client; no ids drops them all
+func unsubscribePresence(client *Client, userIDs []string) {
+	presenceSubs.Lock()
+	defer presenceSubs.Unlock()
+
+	watched := presenceSubs.byClient[client]
+	if len(userIDs) == 0 {
+		for userID := range watched {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	for _, userID := range userIDs {
+		delete(watched, userID)
+		delete(presenceSubs.byUser[userID], client)
+		if len(presenceSubs.byUser[userID]) == 0 {
+			delete(presenceSubs.byUser, userID)
+		}
+	}
+	if len(watched) == 0 {
+		delete(presenceSubs.byClient, client)
+	}
+}
+
+// presenceSubscribers returns the connections watching userID
+func presenceSubscribers(userID string) []*Client {
+	presenceSubs.Lock()
+	defer presenceSubs.Unlock()
+
+	subscribers := make([]*Client, 0, len(presenceSubs.byUser[userID]))
+	for client := range presenceSubs.byUser[userID] {
+		subscribers = append(subscribers, client)
+	}
+	return subscribers
+}
+
+// broadcastUserStatus tells the subscribers of userID that may see it that it
+// connected or disconnected. Invisible users are not announced.
+func broadcastUserStatus(userID string) {
+	info, err := presenceStore.GetPresence(userID)
+	if err != nil {
+		log.Printf("Error loading presence of %s: %v", userID, err)
+		return
+	}
+	if info.State != stateInvisible {
+		sendPresence(userID, info, false)
+	}
+}
+
+// republishPresence sends every subscriber of userID the presence it may see
+// now, after something changed who may see it
+func republishPresence(userID string) {
+	info, err := presenceStore.GetPresence(userID)
+	if err != nil {
+		log.Printf("Error loading presence of %s: %v", userID, err)
+		return
+	}
+	sendPresence(userID, info, true)
+}
+
+// sendPresence sends each subscriber of userID its view of info. Subscribers
+// that may not see userID are skipped unless toHidden is set.
+func sendPresence(userID string, info PresenceInfo, toHidden bool) {
+	subscribers := presenceSubscribers(userID)
+	if len(subscribers) == 0 {
+		return
+	}
+	audience, err := loadPresenceAudience(userID)
+	if err != nil {
+		log.Printf("Error loading presence audience of %s: %v", userID, err)
+		return
+	}
+	for _, client := range subscribers {
+		visible := audience.allows(client.ID)
+		if !toHidden && visible != nil {
+			continue
+		}
+		client.SendPresence(presenceFrame(userID, shownPresence(client.ID, userID, visible, info)))
+	}
+}
+
+// handlePresenceState applies a presence_state frame from client and tells
+// the user's devices and subscribers
+func handlePresenceState(client *Client, req PresenceStateRequest) {
+	switch req.State {
+	case "", stateAvailable, stateAway, stateBusy, stateInvisible:
+	default:
+		sendNack(client, "", nackInvalidPayload, "State must be available, away, busy or invisible")
+		return
+	}
+	if req.StatusText != nil && utf8.RuneCountInString(*req.StatusText) > maxStatusTextLength {
+		sendNack(client, "", nackInvalidPayload, "Status text is too long")
+		return
+	}
+
+	info, err := presenceStore.GetPresence(client.ID)
+	if err != nil {
+		log.Printf("Error loading presence of %s: %v", client.ID, err)
+		sendNack(client, "", nackStorageFailed, "Presence could not be stored")
+		return
+	}
+	wasInvisible := info.State == stateInvisible
+	if req.State != "" {
+		info.State = req.State
+	}
+	if req.StatusText != nil {
+		info.StatusText = strings.TrimSpace(*req.StatusText)
+	}
+	if err := presenceStore.SetState(client.ID, info.State, info.StatusText); err != nil {
+		log.Printf("Error storing presence of %s: %v", client.ID, err)
+		sendNack(client, "", nackStorageFailed, "Presence could not be stored")
+		return
+	}
+
+	sendToUser(client.ID, presenceFrame(client.ID, info))
+	// Leaving invisibility shows up like connecting, entering it like leaving
+	if !wasInvisible || info.State != stateInvisible {
+		sendPresence(client.ID, info, false)
+	}
+}
+
+// handlePresenceSubscription applies a presence_subscribe or
+// presence_unsubscribe frame
+func handlePresenceSubscription(client *Client, req PresenceSubscription) {
+	if req.MessageType == "presence_unsubscribe" {
+		unsubscribePresence(client, req.UserIDs)
+		return
+	}
+	subscribePresence(client, req.UserIDs)
+}
+
+// handleGetPrivacy returns the caller's privacy settings
+func handleGetPrivacy(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	settings, err := privacyStore.GetPrivacy(userID)
+	if err != nil {
+		log.Printf("Error loading privacy settings of %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(settings)
+}
+
+// handleUpdatePrivacy changes the caller's privacy settings
+func handleUpdatePrivacy(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	var settings PrivacySettings
+	if err := c.BodyParser(&settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	switch settings.Presence {
+	case presenceEveryone, presenceContacts, presenceNobody:
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "Presence must be everyone, contacts or nobody"})
+	}
+
+	if err := privacyStore.SavePrivacy(userID, settings); err != nil {
+		log.Printf("Error saving privacy settings of %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	republishPresence(userID)
+	return c.JSON(settings)
+}
+
+// setupPresenceRoutes registers the privacy settings routes
+func setupPresenceRoutes(app *fiber.App) {
+	app.Get("/api/users/:userId/privacy", handleGetPrivacy)
+	app.Put("/api/users/:userId/privacy", handleUpdatePrivacy)
+}
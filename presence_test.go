@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// readPresence waits for the next presence frame about userID and returns its status
+func readPresence(t *testing.T, conn *websocket.Conn, userID string) string {
+	t.Helper()
+	frame := readUntil(t, conn, func(frame map[string]interface{}) bool {
+		return frame["content"] == "status_update" && frame["fromId"] == userID
+	})
+	return frame["status"].(string)
+}
+
+func TestPresenceSubscriptionsFollowPrivacy(t *testing.T) {
+	app := newTestApp(t)
+	alice, contact, stranger := registerUser(t, app), registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	if status := callAPI(t, app, "PUT", "/api/users/"+alice.UserID+"/contacts/"+contact.UserID, alice.Token, fiber.Map{}, nil); status != 200 {
+		t.Fatalf("adding a contact answered %d", status)
+	}
+	dialQuery(t, addr, alice, "&sync=true")
+
+	// With the default setting only contacts see alice online
+	watchers := map[string]*websocket.Conn{}
+	for name, session := range map[string]Session{"contact": contact, "stranger": stranger} {
+		conn := dialQuery(t, addr, session, "&sync=true")
+		sendFrame(t, conn, PresenceSubscription{MessageType: "presence_subscribe", UserIDs: []string{alice.UserID}})
+		watchers[name] = conn
+	}
+	if got := readPresence(t, watchers["contact"], alice.UserID); got != "online" {
+		t.Errorf("the contact sees alice %s", got)
+	}
+	if got := readPresence(t, watchers["stranger"], alice.UserID); got != "offline" {
+		t.Errorf("the stranger sees alice %s", got)
+	}
+
+	// Changing the setting applies to existing subscriptions
+	setPresence := func(presence string) {
+		t.Helper()
+		if status := callAPI(t, app, "PUT", "/api/users/"+alice.UserID+"/privacy", alice.Token, PrivacySettings{Presence: presence}, nil); status != 200 {
+			t.Fatalf("setting presence to %s answered %d", presence, status)
+		}
+	}
+	setPresence(presenceEveryone)
+	for name, conn := range watchers {
+		if got := readPresence(t, conn, alice.UserID); got != "online" {
+			t.Errorf("with everyone the %s sees alice %s", name, got)
+		}
+	}
+	setPresence(presenceNobody)
+	for name, conn := range watchers {
+		if got := readPresence(t, conn, alice.UserID); got != "offline" {
+			t.Errorf("with nobody the %s sees alice %s", name, got)
+		}
+	}
+
+	// The REST lookup answers the same
+	var status struct {
+		Online bool `json:"online"`
+	}
+	callAPI(t, app, "GET", "/api/status/"+alice.UserID, contact.Token, nil, &status)
+	if status.Online {
+		t.Error("the status endpoint shows alice online to a contact with nobody")
+	}
+	setPresence(presenceContacts)
+	callAPI(t, app, "GET", "/api/status/"+alice.UserID, contact.Token, nil, &status)
+	if !status.Online {
+		t.Error("the status endpoint hides alice from a contact")
+	}
+}
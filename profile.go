@@ -0,0 +1,161 @@
+// profile.go - User profiles and the display names shown to other users
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Profile field limits
+const (
+	maxDisplayNameLength = 64
+	maxAvatarURLLength   = 2048
+	maxBioLength         = 500
+)
+
+// UserProfile is the public part of a registered user
+type UserProfile struct {
+	UserID      string    `json:"userId"`
+	DisplayName string    `json:"displayName"`
+	AvatarURL   string    `json:"avatarUrl"`
+	Bio         string    `json:"bio"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ProfileUpdate lists the profile fields to change; nil fields are kept
+type ProfileUpdate struct {
+	DisplayName *string `json:"displayName"`
+	AvatarURL   *string `json:"avatarUrl"`
+	Bio         *string `json:"bio"`
+}
+
+// name is what other users see for the profile
+func (p UserProfile) name() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.UserID
+}
+
+// validate trims the update and checks it against the field limits
+func (u *ProfileUpdate) validate() string {
+	if u.DisplayName != nil {
+		name := strings.TrimSpace(*u.DisplayName)
+		if utf8.RuneCountInString(name) > maxDisplayNameLength {
+			return "Display name is too long"
+		}
+		u.DisplayName = &name
+	}
+	if u.AvatarURL != nil {
+		avatar := strings.TrimSpace(*u.AvatarURL)
+		if len(avatar) > maxAvatarURLLength {
+			return "Avatar URL is too long"
+		}
+		if avatar != "" {
+			parsed, err := url.Parse(avatar)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return "Avatar URL must be an http or https URL"
+			}
+		}
+		u.AvatarURL = &avatar
+	}
+	if u.Bio != nil {
+		bio := strings.TrimSpace(*u.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			return "Bio is too long"
+		}
+		u.Bio = &bio
+	}
+	return ""
+}
+
+// displayNames maps each user id to the name other users see for it. Users
+// without a profile, such as those from before registration, keep their id.
+func displayNames(userIDs []string) map[string]string {
+	names := make(map[string]string, len(userIDs))
+	for _, userID := range userIDs {
+		names[userID] = userID
+	}
+	profiles, err := profileStore.GetProfiles(userIDs)
+	if err != nil {
+		log.Printf("Error loading profiles: %v", err)
+		return names
+	}
+	for userID, profile := range profiles {
+		names[userID] = profile.name()
+	}
+	return names
+}
+
+// displayName is displayNames for a single user
+func displayName(userID string) string {
+	return displayNames([]string{userID})[userID]
+}
+
+// withSenderNames fills in the sender names of group messages
+func withSenderNames(messages []GroupMessage) []GroupMessage {
+	if len(messages) == 0 {
+		return messages
+	}
+	senderIDs := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		senderIDs = append(senderIDs, msg.FromID)
+	}
+	names := displayNames(senderIDs)
+	for i := range messages {
+		messages[i].SenderName = names[messages[i].FromID]
+	}
+	return messages
+}
+
+// handleGetProfile returns a user's profile
+func handleGetProfile(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+
+	profile, err := profileStore.GetProfile(userID)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+	if err != nil {
+		log.Printf("Error loading profile of %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(profile)
+}
+
+// handleUpdateProfile changes the caller's own profile
+func handleUpdateProfile(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if err := canAccessUserData(authUser(c), userID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	var update ProfileUpdate
+	if err := c.BodyParser(&update); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if problem := update.validate(); problem != "" {
+		return c.Status(400).JSON(fiber.Map{"error": problem})
+	}
+
+	profile, err := profileStore.UpdateProfile(userID, update)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+	if err != nil {
+		log.Printf("Error updating profile of %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	return c.JSON(profile)
+}
+
+// setupProfileRoutes registers the profile routes
+func setupProfileRoutes(app *fiber.App) {
+	app.Get("/api/users/:userId/profile", handleGetProfile)
+	app.Put("/api/users/:userId/profile", handleUpdateProfile)
+}
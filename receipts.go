@@ -0,0 +1,182 @@
+// receipts.go - Delivery and read receipts for direct and group messages
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxReceiptIDs bounds the message ids, and separately the watermarks,
+// accepted in one receipt frame
+const maxReceiptIDs = 500
+
+// ReceiptRequest is sent by a recipient to report messages as delivered or read,
+// either by id or with a per-conversation watermark covering every message up
+// to a sequence number. Message ids refer to direct messages unless GroupID is
+// set; watermarks refer to a group when keyed by a group id.
+type ReceiptRequest struct {
+	MessageType string           `json:"messageType"` // "receipt"
+	Status      string           `json:"status"`      // "delivered" or "read"
+	GroupID     string           `json:"groupId,omitempty"`
+	MessageIDs  []string         `json:"messageIds,omitempty"`
+	UpTo        map[string]int64 `json:"upTo,omitempty"` // contact or group id -> highest seq covered
+}
+
+// ReceiptEvent tells a sender which of their messages a recipient has received or read
+type ReceiptEvent struct {
+	MessageType string    `json:"messageType"` // "receipt"
+	FromID      string    `json:"fromId"`      // the recipient reporting the receipt
+	GroupID     string    `json:"groupId,omitempty"`
+	Status      string    `json:"status"`
+	MessageIDs  []string  `json:"messageIds"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// GroupReceipt is one member's state for a group message
+type GroupReceipt struct {
+	UserID      string     `json:"userId"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty"`
+}
+
+// handleReceipt applies a receipt from client and notifies the senders of the
+// affected messages, one event per sender. Senders that are offline see the
+// new state in their history instead.
+func handleReceipt(client *Client, req ReceiptRequest) {
+	if req.Status != "delivered" && req.Status != "read" {
+		sendNack(client, "", nackInvalidPayload, "Receipt status must be delivered or read")
+		return
+	}
+	if len(req.MessageIDs) > maxReceiptIDs {
+		sendNack(client, "", nackInvalidPayload, "Too many message ids in one receipt")
+		return
+	}
+	if len(req.UpTo) > maxReceiptIDs {
+		sendNack(client, "", nackInvalidPayload, "Too many conversations in one receipt")
+		return
+	}
+	read := req.Status == "read"
+
+	if req.GroupID != "" {
+		if !handleGroupReceipt(client, req.GroupID, req.Status, func() ([]GroupMessage, error) {
+			return groupStore.MarkGroupReceipts(req.GroupID, client.ID, req.MessageIDs, read)
+		}) {
+			return
+		}
+	} else {
+		changed, err := messageStore.MarkReceipts(client.ID, req.MessageIDs, read)
+		if err != nil {
+			log.Printf("Error recording receipts from %s: %v", client.ID, err)
+			sendNack(client, "", nackStorageFailed, "Receipt could not be stored")
+			return
+		}
+		notifyReceipts(client.ID, "", req.Status, receiptsBySender(changed, messageSender))
+	}
+
+	for conversationID, seq := range req.UpTo {
+		if strings.HasPrefix(conversationID, "GROUP_") {
+			if !handleGroupReceipt(client, conversationID, req.Status, func() ([]GroupMessage, error) {
+				return groupStore.MarkGroupReceiptsUpTo(conversationID, client.ID, seq, read)
+			}) {
+				return
+			}
+			continue
+		}
+
+		changed, err := messageStore.MarkReceiptsUpTo(client.ID, conversationID, seq, read)
+		if err != nil {
+			log.Printf("Error recording receipts from %s for %s: %v", client.ID, conversationID, err)
+			sendNack(client, "", nackStorageFailed, "Receipt could not be stored")
+			return
+		}
+		notifyReceipts(client.ID, "", req.Status, receiptsBySender(changed, messageSender))
+	}
+}
+
+// handleGroupReceipt applies a receipt from client for messages of a group,
+// which it must be a member of, and notifies their senders. It reports whether
+// the receipt was accepted.
+func handleGroupReceipt(client *Client, groupID, status string, mark func() ([]GroupMessage, error)) bool {
+	if err := canReadGroup(client.ID, groupID); err != nil {
+		if _, denied := err.(*denial); !denied {
+			log.Printf("Error checking membership of %s in %s: %v", client.ID, groupID, err)
+		}
+		sendNack(client, "", nackNotMember, "You are not a member of this group")
+		return false
+	}
+
+	changed, err := mark()
+	if err != nil {
+		log.Printf("Error recording group receipts from %s for %s: %v", client.ID, groupID, err)
+		sendNack(client, "", nackStorageFailed, "Receipt could not be stored")
+		return false
+	}
+	notifyReceipts(client.ID, groupID, status, receiptsBySender(changed, groupMessageSender))
+	return true
+}
+
+// receiptsBySender groups the ids of changed messages by their sender
+func receiptsBySender[T any](changed []T, ids func(T) (senderID, messageID string)) map[string][]string {
+	bySender := make(map[string][]string)
+	for _, msg := range changed {
+		senderID, messageID := ids(msg)
+		bySender[senderID] = append(bySender[senderID], messageID)
+	}
+	return bySender
+}
+
+// messageSender and groupMessageSender pick out what receipts are grouped by
+func messageSender(m Message) (string, string)           { return m.FromID, m.ID }
+func groupMessageSender(m GroupMessage) (string, string) { return m.FromID, m.ID }
+
+// notifyReceipts sends each online sender one event listing their messages
+func notifyReceipts(readerID, groupID, status string, bySender map[string][]string) {
+	for senderID, messageIDs := range bySender {
+		event := ReceiptEvent{
+			MessageType: "receipt",
+			FromID:      readerID,
+			GroupID:     groupID,
+			Status:      status,
+			MessageIDs:  messageIDs,
+			Timestamp:   time.Now(),
+		}
+		sendToUser(senderID, event)
+	}
+}
+
+// handleGetGroupMessageReceipts lists who has received and read a group message
+func handleGetGroupMessageReceipts(c *fiber.Ctx) error {
+	groupID := c.Params("groupId")
+	messageID := c.Params("messageId")
+	if err := canReadGroup(authUser(c), groupID); err != nil {
+		return denyRequest(c, err)
+	}
+
+	receipts, err := groupStore.GetGroupMessageReceipts(groupID, messageID)
+	if err == ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err != nil {
+		log.Printf("Error querying receipts for %s: %v", messageID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	return c.JSON(fiber.Map{
+		"messageId": messageID,
+		"receipts":  receipts,
+	})
+}
+
+// legacyReceiptTarget returns the message a per-message receipt refers to.
+// Older clients send receipts as Messages with ids like "read_<message id>".
+func legacyReceiptTarget(receiptID string) string {
+	for _, prefix := range []string{"delivery_", "read_"} {
+		if target, found := strings.CutPrefix(receiptID, prefix); found {
+			return target
+		}
+	}
+	return receiptID
+}
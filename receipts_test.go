@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// isReceipt matches receipt events
+func isReceipt(frame map[string]interface{}) bool {
+	return frame["messageType"] == "receipt"
+}
+
+// receiptIDs joins the message ids of a receipt event, which come in no
+// particular order
+func receiptIDs(frame map[string]interface{}) string {
+	var ids []string
+	for _, id := range frame["messageIds"].([]interface{}) {
+		ids = append(ids, id.(string))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// sendFrame writes frame to conn
+func sendFrame(t *testing.T, conn *websocket.Conn, frame interface{}) {
+	t.Helper()
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiptsByIDAndWatermark(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	for i := 1; i <= 4; i++ {
+		msg := Message{ID: fmt.Sprintf("m%d", i), FromID: alice.UserID, ToID: bob.UserID, Content: "hi", Timestamp: time.Now()}
+		if _, err := messageStore.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceConn, bobConn := dialQuery(t, addr, alice, "&sync=true"), dialQuery(t, addr, bob, "&sync=true")
+
+	// By id: only the listed messages change
+	sendFrame(t, bobConn, ReceiptRequest{MessageType: "receipt", Status: "read", MessageIDs: []string{"m1"}})
+	event := readUntil(t, aliceConn, isReceipt)
+	if event["fromId"] != bob.UserID || event["status"] != "read" || receiptIDs(event) != "m1" {
+		t.Errorf("receipt by id: %v", event)
+	}
+
+	// By watermark: every message up to the sequence number, except those
+	// already in that state
+	sendFrame(t, bobConn, ReceiptRequest{MessageType: "receipt", Status: "read", UpTo: map[string]int64{alice.UserID: 3}})
+	event = readUntil(t, aliceConn, isReceipt)
+	if receiptIDs(event) != "m2,m3" {
+		t.Errorf("receipt up to 3 covered %s, want m2,m3", receiptIDs(event))
+	}
+	for id, read := range map[string]bool{"m1": true, "m3": true, "m4": false} {
+		msg, err := messageStore.GetMessage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ReadStatus != read {
+			t.Errorf("%s read = %v, want %v", id, msg.ReadStatus, read)
+		}
+	}
+
+	// Alice cannot mark her own messages to bob, so m4 is left for bob below
+	sendFrame(t, aliceConn, ReceiptRequest{MessageType: "receipt", Status: "read", MessageIDs: []string{"m4"}})
+	sendFrame(t, aliceConn, ReceiptRequest{MessageType: "receipt", Status: "read", UpTo: map[string]int64{bob.UserID: 4}})
+
+	// An older client's receipt message becomes a receipt event, not a message
+	sendFrame(t, bobConn, Message{ID: "read_m4", ToID: alice.UserID, Content: "read"})
+	event = readUntil(t, aliceConn, isReceipt)
+	if receiptIDs(event) != "m4" {
+		t.Errorf("legacy receipt covered %s, want m4", receiptIDs(event))
+	}
+	sendFrame(t, bobConn, Message{ID: "after", ToID: alice.UserID, Content: "after"})
+	readUntil(t, aliceConn, func(frame map[string]interface{}) bool {
+		if frame["content"] == "read" {
+			t.Errorf("the legacy receipt was forwarded as a message: %v", frame)
+		}
+		return frame["id"] == "after"
+	})
+}
+
+func TestReceiptNacks(t *testing.T) {
+	app := newTestApp(t)
+	bob := registerUser(t, app)
+	addr := serve(t, app)
+	conn := dialQuery(t, addr, bob, "&sync=true")
+
+	tooMany := make([]string, maxReceiptIDs+1)
+	watermarks := make(map[string]int64)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("m%d", i)
+		watermarks[tooMany[i]] = 1
+	}
+	tests := []struct {
+		name string
+		req  ReceiptRequest
+		code string
+	}{
+		{"unknown status", ReceiptRequest{Status: "seen", MessageIDs: []string{"m1"}}, nackInvalidPayload},
+		{"too many ids", ReceiptRequest{Status: "read", MessageIDs: tooMany}, nackInvalidPayload},
+		{"too many watermarks", ReceiptRequest{Status: "read", UpTo: watermarks}, nackInvalidPayload},
+		{"foreign group", ReceiptRequest{Status: "read", GroupID: "GROUP_other", MessageIDs: []string{"m1"}}, nackNotMember},
+	}
+	for _, tt := range tests {
+		tt.req.MessageType = "receipt"
+		sendFrame(t, conn, tt.req)
+		nack := readUntil(t, conn, func(frame map[string]interface{}) bool { return frame["messageType"] == "nack" })
+		if nack["code"] != tt.code {
+			t.Errorf("%s: nack %v, want code %s", tt.name, nack, tt.code)
+		}
+	}
+}
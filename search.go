@@ -0,0 +1,149 @@
+// search.go - Full-text search over the caller's direct and group messages
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// searchQuery holds the search text and the optional filters
+type searchQuery struct {
+	Text    string
+	FromID  string     // only messages sent by this user
+	GroupID string     // only messages in this group (skips direct messages)
+	Since   *time.Time // only messages at or after this time
+	Until   *time.Time // only messages at or before this time
+	HasFile bool       // only messages carrying a file
+	Limit   int
+}
+
+// SearchResult is one match, tagged with the conversation it belongs to
+type SearchResult struct {
+	Type           string      `json:"type"`           // "direct" or "group"
+	ConversationID string      `json:"conversationId"` // contact id or group id
+	Timestamp      time.Time   `json:"timestamp"`
+	Message        interface{} `json:"message"` // Message or GroupMessage
+}
+
+// parseSearchQuery reads the q, sender, groupId, since, until, hasFile and limit
+// query parameters
+func parseSearchQuery(c *fiber.Ctx) (searchQuery, error) {
+	q := searchQuery{
+		Text:    strings.TrimSpace(c.Query("q")),
+		FromID:  c.Query("sender"),
+		GroupID: c.Query("groupId"),
+		Limit:   defaultHistoryLimit,
+	}
+	if q.Text == "" {
+		return q, fmt.Errorf("missing search text")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("invalid limit")
+		}
+		q.Limit = min(n, maxHistoryLimit)
+	}
+
+	for name, dest := range map[string]**time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s date, expected RFC 3339", name)
+			}
+			*dest = &t
+		}
+	}
+
+	if hasFile := c.Query("hasFile"); hasFile != "" {
+		b, err := strconv.ParseBool(hasFile)
+		if err != nil {
+			return q, fmt.Errorf("invalid hasFile")
+		}
+		q.HasFile = b
+	}
+	return q, nil
+}
+
+// ftsQuery turns free text into an FTS5 query matching every word as a
+// prefix. Each word is quoted so user input cannot inject query syntax.
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// likePattern matches word anywhere in a text, for searching without the
+// full-text index. LIKE wildcards in the word are escaped with a backslash.
+func likePattern(word string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(word)
+	return "%" + escaped + "%"
+}
+
+// messageSearchText extracts the searchable text of stored content and
+// whether it carries a file, matching what the SQL search index holds
+func messageSearchText(content interface{}) (string, bool) {
+	raw := encodeContent(content)
+	var mc MessageContent
+	if !strings.HasPrefix(strings.TrimSpace(raw), "{") || json.Unmarshal([]byte(raw), &mc) != nil {
+		return raw, false
+	}
+	if mc.File == nil {
+		return mc.Text, false
+	}
+	return strings.TrimSpace(mc.Text + " " + mc.File.Name), true
+}
+
+// handleSearch searches the conversations and groups the caller belongs to
+func handleSearch(c *fiber.Ctx) error {
+	userID := authUser(c)
+
+	q, err := parseSearchQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if q.GroupID != "" {
+		if err := canReadGroup(userID, q.GroupID); err != nil {
+			return denyRequest(c, err)
+		}
+	}
+
+	messages, groupMessages, err := searchStore.SearchMessages(userID, q)
+	if err != nil {
+		log.Printf("Error searching messages for %s: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	results := make([]SearchResult, 0, len(messages)+len(groupMessages))
+	for _, msg := range messages {
+		contactID := msg.ToID
+		if contactID == userID {
+			contactID = msg.FromID
+		}
+		results = append(results, SearchResult{Type: "direct", ConversationID: contactID, Timestamp: msg.Timestamp, Message: msg})
+	}
+	for _, msg := range groupMessages {
+		results = append(results, SearchResult{Type: "group", ConversationID: msg.GroupID, Timestamp: msg.Timestamp, Message: msg})
+	}
+
+	// Each kind is already limited; merge them newest first
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp.After(results[j].Timestamp)
+	})
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+
+	return c.JSON(fiber.Map{"results": results})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSQLiteStore points every store at a fresh SQLite database for the test
+func useSQLiteStore(t *testing.T) *sqlStore {
+	t.Helper()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "test.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	messageStore, groupStore, presenceStore, searchStore, syncStore, editStore, authStore, profileStore, idStore, contactStore, privacyStore = store, store, store, store, store, store, store, store, store, store, store
+	return store
+}
+
+func TestFTSQueryQuotesWords(t *testing.T) {
+	tests := map[string]string{
+		"pizza":             `"pizza"*`,
+		"  pizza  party ":   `"pizza"* "party"*`,
+		`say "hi" OR NOT x`: `"say"* """hi"""* "OR"* "NOT"* "x"*`,
+	}
+	for text, want := range tests {
+		if got := ftsQuery(text); got != want {
+			t.Errorf("ftsQuery(%q) = %s, want %s", text, got, want)
+		}
+	}
+}
+
+func TestLikePatternEscapesWildcards(t *testing.T) {
+	if got := likePattern(`50%_off\`); got != `%50\%\_off\\%` {
+		t.Errorf("likePattern = %s", got)
+	}
+}
+
+func TestSearchOnlyReadableConversations(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		useMemoryStore(t)
+		testSearchScope(t)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		useSQLiteStore(t)
+		testSearchScope(t)
+	})
+}
+
+// testSearchScope searches as a user with readable and unreadable matches
+func testSearchScope(t *testing.T) {
+	app := newApp()
+	alice, bob, carol := registerUser(t, app), registerUser(t, app), registerUser(t, app)
+
+	now := time.Now()
+	for _, msg := range []Message{
+		{ID: "to-bob", FromID: alice.UserID, ToID: bob.UserID, Content: "pizza tonight?", Timestamp: now},
+		{ID: "from-bob", FromID: bob.UserID, ToID: alice.UserID, Content: "Pizza sounds good", Timestamp: now},
+		{ID: "carol-bob", FromID: carol.UserID, ToID: bob.UserID, Content: "pizza without alice", Timestamp: now},
+		{ID: "no-match", FromID: bob.UserID, ToID: alice.UserID, Content: "pasta then", Timestamp: now},
+	} {
+		if _, err := messageStore.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups := map[string][]string{"GROUP_with": {alice.UserID, bob.UserID}, "GROUP_without": {bob.UserID, carol.UserID}, "GROUP_banned": {alice.UserID, carol.UserID}}
+	for groupID, memberIDs := range groups {
+		group := Group{ID: groupID, Name: groupID, CreatedBy: memberIDs[1], CreatedAt: now}
+		if err := groupStore.CreateGroup(group, memberIDs[:1]); err != nil {
+			t.Fatal(err)
+		}
+		msg := GroupMessage{ID: "in-" + groupID, GroupID: groupID, FromID: memberIDs[1], Content: "pizza for the group", Timestamp: now}
+		if _, err := groupStore.SaveGroupMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groupStore.SetBanned("GROUP_banned", alice.UserID, true)
+
+	search := func(query string) []string {
+		t.Helper()
+		var answer struct {
+			Results []struct {
+				Message struct {
+					ID string `json:"id"`
+				} `json:"message"`
+			} `json:"results"`
+		}
+		if status := callAPI(t, app, "GET", "/api/search?"+query, alice.Token, nil, &answer); status != 200 {
+			t.Fatalf("search %s answered %d", query, status)
+		}
+		var ids []string
+		for _, result := range answer.Results {
+			ids = append(ids, result.Message.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	if got := strings.Join(search("q=pizza"), ","); got != "from-bob,in-GROUP_with,to-bob" {
+		t.Errorf("searching for pizza found %s", got)
+	}
+	if got := strings.Join(search("q=pizza&sender="+bob.UserID), ","); got != "from-bob,in-GROUP_with" {
+		t.Errorf("searching bob's messages found %s", got)
+	}
+	if got := strings.Join(search("q=pizza&groupId=GROUP_with"), ","); got != "in-GROUP_with" {
+		t.Errorf("searching the group found %s", got)
+	}
+	for _, groupID := range []string{"GROUP_without", "GROUP_banned"} {
+		if status := callAPI(t, app, "GET", "/api/search?q=pizza&groupId="+groupID, alice.Token, nil, nil); status != 403 {
+			t.Errorf("searching %s answered %d, want 403", groupID, status)
+		}
+	}
+	if status := callAPI(t, app, "GET", "/api/search?q=pizza", "", nil, nil); status != 401 {
+		t.Errorf("searching without a session answered %d, want 401", status)
+	}
+}
+
+func TestSearchIndexBuiltWhenMissing(t *testing.T) {
+	m := newTestMigrator(t)
+	if enabled, err := sqliteHasFTS5(m.db); err != nil || !enabled {
+		t.Skip("SQLite was built without FTS5")
+	}
+	if err := m.Up(m.latestVersion()); err != nil {
+		t.Fatal(err)
+	}
+
+	// As left by a build without FTS5: no index, and new rows without a search_id
+	if _, err := m.db.Exec(dropSQLiteSearchIndex); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.db.Exec("INSERT INTO messages (id, from_id, to_id, content, timestamp) VALUES ('m1', 'alice', 'bob', 'pizza tonight', CURRENT_TIMESTAMP)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ensureSearchIndex(); err != nil {
+		t.Fatalf("building the index: %v", err)
+	}
+	var found int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM messages JOIN messages_fts ON messages_fts.rowid = messages.search_id WHERE messages_fts MATCH 'pizza'").Scan(&found); err != nil {
+		t.Fatal(err)
+	}
+	if found != 1 {
+		t.Errorf("the rebuilt index finds %d messages, want 1", found)
+	}
+}
@@ -0,0 +1,111 @@
+// shutdown.go - Graceful shutdown and connection draining
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// On SIGINT or SIGTERM the server stops accepting websocket upgrades, tells
+// every client it is going away and when to reconnect, flushes their queues,
+// waits for the connection handlers (and with them any database writes) to
+// finish, and closes the database, all within -shutdown-timeout.
+
+// GoingAway is the last frame a client receives before the server shuts down
+type GoingAway struct {
+	MessageType      string `json:"messageType"` // "server_shutdown"
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int    `json:"reconnectAfterMs"` // spread out so clients do not reconnect at once
+}
+
+// Reconnect hints are spread over this range
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 5 * time.Second
+)
+
+// lifecycle tracks the websocket handlers that must finish before the stores close
+var lifecycle struct {
+	mu       sync.Mutex
+	stopping bool
+	handlers sync.WaitGroup
+}
+
+// shuttingDown reports whether the server has started shutting down
+func shuttingDown() bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.stopping
+}
+
+// trackHandler registers a websocket handler, or returns false once the
+// server is shutting down. Each successful call needs a handlerDone.
+func trackHandler() bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	if lifecycle.stopping {
+		return false
+	}
+	lifecycle.handlers.Add(1)
+	return true
+}
+
+func handlerDone() {
+	lifecycle.handlers.Done()
+}
+
+// goingAwayFrame builds the shutdown notice with a randomized reconnect hint
+func goingAwayFrame() GoingAway {
+	delay := minReconnectDelay + time.Duration(rand.Int63n(int64(maxReconnectDelay-minReconnectDelay)))
+	return GoingAway{
+		MessageType:      "server_shutdown",
+		Reason:           "Server is restarting",
+		ReconnectAfterMs: int(delay / time.Millisecond),
+	}
+}
+
+// shutdownServer drains all clients and closes the app and the stores. Whatever
+// is still running when timeout expires is cut off.
+func shutdownServer(app *fiber.App, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	lifecycle.mu.Lock()
+	lifecycle.stopping = true
+	lifecycle.mu.Unlock()
+
+	clientsMux.RLock()
+	var devices []*Client
+	for _, userDevices := range clients {
+		devices = append(devices, userDevices...)
+	}
+	clientsMux.RUnlock()
+
+	log.Printf("Shutting down: draining %d connections", len(devices))
+	for _, client := range devices {
+		client.goAway(goingAwayFrame())
+	}
+
+	handlersDone := make(chan struct{})
+	go func() {
+		lifecycle.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+		log.Printf("All connections drained")
+	case <-time.After(time.Until(deadline)):
+		log.Printf("Shutdown timeout reached with connections still open")
+	}
+
+	if err := app.ShutdownWithTimeout(max(time.Until(deadline), 0)); err != nil {
+		log.Printf("Error stopping HTTP server: %v", err)
+	}
+	if err := closeStores(); err != nil {
+		log.Printf("Error closing storage: %v", err)
+	}
+	log.Printf("Shutdown complete")
+}
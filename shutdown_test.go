@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestShutdownFlushesAndSaysGoodbye(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	aliceConn, bobConn := dialQuery(t, addr, alice, "&sync=true"), dialQuery(t, addr, bob, "&sync=true")
+	t.Cleanup(func() {
+		lifecycle.mu.Lock()
+		lifecycle.stopping = false
+		lifecycle.mu.Unlock()
+	})
+
+	// Frames queued before the shutdown are written before the notice
+	for i := 0; i < 50; i++ {
+		sendToUser(bob.UserID, Message{ID: fmt.Sprintf("m%d", i), FromID: alice.UserID, ToID: bob.UserID, Content: "hi"})
+	}
+	done := make(chan struct{})
+	go func() {
+		shutdownServer(app, 5*time.Second)
+		close(done)
+	}()
+
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 50; i++ {
+		var frame map[string]interface{}
+		if err := bobConn.ReadJSON(&frame); err != nil {
+			t.Fatalf("reading queued frame %d: %v", i, err)
+		}
+		if frame["id"] != fmt.Sprintf("m%d", i) {
+			t.Fatalf("frame %d is %v", i, frame)
+		}
+	}
+	for _, conn := range []*websocket.Conn{bobConn, aliceConn} {
+		var notice GoingAway
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&notice); err != nil {
+			t.Fatalf("reading the shutdown notice: %v", err)
+		}
+		delay := time.Duration(notice.ReconnectAfterMs) * time.Millisecond
+		if notice.MessageType != "server_shutdown" || delay < minReconnectDelay || delay > maxReconnectDelay {
+			t.Errorf("shutdown notice %+v", notice)
+		}
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("after the notice read %v, want a going away close frame", err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish once the clients were drained")
+	}
+	if trackHandler() {
+		handlerDone()
+		t.Error("a new connection was accepted after shutdown")
+	}
+}
@@ -0,0 +1,361 @@
+// store.go - Storage interfaces used by the HTTP and WebSocket handlers
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ErrNotFound is returned by stores when the requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicateMessage is returned when a sender resubmits a message id they
+// already used. The store returns the original message along with it.
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// ErrMessageIDTaken is returned when a different sender already used the
+// message id. The message can be saved again under an id of the server's,
+// keeping the sender's id as its ClientID.
+var ErrMessageIDTaken = errors.New("message id already taken")
+
+// senderMessageID is the id the sender gave a message: clientID when the
+// message was stored under another id, id otherwise
+func senderMessageID(id, clientID string) string {
+	if clientID == "" {
+		return id
+	}
+	return clientID
+}
+
+// MessageStore persists direct messages between two users. What is read for a
+// user leaves out the messages hidden from them, and receipts never apply to
+// hidden messages.
+type MessageStore interface {
+	// SaveMessage stores msg and returns it with the sequence number assigned
+	// within its conversation. Resubmissions, recognised by sender and client
+	// id (ClientID, or ID when it is empty), return ErrDuplicateMessage.
+	SaveMessage(msg Message) (Message, error)
+	UpdateMessageStatus(messageID string, delivered bool, read bool) error
+	// GetMessage returns a direct message, or ErrNotFound
+	GetMessage(messageID string) (*Message, error)
+	// MarkDelivered flags a message addressed to toID as delivered and
+	// reports whether it was previously undelivered
+	MarkDelivered(messageID, toID string) (bool, error)
+	// MarkReceipts records that readerID received, or with read also read, the
+	// listed messages addressed to them and returns those whose state changed
+	MarkReceipts(readerID string, messageIDs []string, read bool) ([]Message, error)
+	// MarkReceiptsUpTo is MarkReceipts for every message from contactID to
+	// readerID with a sequence number up to seq
+	MarkReceiptsUpTo(readerID, contactID string, seq int64, read bool) ([]Message, error)
+	GetUserMessages(userID string) ([]Message, error)
+	GetUndeliveredMessages(userID string) ([]Message, error)
+	// GetMessagePage returns one page of a user's history, limited to the
+	// conversation with contactID when it is not empty
+	GetMessagePage(userID, contactID string, q historyQuery) ([]Message, bool, error)
+	// GetMessagesAfterSeq returns up to limit messages of the conversation
+	// between userID and contactID with a sequence number above afterSeq,
+	// in sequence order, and whether more follow
+	GetMessagesAfterSeq(userID, contactID string, afterSeq int64, limit int) ([]Message, bool, error)
+	// GetContactIDs returns every user userID has exchanged direct messages with
+	GetContactIDs(userID string) ([]string, error)
+	DeleteConversation(userID, contactID string) error
+}
+
+// GroupStore persists groups, their members and their messages
+type GroupStore interface {
+	// CreateGroup stores the group with its creator as admin and memberIDs as members
+	CreateGroup(group Group, memberIDs []string) error
+	GetGroup(groupID string) (*Group, error)
+	GetUserGroups(userID string) ([]Group, error)
+	// GetUserGroupIDs returns the groups a user belongs to and is not banned from
+	GetUserGroupIDs(userID string) ([]string, error)
+
+	GetMember(groupID, userID string) (*GroupMember, error)
+	GetMembers(groupID string) ([]GroupMember, error)
+	// GetActiveMemberIDs returns the ids of all members that are not banned
+	GetActiveMemberIDs(groupID string) ([]string, error)
+	// AddMember adds a regular member, doing nothing if they already belong to the group
+	AddMember(groupID, userID string) error
+	RemoveMember(groupID, userID string) error
+	SetMuted(groupID, userID string, muted bool) error
+	SetBanned(groupID, userID string, banned bool) error
+	SetRole(groupID, userID, role string) error
+	CountAdmins(groupID string) (int, error)
+	// ShareGroup reports whether two users are active members of a common group
+	ShareGroup(userA, userB string) (bool, error)
+	// GetCoMemberIDs returns the users sharing a group with userID, where
+	// neither of them is banned
+	GetCoMemberIDs(userID string) ([]string, error)
+
+	// SaveGroupMessage stores msg and returns it with its sequence number within
+	// the group. Resubmissions are recognised as by SaveMessage.
+	SaveGroupMessage(msg GroupMessage) (GroupMessage, error)
+	// GetRecentGroupMessages returns up to limit of the newest messages in chronological order
+	GetRecentGroupMessages(groupID string, limit int) ([]GroupMessage, error)
+	GetGroupMessagePage(groupID string, q historyQuery) ([]GroupMessage, bool, error)
+	GetGroupMessagesAfterSeq(groupID string, afterSeq int64, limit int) ([]GroupMessage, bool, error)
+	// GetGroupMessage returns a message of the group, or ErrNotFound
+	GetGroupMessage(groupID, messageID string) (*GroupMessage, error)
+
+	// MarkGroupReceipts records that userID received (or read) the given messages
+	// of a group and returns those whose state for the user changed. A member's
+	// own messages are never changed.
+	MarkGroupReceipts(groupID, userID string, messageIDs []string, read bool) ([]GroupMessage, error)
+	// MarkGroupReceiptsUpTo is MarkGroupReceipts for every message up to seq
+	MarkGroupReceiptsUpTo(groupID, userID string, seq int64, read bool) ([]GroupMessage, error)
+	// GetGroupMessageReceipts returns the receipts of everyone but the sender,
+	// or ErrNotFound if the group has no such message
+	GetGroupMessageReceipts(groupID, messageID string) ([]GroupReceipt, error)
+}
+
+// PresenceStore tracks which users are currently connected
+type PresenceStore interface {
+	SetOnline(userID string) error
+	SetOffline(userID string, lastSeen time.Time) error
+	IsOnline(userID string) (bool, error)
+	OnlineUsers() ([]string, error)
+	// GetPresence returns the stored presence of a user; users never seen are
+	// offline and available
+	GetPresence(userID string) (PresenceInfo, error)
+	// SetState records the state and status text a user chose, which outlive
+	// their connections
+	SetState(userID, state, statusText string) error
+}
+
+// SearchStore runs full-text searches over direct and group messages
+type SearchStore interface {
+	// SearchMessages returns the newest matches, at most q.Limit of each kind,
+	// from conversations and groups userID takes part in
+	SearchMessages(userID string, q searchQuery) ([]Message, []GroupMessage, error)
+}
+
+// SyncStore remembers how far each device of a user has synced
+type SyncStore interface {
+	// GetSyncCursors returns the device's highest seq per conversation
+	GetSyncCursors(userID, deviceID string) (map[string]int64, error)
+	// SaveSyncCursors records cursors for the device, leaving other conversations alone
+	SaveSyncCursors(userID, deviceID string, cursors map[string]int64) error
+}
+
+// EditStore changes the content of sent messages and keeps the edit log. A
+// groupID of "" refers to a direct message.
+type EditStore interface {
+	// EditMessage replaces the content of a message, flags it as edited and
+	// logs the edit with the replaced content, or returns ErrNotFound. A
+	// hidden edit is left out of the recipient's edit feed.
+	EditMessage(groupID, messageID, content string, editedAt time.Time, hidden bool) (MessageEdit, error)
+	// GetMessageEdits returns the edits of a message, oldest first
+	GetMessageEdits(groupID, messageID string) ([]MessageEdit, error)
+	// GetEditsSince returns up to limit edits logged after seq to messages of
+	// userID's direct conversations and groups, in log order, and whether
+	// more follow. Edits hidden from userID are left out.
+	GetEditsSince(userID string, afterSeq int64, limit int) ([]MessageEdit, bool, error)
+	// LastEditSeq returns the position of the newest edit in the log
+	LastEditSeq() (int64, error)
+}
+
+// AuthStore keeps user credentials and login sessions
+type AuthStore interface {
+	// CreateUser registers a user, or returns ErrUserExists
+	CreateUser(userID, passwordHash string) error
+	GetPasswordHash(userID string) (string, error)
+	CreateSession(tokenHash, userID string, expiresAt time.Time) error
+	// GetSession returns the user and expiry of a session, or ErrNotFound
+	GetSession(tokenHash string) (string, time.Time, error)
+	DeleteSession(tokenHash string) error
+}
+
+// IDStore is the registry of user ids that have been handed out. Each id
+// carries the hash of the claim that lets its holder register it.
+type IDStore interface {
+	// ReserveID records id as issued with its claim and reports false if it
+	// already was
+	ReserveID(id, claimHash string, claimExpiresAt time.Time) (bool, error)
+	IsIssued(id string) (bool, error)
+	// GetClaim returns the claim hash of an issued id and its expiry, or
+	// ErrNotFound if the id has no claim
+	GetClaim(id string) (string, time.Time, error)
+	// SetClaim gives an issued id that has no account yet a new claim, or
+	// returns ErrNotFound
+	SetClaim(id, claimHash string, expiresAt time.Time) error
+}
+
+// ContactStore keeps each user's contact list and block list
+type ContactStore interface {
+	GetContacts(ownerID string) ([]Contact, error)
+	// SaveContact adds a contact or replaces its nickname
+	SaveContact(ownerID, contactID, nickname string) (Contact, error)
+	// RemoveContact returns ErrNotFound if contactID is not a contact
+	RemoveContact(ownerID, contactID string) error
+	GetBlocked(blockerID string) ([]BlockedUser, error)
+	// Block does nothing if the user is already blocked
+	Block(blockerID, blockedID string) error
+	// Unblock returns ErrNotFound if the user was not blocked
+	Unblock(blockerID, blockedID string) error
+	IsBlocked(blockerID, blockedID string) (bool, error)
+	IsContact(ownerID, contactID string) (bool, error)
+}
+
+// PrivacyStore keeps each user's privacy settings
+type PrivacyStore interface {
+	// GetPrivacy returns the user's settings, or defaultPrivacy if they never saved any
+	GetPrivacy(userID string) (PrivacySettings, error)
+	SavePrivacy(userID string, settings PrivacySettings) error
+}
+
+// ProfileStore keeps the public profiles of registered users
+type ProfileStore interface {
+	// GetProfile returns a user's profile, or ErrNotFound
+	GetProfile(userID string) (*UserProfile, error)
+	// GetProfiles returns the profiles of the listed users that have one
+	GetProfiles(userIDs []string) (map[string]UserProfile, error)
+	// UpdateProfile applies update and returns the result, or ErrNotFound
+	UpdateProfile(userID string, update ProfileUpdate) (*UserProfile, error)
+}
+
+// Storage backends used by the handlers, wired up by initStores
+var (
+	messageStore  MessageStore
+	groupStore    GroupStore
+	presenceStore PresenceStore
+	searchStore   SearchStore
+	syncStore     SyncStore
+	editStore     EditStore
+	authStore     AuthStore
+	profileStore  ProfileStore
+	idStore       IDStore
+	contactStore  ContactStore
+	privacyStore  PrivacyStore
+
+	// storeCloser releases the backend on shutdown; nil when there is nothing to release
+	storeCloser io.Closer
+)
+
+// storeConfig selects and locates the storage backend
+type storeConfig struct {
+	Backend     string // "sqlite", "postgres" or "memory"; empty picks postgres when a DSN is set
+	SQLitePath  string
+	PostgresDSN string
+	AutoMigrate bool // apply pending migrations on startup
+}
+
+func (cfg storeConfig) backend() string {
+	if cfg.Backend != "" {
+		return cfg.Backend
+	}
+	if cfg.PostgresDSN != "" {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// initStores wires up the configured storage backend
+func initStores(cfg storeConfig) {
+	backend := cfg.backend()
+	switch backend {
+	case "sqlite":
+		store, err := newSQLiteStore(cfg.SQLitePath, cfg.AutoMigrate)
+		if err != nil {
+			log.Fatalf("Error opening SQLite store: %v", err)
+		}
+		messageStore, groupStore, presenceStore, searchStore, syncStore, editStore, authStore, profileStore, idStore, contactStore, privacyStore = store, store, store, store, store, store, store, store, store, store, store
+		storeCloser = store
+	case "postgres":
+		store, err := newPostgresStore(cfg.PostgresDSN, cfg.AutoMigrate)
+		if err != nil {
+			log.Fatalf("Error opening PostgreSQL store: %v", err)
+		}
+		messageStore, groupStore, presenceStore, searchStore, syncStore, editStore, authStore, profileStore, idStore, contactStore, privacyStore = store, store, store, store, store, store, store, store, store, store, store
+		storeCloser = store
+	case "memory":
+		store := newMemoryStore()
+		messageStore, groupStore, presenceStore, searchStore, syncStore, editStore, authStore, profileStore, idStore, contactStore, privacyStore = store, store, store, store, store, store, store, store, store, store, store
+	default:
+		log.Fatalf("Unknown storage backend %q", backend)
+	}
+	log.Printf("Using %s storage backend", backend)
+}
+
+// closeStores closes the storage backend
+func closeStores() error {
+	if storeCloser == nil {
+		return nil
+	}
+	return storeCloser.Close()
+}
+
+// openDatabase opens the configured SQL database without preparing it as
+// initStores does, for the commands that run next to a live server
+func openDatabase(cfg storeConfig) (*sql.DB, error) {
+	switch cfg.backend() {
+	case "sqlite":
+		return sql.Open("sqlite3", cfg.SQLitePath)
+	case "postgres":
+		return sql.Open("postgres", cfg.PostgresDSN)
+	case "memory":
+		return nil, fmt.Errorf("the memory backend keeps nothing between runs")
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.backend())
+	}
+}
+
+// migrateStore runs the migrate command against the configured backend
+func migrateStore(cfg storeConfig, args []string) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return runMigrateCommand(newMigrator(db, cfg.backend()), args)
+}
+
+// claimStoredID runs the claim-id command against the configured backend
+func claimStoredID(cfg storeConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: claim-id <user id>")
+	}
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	store := &sqlStore{db: db, dialect: cfg.backend()}
+	claim, expiresAt, err := claimLegacyID(store, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Claim for %s, valid until %s:\n%s\n", args[0], expiresAt.Format(time.RFC3339), claim)
+	return nil
+}
+
+// directConversationID identifies the conversation between two users
+// regardless of who sent the message
+func directConversationID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+// encodeContent converts message content to the string form kept in storage
+func encodeContent(content interface{}) string {
+	switch v := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		contentBytes, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(contentBytes)
+	}
+}
@@ -0,0 +1,1136 @@
+// store_memory.go - In-memory implementation of the storage interfaces
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. It is meant for tests and
+// throwaway servers; nothing survives a restart.
+type memoryStore struct {
+	mu            sync.RWMutex
+	messages      map[string]*Message
+	sentIDs       map[[2]string]string // sender and client id -> message id
+	groups        map[string]*Group
+	members       map[string]map[string]*GroupMember // group id -> user id -> member
+	groupMessages map[string][]GroupMessage          // group id -> messages in insertion order
+	groupSentIDs  map[[2]string]string               // sender and client id -> group message id
+	online        map[string]bool
+	lastSeen      map[string]time.Time
+	states        map[string][2]string                // user id -> chosen state and status text
+	seqs          map[string]int64                    // conversation id -> last sequence number
+	receipts      map[string]map[string]*GroupReceipt // group message id -> user id -> receipt
+	syncCursors   map[[2]string]map[string]int64      // user and device id -> conversation id -> seq
+	edits         []MessageEdit                       // edit log, oldest first
+	lastEditSeq   int64
+	passwords     map[string]string // user id -> password hash
+	profiles      map[string]*UserProfile
+	issuedIDs     map[string]*memoryClaim         // user id -> claim
+	contacts      map[string]map[string]*Contact  // owner id -> contact id -> contact
+	blocks        map[string]map[string]time.Time // blocker id -> blocked id -> when
+	privacy       map[string]PrivacySettings
+	sessions      map[string]memorySession // token hash -> session
+}
+
+type memorySession struct {
+	userID    string
+	expiresAt time.Time
+}
+
+type memoryClaim struct {
+	hash      string
+	expiresAt time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		messages:      make(map[string]*Message),
+		sentIDs:       make(map[[2]string]string),
+		groups:        make(map[string]*Group),
+		members:       make(map[string]map[string]*GroupMember),
+		groupMessages: make(map[string][]GroupMessage),
+		groupSentIDs:  make(map[[2]string]string),
+		online:        make(map[string]bool),
+		lastSeen:      make(map[string]time.Time),
+		states:        make(map[string][2]string),
+		seqs:          make(map[string]int64),
+		receipts:      make(map[string]map[string]*GroupReceipt),
+		syncCursors:   make(map[[2]string]map[string]int64),
+		passwords:     make(map[string]string),
+		profiles:      make(map[string]*UserProfile),
+		issuedIDs:     make(map[string]*memoryClaim),
+		contacts:      make(map[string]map[string]*Contact),
+		blocks:        make(map[string]map[string]time.Time),
+		privacy:       make(map[string]PrivacySettings),
+		sessions:      make(map[string]memorySession),
+	}
+}
+
+// Direct messages
+
+// storedMessage returns a copy of msg as the SQL store would hand it back
+func storedMessage(msg Message) Message {
+	msg.Content = encodeContent(msg.Content)
+	msg.Timestamp = msg.Timestamp.UTC()
+	return msg
+}
+
+func (s *memoryStore) SaveMessage(msg Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent := [2]string{msg.FromID, senderMessageID(msg.ID, msg.ClientID)}
+	if id, exists := s.sentIDs[sent]; exists {
+		existing := *s.messages[id]
+		if existing.ID != sent[1] {
+			existing.ClientID = sent[1]
+		}
+		return existing, ErrDuplicateMessage
+	}
+	if _, exists := s.messages[msg.ID]; exists {
+		return Message{}, ErrMessageIDTaken
+	}
+	stored := storedMessage(msg)
+	stored.ClientID = ""
+	conversationID := directConversationID(msg.FromID, msg.ToID)
+	s.seqs[conversationID]++
+	stored.Seq = s.seqs[conversationID]
+	s.messages[msg.ID] = &stored
+	s.sentIDs[sent] = msg.ID
+
+	msg.Seq = stored.Seq
+	return msg, nil
+}
+
+func (s *memoryStore) UpdateMessageStatus(messageID string, delivered bool, read bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg, exists := s.messages[messageID]; exists {
+		msg.Delivered = delivered
+		msg.ReadStatus = read
+		msg.Status = "sent"
+		if read {
+			msg.Status = "read"
+		} else if delivered {
+			msg.Status = "delivered"
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetMessage(messageID string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msg, exists := s.messages[messageID]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *msg
+	return &copied, nil
+}
+
+func (s *memoryStore) MarkDelivered(messageID, toID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, exists := s.messages[messageID]
+	if !exists || msg.ToID != toID || msg.Delivered || msg.Hidden {
+		return false, nil
+	}
+	msg.Delivered = true
+	return true, nil
+}
+
+// markReceiptsWhere applies a receipt to the messages addressed to readerID
+// that match keep, returning those whose state changed
+func (s *memoryStore) markReceiptsWhere(readerID string, read bool, keep func(msg *Message) bool) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []Message
+	for _, msg := range s.messages {
+		if msg.ToID != readerID || msg.Hidden || !keep(msg) || (read && msg.ReadStatus) || (!read && msg.Delivered) {
+			continue
+		}
+		msg.Delivered = true
+		msg.Status = "delivered"
+		if read {
+			msg.ReadStatus = true
+			msg.Status = "read"
+		}
+		changed = append(changed, *msg)
+	}
+	return changed
+}
+
+func (s *memoryStore) MarkReceipts(readerID string, messageIDs []string, read bool) ([]Message, error) {
+	ids := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		ids[id] = true
+	}
+	return s.markReceiptsWhere(readerID, read, func(msg *Message) bool { return ids[msg.ID] }), nil
+}
+
+func (s *memoryStore) MarkReceiptsUpTo(readerID, contactID string, seq int64, read bool) ([]Message, error) {
+	return s.markReceiptsWhere(readerID, read, func(msg *Message) bool {
+		return msg.FromID == contactID && msg.Seq <= seq
+	}), nil
+}
+
+// filterMessages returns the messages matching keep, oldest first
+func (s *memoryStore) filterMessages(keep func(msg *Message) bool) []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []Message
+	for _, msg := range s.messages {
+		if keep(msg) {
+			messages = append(messages, *msg)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+	return messages
+}
+
+func (s *memoryStore) GetUserMessages(userID string) ([]Message, error) {
+	return s.filterMessages(func(msg *Message) bool {
+		return (msg.FromID == userID || msg.ToID == userID) && msg.visibleTo(userID)
+	}), nil
+}
+
+func (s *memoryStore) GetUndeliveredMessages(userID string) ([]Message, error) {
+	return s.filterMessages(func(msg *Message) bool {
+		return msg.ToID == userID && !msg.Delivered && !msg.Hidden
+	}), nil
+}
+
+func (s *memoryStore) GetMessagePage(userID, contactID string, q historyQuery) ([]Message, bool, error) {
+	messages := s.filterMessages(func(msg *Message) bool {
+		if !msg.visibleTo(userID) {
+			return false
+		}
+		if contactID == "" {
+			return msg.FromID == userID || msg.ToID == userID
+		}
+		return (msg.FromID == userID && msg.ToID == contactID) ||
+			(msg.FromID == contactID && msg.ToID == userID)
+	})
+	messages, hasMore := pageInMemory(messages, messageCursor, q)
+	return messages, hasMore, nil
+}
+
+func (s *memoryStore) GetMessagesAfterSeq(userID, contactID string, afterSeq int64, limit int) ([]Message, bool, error) {
+	conversationID := directConversationID(userID, contactID)
+	messages := s.filterMessages(func(msg *Message) bool {
+		return directConversationID(msg.FromID, msg.ToID) == conversationID && msg.Seq > afterSeq &&
+			msg.visibleTo(userID)
+	})
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Seq < messages[j].Seq })
+	messages, hasMore := trimSeqPage(messages, limit)
+	return messages, hasMore, nil
+}
+
+func (s *memoryStore) GetContactIDs(userID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var contactIDs []string
+	for _, msg := range s.messages {
+		if !msg.visibleTo(userID) {
+			continue
+		}
+		contactID := ""
+		if msg.FromID == userID {
+			contactID = msg.ToID
+		} else if msg.ToID == userID {
+			contactID = msg.FromID
+		}
+		if contactID != "" && !seen[contactID] {
+			seen[contactID] = true
+			contactIDs = append(contactIDs, contactID)
+		}
+	}
+	sort.Strings(contactIDs)
+	return contactIDs, nil
+}
+
+func (s *memoryStore) DeleteConversation(userID, contactID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, msg := range s.messages {
+		if (msg.FromID == userID && msg.ToID == contactID) ||
+			(msg.FromID == contactID && msg.ToID == userID) {
+			delete(s.messages, id)
+		}
+	}
+	for sent, id := range s.sentIDs {
+		if _, exists := s.messages[id]; !exists {
+			delete(s.sentIDs, sent)
+		}
+	}
+	edits := s.edits[:0]
+	for _, e := range s.edits {
+		if e.GroupID != "" || directConversationID(e.FromID, e.ToID) != directConversationID(userID, contactID) {
+			edits = append(edits, e)
+		}
+	}
+	s.edits = edits
+	return nil
+}
+
+// Groups
+
+func (s *memoryStore) CreateGroup(group Group, memberIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.groups[group.ID]; exists {
+		return fmt.Errorf("group %s already exists", group.ID)
+	}
+
+	group.CreatedAt = group.CreatedAt.UTC()
+	s.groups[group.ID] = &group
+	s.members[group.ID] = map[string]*GroupMember{
+		group.CreatedBy: {GroupID: group.ID, UserID: group.CreatedBy, Role: "admin", JoinedAt: group.CreatedAt},
+	}
+	for _, userID := range memberIDs {
+		if userID != "" {
+			s.addMemberLocked(group.ID, userID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) addMemberLocked(groupID, userID string) {
+	members := s.members[groupID]
+	if members == nil {
+		members = make(map[string]*GroupMember)
+		s.members[groupID] = members
+	}
+	if _, exists := members[userID]; !exists {
+		members[userID] = &GroupMember{GroupID: groupID, UserID: userID, Role: "member", JoinedAt: time.Now().UTC()}
+	}
+}
+
+func (s *memoryStore) groupLocked(groupID string) Group {
+	g := *s.groups[groupID]
+	g.MemberCount = len(s.members[groupID])
+	return g
+}
+
+func (s *memoryStore) GetGroup(groupID string) (*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.groups[groupID]; !exists {
+		return nil, ErrNotFound
+	}
+	g := s.groupLocked(groupID)
+	return &g, nil
+}
+
+func (s *memoryStore) GetUserGroups(userID string) ([]Group, error) {
+	groupIDs, _ := s.GetUserGroupIDs(userID)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groups []Group
+	for _, groupID := range groupIDs {
+		if _, exists := s.groups[groupID]; exists {
+			groups = append(groups, s.groupLocked(groupID))
+		}
+	}
+	return groups, nil
+}
+
+func (s *memoryStore) GetUserGroupIDs(userID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groupIDs []string
+	for groupID, members := range s.members {
+		if m, exists := members[userID]; exists && !m.IsBanned {
+			groupIDs = append(groupIDs, groupID)
+		}
+	}
+	sort.Strings(groupIDs)
+	return groupIDs, nil
+}
+
+func (s *memoryStore) GetMember(groupID, userID string) (*GroupMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, exists := s.members[groupID][userID]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	member := *m
+	return &member, nil
+}
+
+func (s *memoryStore) GetMembers(groupID string) ([]GroupMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var members []GroupMember
+	for _, m := range s.members[groupID] {
+		members = append(members, *m)
+	}
+	// Same ordering as the SQL store: admins first, then by join time
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Role != members[j].Role {
+			return members[i].Role > members[j].Role
+		}
+		return members[i].JoinedAt.Before(members[j].JoinedAt)
+	})
+	return members, nil
+}
+
+func (s *memoryStore) GetActiveMemberIDs(groupID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var memberIDs []string
+	for userID, m := range s.members[groupID] {
+		if !m.IsBanned {
+			memberIDs = append(memberIDs, userID)
+		}
+	}
+	sort.Strings(memberIDs)
+	return memberIDs, nil
+}
+
+func (s *memoryStore) AddMember(groupID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addMemberLocked(groupID, userID)
+	return nil
+}
+
+func (s *memoryStore) RemoveMember(groupID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.members[groupID], userID)
+	return nil
+}
+
+// updateMember applies update to a member if they exist
+func (s *memoryStore) updateMember(groupID, userID string, update func(m *GroupMember)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, exists := s.members[groupID][userID]; exists {
+		update(m)
+	}
+	return nil
+}
+
+func (s *memoryStore) SetMuted(groupID, userID string, muted bool) error {
+	return s.updateMember(groupID, userID, func(m *GroupMember) { m.IsMuted = muted })
+}
+
+func (s *memoryStore) SetBanned(groupID, userID string, banned bool) error {
+	return s.updateMember(groupID, userID, func(m *GroupMember) { m.IsBanned = banned })
+}
+
+func (s *memoryStore) SetRole(groupID, userID, role string) error {
+	return s.updateMember(groupID, userID, func(m *GroupMember) { m.Role = role })
+}
+
+func (s *memoryStore) ShareGroup(userA, userB string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, members := range s.members {
+		a, b := members[userA], members[userB]
+		if a != nil && b != nil && !a.IsBanned && !b.IsBanned {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) GetCoMemberIDs(userID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var coMemberIDs []string
+	for _, members := range s.members {
+		if m := members[userID]; m == nil || m.IsBanned {
+			continue
+		}
+		for id, m := range members {
+			if id != userID && !m.IsBanned && !seen[id] {
+				seen[id] = true
+				coMemberIDs = append(coMemberIDs, id)
+			}
+		}
+	}
+	sort.Strings(coMemberIDs)
+	return coMemberIDs, nil
+}
+
+func (s *memoryStore) CountAdmins(groupID string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, m := range s.members[groupID] {
+		if m.Role == "admin" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Group messages
+
+func (s *memoryStore) SaveGroupMessage(msg GroupMessage) (GroupMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Ids are unique across groups, as in the SQL store
+	sent := [2]string{msg.FromID, senderMessageID(msg.ID, msg.ClientID)}
+	originalID, resubmitted := s.groupSentIDs[sent]
+	for _, messages := range s.groupMessages {
+		for _, existing := range messages {
+			if resubmitted && existing.ID == originalID {
+				if existing.ID != sent[1] {
+					existing.ClientID = sent[1]
+				}
+				return existing, ErrDuplicateMessage
+			}
+			if !resubmitted && existing.ID == msg.ID {
+				return GroupMessage{}, ErrMessageIDTaken
+			}
+		}
+	}
+
+	stored := msg
+	stored.ClientID = ""
+	stored.Content = encodeContent(msg.Content)
+	stored.Timestamp = msg.Timestamp.UTC()
+	stored.Delivered = true
+	stored.ReadBy = append([]string(nil), msg.ReadBy...)
+	s.receipts[msg.ID] = make(map[string]*GroupReceipt)
+	for _, userID := range msg.ReadBy {
+		s.receipts[msg.ID][userID] = &GroupReceipt{UserID: userID, DeliveredAt: &stored.Timestamp, ReadAt: &stored.Timestamp}
+	}
+	s.seqs[msg.GroupID]++
+	stored.Seq = s.seqs[msg.GroupID]
+	s.groupMessages[msg.GroupID] = append(s.groupMessages[msg.GroupID], stored)
+	s.groupSentIDs[sent] = msg.ID
+
+	msg.Seq = stored.Seq
+	return msg, nil
+}
+
+func (s *memoryStore) GetRecentGroupMessages(groupID string, limit int) ([]GroupMessage, error) {
+	messages, _, err := s.GetGroupMessagePage(groupID, historyQuery{Limit: limit})
+	return messages, err
+}
+
+func (s *memoryStore) GetGroupMessagePage(groupID string, q historyQuery) ([]GroupMessage, bool, error) {
+	s.mu.RLock()
+	messages := append([]GroupMessage(nil), s.groupMessages[groupID]...)
+	s.mu.RUnlock()
+
+	messages, hasMore := pageInMemory(messages, groupMessageCursor, q)
+	return messages, hasMore, nil
+}
+
+func (s *memoryStore) GetGroupMessagesAfterSeq(groupID string, afterSeq int64, limit int) ([]GroupMessage, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Group messages are kept in insertion order, which is sequence order
+	var messages []GroupMessage
+	for _, msg := range s.groupMessages[groupID] {
+		if msg.Seq > afterSeq {
+			messages = append(messages, msg)
+		}
+	}
+	messages, hasMore := trimSeqPage(messages, limit)
+	return messages, hasMore, nil
+}
+
+func (s *memoryStore) GetGroupMessage(groupID, messageID string) (*GroupMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, msg := range s.groupMessages[groupID] {
+		if msg.ID == messageID {
+			return &msg, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) markGroupReceiptsWhere(groupID, userID string, read bool, keep func(msg *GroupMessage) bool) []GroupMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	var changed []GroupMessage
+	messages := s.groupMessages[groupID]
+	for i := range messages {
+		msg := &messages[i]
+		if msg.FromID == userID || !keep(msg) {
+			continue
+		}
+		receipt := s.receipts[msg.ID][userID]
+		if receipt == nil {
+			receipt = &GroupReceipt{UserID: userID}
+		}
+		if (read && receipt.ReadAt != nil) || (!read && receipt.DeliveredAt != nil) {
+			continue
+		}
+		changed = append(changed, *msg)
+
+		if receipt.DeliveredAt == nil {
+			receipt.DeliveredAt = &now
+		}
+		if read {
+			receipt.ReadAt = &now
+			// Readers may hold the old slice, so it is replaced rather than appended to
+			msg.ReadBy = append(append([]string(nil), msg.ReadBy...), userID)
+		}
+		s.receipts[msg.ID][userID] = receipt
+	}
+	return changed
+}
+
+func (s *memoryStore) MarkGroupReceipts(groupID, userID string, messageIDs []string, read bool) ([]GroupMessage, error) {
+	return s.markGroupReceiptsWhere(groupID, userID, read, func(msg *GroupMessage) bool {
+		return contains(messageIDs, msg.ID)
+	}), nil
+}
+
+func (s *memoryStore) MarkGroupReceiptsUpTo(groupID, userID string, seq int64, read bool) ([]GroupMessage, error) {
+	return s.markGroupReceiptsWhere(groupID, userID, read, func(msg *GroupMessage) bool {
+		return msg.Seq <= seq
+	}), nil
+}
+
+func (s *memoryStore) GetGroupMessageReceipts(groupID, messageID string) ([]GroupReceipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, msg := range s.groupMessages[groupID] {
+		if msg.ID != messageID {
+			continue
+		}
+		receipts := []GroupReceipt{}
+		for userID, receipt := range s.receipts[messageID] {
+			if userID != msg.FromID {
+				receipts = append(receipts, *receipt)
+			}
+		}
+		sort.Slice(receipts, func(i, j int) bool {
+			if !receipts[i].DeliveredAt.Equal(*receipts[j].DeliveredAt) {
+				return receipts[i].DeliveredAt.Before(*receipts[j].DeliveredAt)
+			}
+			return receipts[i].UserID < receipts[j].UserID
+		})
+		return receipts, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Search
+
+// matchesSearch is the in-memory stand-in for the SQL full-text index: every
+// word of the query must occur in the message text, ignoring case
+func matchesSearch(content interface{}, timestamp time.Time, fromID string, q searchQuery) bool {
+	text, hasFile := messageSearchText(content)
+	if (q.HasFile && !hasFile) ||
+		(q.FromID != "" && fromID != q.FromID) ||
+		(q.Since != nil && timestamp.Before(*q.Since)) ||
+		(q.Until != nil && timestamp.After(*q.Until)) {
+		return false
+	}
+	text = strings.ToLower(text)
+	for _, word := range strings.Fields(strings.ToLower(q.Text)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *memoryStore) SearchMessages(userID string, q searchQuery) ([]Message, []GroupMessage, error) {
+	var messages []Message
+	if q.GroupID == "" {
+		messages = s.filterMessages(func(msg *Message) bool {
+			return (msg.FromID == userID || msg.ToID == userID) && msg.visibleTo(userID) &&
+				matchesSearch(msg.Content, msg.Timestamp, msg.FromID, q)
+		})
+	}
+
+	s.mu.RLock()
+	var groupMessages []GroupMessage
+	for groupID, members := range s.members {
+		if m, exists := members[userID]; !exists || m.IsBanned || (q.GroupID != "" && groupID != q.GroupID) {
+			continue
+		}
+		for _, msg := range s.groupMessages[groupID] {
+			if matchesSearch(msg.Content, msg.Timestamp, msg.FromID, q) {
+				groupMessages = append(groupMessages, msg)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	// Newest first, like the SQL store
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp.After(messages[j].Timestamp) })
+	sort.SliceStable(groupMessages, func(i, j int) bool { return groupMessages[i].Timestamp.After(groupMessages[j].Timestamp) })
+	if len(messages) > q.Limit {
+		messages = messages[:q.Limit]
+	}
+	if len(groupMessages) > q.Limit {
+		groupMessages = groupMessages[:q.Limit]
+	}
+	return messages, groupMessages, nil
+}
+
+// Sync cursors
+
+func (s *memoryStore) GetSyncCursors(userID, deviceID string) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cursors := make(map[string]int64)
+	for conversationID, seq := range s.syncCursors[[2]string{userID, deviceID}] {
+		cursors[conversationID] = seq
+	}
+	return cursors, nil
+}
+
+func (s *memoryStore) SaveSyncCursors(userID, deviceID string, cursors map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]string{userID, deviceID}
+	if s.syncCursors[key] == nil {
+		s.syncCursors[key] = make(map[string]int64)
+	}
+	for conversationID, seq := range cursors {
+		s.syncCursors[key][conversationID] = seq
+	}
+	return nil
+}
+
+// Message edits
+
+func (s *memoryStore) EditMessage(groupID, messageID, content string, editedAt time.Time, hidden bool) (MessageEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	editedAt = editedAt.UTC()
+	edit := MessageEdit{MessageID: messageID, GroupID: groupID, Content: content, EditedAt: editedAt, Hidden: hidden}
+	found := false
+	if groupID == "" {
+		if msg, exists := s.messages[messageID]; exists {
+			edit.FromID, edit.ToID, edit.PreviousContent = msg.FromID, msg.ToID, encodeContent(msg.Content)
+			msg.Content, msg.Edited, msg.EditedAt = content, true, &editedAt
+			found = true
+		}
+	} else {
+		for i := range s.groupMessages[groupID] {
+			msg := &s.groupMessages[groupID][i]
+			if msg.ID == messageID {
+				edit.FromID, edit.ToID, edit.PreviousContent = msg.FromID, groupID, encodeContent(msg.Content)
+				msg.Content, msg.Edited, msg.EditedAt = content, true, &editedAt
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return edit, ErrNotFound
+	}
+
+	s.lastEditSeq++
+	edit.Seq = s.lastEditSeq
+	s.edits = append(s.edits, edit)
+	return edit, nil
+}
+
+func (s *memoryStore) GetMessageEdits(groupID, messageID string) ([]MessageEdit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	edits := []MessageEdit{}
+	for _, e := range s.edits {
+		if e.GroupID == groupID && e.MessageID == messageID {
+			edits = append(edits, e)
+		}
+	}
+	return edits, nil
+}
+
+func (s *memoryStore) GetEditsSince(userID string, afterSeq int64, limit int) ([]MessageEdit, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	edits := []MessageEdit{}
+	for _, e := range s.edits {
+		if e.Seq <= afterSeq {
+			continue
+		}
+		if e.GroupID == "" {
+			if (e.FromID != userID && e.ToID != userID) || !e.visibleTo(userID) {
+				continue
+			}
+		} else if member := s.members[e.GroupID][userID]; member == nil || member.IsBanned {
+			continue
+		}
+		edits = append(edits, e)
+	}
+	edits, hasMore := trimSeqPage(edits, limit)
+	return edits, hasMore, nil
+}
+
+func (s *memoryStore) LastEditSeq() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastEditSeq, nil
+}
+
+// Users and sessions
+
+func (s *memoryStore) CreateUser(userID, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.passwords[userID]; exists {
+		return ErrUserExists
+	}
+	s.passwords[userID] = passwordHash
+	s.profiles[userID] = &UserProfile{UserID: userID, CreatedAt: time.Now().UTC()}
+	return nil
+}
+
+func (s *memoryStore) GetPasswordHash(userID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hash, exists := s.passwords[userID]
+	if !exists {
+		return "", ErrNotFound
+	}
+	return hash, nil
+}
+
+func (s *memoryStore) CreateSession(tokenHash, userID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[tokenHash] = memorySession{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memoryStore) GetSession(tokenHash string) (string, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return "", time.Time{}, ErrNotFound
+	}
+	return session.userID, session.expiresAt, nil
+}
+
+func (s *memoryStore) DeleteSession(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+// Issued user ids
+
+func (s *memoryStore) ReserveID(id, claimHash string, claimExpiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, issued := s.issuedIDs[id]; issued {
+		return false, nil
+	}
+	s.issuedIDs[id] = &memoryClaim{hash: claimHash, expiresAt: claimExpiresAt}
+	return true, nil
+}
+
+func (s *memoryStore) IsIssued(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, issued := s.issuedIDs[id]
+	return issued, nil
+}
+
+func (s *memoryStore) GetClaim(id string) (string, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	claim := s.issuedIDs[id]
+	if claim == nil {
+		return "", time.Time{}, ErrNotFound
+	}
+	return claim.hash, claim.expiresAt, nil
+}
+
+func (s *memoryStore) SetClaim(id, claimHash string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, issued := s.issuedIDs[id]
+	_, registered := s.passwords[id]
+	if !issued || registered {
+		return ErrNotFound
+	}
+	s.issuedIDs[id] = &memoryClaim{hash: claimHash, expiresAt: expiresAt}
+	return nil
+}
+
+// Contacts and blocks
+
+func (s *memoryStore) GetContacts(ownerID string) ([]Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	contacts := []Contact{}
+	for _, contact := range s.contacts[ownerID] {
+		contacts = append(contacts, *contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		if !contacts[i].AddedAt.Equal(contacts[j].AddedAt) {
+			return contacts[i].AddedAt.Before(contacts[j].AddedAt)
+		}
+		return contacts[i].ContactID < contacts[j].ContactID
+	})
+	return contacts, nil
+}
+
+func (s *memoryStore) SaveContact(ownerID, contactID, nickname string) (Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.contacts[ownerID] == nil {
+		s.contacts[ownerID] = make(map[string]*Contact)
+	}
+	contact, exists := s.contacts[ownerID][contactID]
+	if !exists {
+		contact = &Contact{ContactID: contactID, AddedAt: time.Now().UTC()}
+		s.contacts[ownerID][contactID] = contact
+	}
+	contact.Nickname = nickname
+	return *contact, nil
+}
+
+func (s *memoryStore) RemoveContact(ownerID, contactID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.contacts[ownerID][contactID]; !exists {
+		return ErrNotFound
+	}
+	delete(s.contacts[ownerID], contactID)
+	return nil
+}
+
+func (s *memoryStore) GetBlocked(blockerID string) ([]BlockedUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blocked := []BlockedUser{}
+	for userID, blockedAt := range s.blocks[blockerID] {
+		blocked = append(blocked, BlockedUser{UserID: userID, BlockedAt: blockedAt})
+	}
+	sort.Slice(blocked, func(i, j int) bool {
+		if !blocked[i].BlockedAt.Equal(blocked[j].BlockedAt) {
+			return blocked[i].BlockedAt.Before(blocked[j].BlockedAt)
+		}
+		return blocked[i].UserID < blocked[j].UserID
+	})
+	return blocked, nil
+}
+
+func (s *memoryStore) Block(blockerID, blockedID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blocks[blockerID] == nil {
+		s.blocks[blockerID] = make(map[string]time.Time)
+	}
+	if _, exists := s.blocks[blockerID][blockedID]; !exists {
+		s.blocks[blockerID][blockedID] = time.Now().UTC()
+	}
+	return nil
+}
+
+func (s *memoryStore) Unblock(blockerID, blockedID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.blocks[blockerID][blockedID]; !exists {
+		return ErrNotFound
+	}
+	delete(s.blocks[blockerID], blockedID)
+	return nil
+}
+
+func (s *memoryStore) IsBlocked(blockerID, blockedID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, blocked := s.blocks[blockerID][blockedID]
+	return blocked, nil
+}
+
+func (s *memoryStore) IsContact(ownerID, contactID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.contacts[ownerID][contactID]
+	return exists, nil
+}
+
+// Privacy settings
+
+func (s *memoryStore) GetPrivacy(userID string) (PrivacySettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if settings, exists := s.privacy[userID]; exists {
+		return settings, nil
+	}
+	return defaultPrivacy, nil
+}
+
+func (s *memoryStore) SavePrivacy(userID string, settings PrivacySettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.privacy[userID] = settings
+	return nil
+}
+
+// Profiles
+
+func (s *memoryStore) GetProfile(userID string) (*UserProfile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	profile, exists := s.profiles[userID]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	copied := *profile
+	return &copied, nil
+}
+
+func (s *memoryStore) GetProfiles(userIDs []string) (map[string]UserProfile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	profiles := make(map[string]UserProfile)
+	for _, userID := range userIDs {
+		if profile, exists := s.profiles[userID]; exists {
+			profiles[userID] = *profile
+		}
+	}
+	return profiles, nil
+}
+
+func (s *memoryStore) UpdateProfile(userID string, update ProfileUpdate) (*UserProfile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	profile, exists := s.profiles[userID]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if update.DisplayName != nil {
+		profile.DisplayName = *update.DisplayName
+	}
+	if update.AvatarURL != nil {
+		profile.AvatarURL = *update.AvatarURL
+	}
+	if update.Bio != nil {
+		profile.Bio = *update.Bio
+	}
+	copied := *profile
+	return &copied, nil
+}
+
+// Presence
+
+func (s *memoryStore) SetOnline(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.online[userID] = true
+	return nil
+}
+
+func (s *memoryStore) SetOffline(userID string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.online, userID)
+	s.lastSeen[userID] = lastSeen.UTC()
+	return nil
+}
+
+func (s *memoryStore) IsOnline(userID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.online[userID], nil
+}
+
+func (s *memoryStore) OnlineUsers() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userIDs := make([]string, 0, len(s.online))
+	for userID := range s.online {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
+
+func (s *memoryStore) GetPresence(userID string) (PresenceInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info := PresenceInfo{Online: s.online[userID], State: stateAvailable}
+	if lastSeen, seen := s.lastSeen[userID]; seen {
+		info.LastSeen = &lastSeen
+	}
+	if chosen, set := s.states[userID]; set {
+		info.State, info.StatusText = chosen[0], chosen[1]
+	}
+	return info, nil
+}
+
+func (s *memoryStore) SetState(userID, state, statusText string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[userID] = [2]string{state, statusText}
+	return nil
+}
@@ -0,0 +1,366 @@
+// store_postgres.go - PostgreSQL flavour of the SQL store
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// newPostgresStore connects to PostgreSQL. Several server instances may share
+// one database, so unlike SQLite the presence table is not reset on startup.
+func newPostgresStore(dsn string, autoMigrate bool) (*sqlStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &sqlStore{db: db, dialect: "postgres"}
+	if err := s.prepareSchema(autoMigrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// postgresMigrations mirror sqliteMigrations with native types: timestamps
+// are TIMESTAMPTZ and the read_by/reply_to documents are JSONB.
+var postgresMigrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_messages",
+		Up: `CREATE TABLE messages (
+			id TEXT PRIMARY KEY,
+			from_id TEXT,
+			to_id TEXT,
+			content TEXT,
+			timestamp TIMESTAMPTZ,
+			delivered BOOLEAN DEFAULT FALSE,
+			read_status BOOLEAN DEFAULT FALSE,
+			status TEXT DEFAULT 'sent',
+			reply_to JSONB DEFAULT NULL
+		);`,
+		Down: `DROP TABLE IF EXISTS messages;`,
+	},
+	{
+		Version: 2,
+		Name:    "create_groups",
+		Up: `CREATE TABLE groups (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT now(),
+			avatar_url TEXT
+		);`,
+		Down: `DROP TABLE IF EXISTS groups;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_group_members",
+		Up: `CREATE TABLE group_members (
+			group_id TEXT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL,
+			role TEXT DEFAULT 'member',
+			joined_at TIMESTAMPTZ DEFAULT now(),
+			is_muted BOOLEAN DEFAULT FALSE,
+			is_banned BOOLEAN DEFAULT FALSE,
+			PRIMARY KEY (group_id, user_id)
+		);
+		CREATE INDEX idx_group_members_user ON group_members(user_id);`,
+		Down: `DROP TABLE IF EXISTS group_members;`,
+	},
+	{
+		Version: 4,
+		Name:    "create_group_messages",
+		Up: `CREATE TABLE group_messages (
+			id TEXT PRIMARY KEY,
+			group_id TEXT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+			from_id TEXT NOT NULL,
+			content TEXT,
+			timestamp TIMESTAMPTZ DEFAULT now(),
+			delivered BOOLEAN DEFAULT TRUE,
+			read_by JSONB NOT NULL DEFAULT '[]'::jsonb,
+			status TEXT DEFAULT 'sent',
+			reply_to JSONB
+		);
+		CREATE INDEX idx_group_messages_group ON group_messages(group_id);
+		CREATE INDEX idx_group_messages_timestamp ON group_messages(timestamp);`,
+		Down: `DROP TABLE IF EXISTS group_messages;`,
+	},
+	{
+		Version: 5,
+		Name:    "create_user_presence",
+		Up: `CREATE TABLE user_presence (
+			user_id TEXT PRIMARY KEY,
+			online BOOLEAN DEFAULT FALSE,
+			last_seen TIMESTAMPTZ
+		);`,
+		Down: `DROP TABLE IF EXISTS user_presence;`,
+	},
+	{
+		// Search columns are generated from content, so they are backfilled
+		// on creation and follow every later write
+		Version: 6,
+		Name:    "create_message_search",
+		Up: `CREATE FUNCTION message_search_text(content TEXT) RETURNS TEXT AS $$
+			DECLARE
+				doc JSONB;
+			BEGIN
+				BEGIN
+					doc := content::jsonb;
+				EXCEPTION WHEN others THEN
+					RETURN content;
+				END;
+				IF jsonb_typeof(doc) <> 'object' THEN
+					RETURN content;
+				END IF;
+				RETURN concat_ws(' ', doc->>'text', doc#>>'{file,name}');
+			END;
+			$$ LANGUAGE plpgsql IMMUTABLE;
+
+			CREATE FUNCTION message_has_file(content TEXT) RETURNS BOOLEAN AS $$
+			BEGIN
+				RETURN COALESCE(jsonb_typeof(content::jsonb->'file') = 'object', FALSE);
+			EXCEPTION WHEN others THEN
+				RETURN FALSE;
+			END;
+			$$ LANGUAGE plpgsql IMMUTABLE;
+
+			ALTER TABLE messages
+				ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', message_search_text(content))) STORED,
+				ADD COLUMN has_file BOOLEAN GENERATED ALWAYS AS (message_has_file(content)) STORED;
+			CREATE INDEX idx_messages_search ON messages USING GIN (search_vector);
+
+			ALTER TABLE group_messages
+				ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', message_search_text(content))) STORED,
+				ADD COLUMN has_file BOOLEAN GENERATED ALWAYS AS (message_has_file(content)) STORED;
+			CREATE INDEX idx_group_messages_search ON group_messages USING GIN (search_vector);`,
+		Down: `ALTER TABLE messages DROP COLUMN IF EXISTS search_vector, DROP COLUMN IF EXISTS has_file;
+			ALTER TABLE group_messages DROP COLUMN IF EXISTS search_vector, DROP COLUMN IF EXISTS has_file;
+			DROP FUNCTION IF EXISTS message_search_text(TEXT);
+			DROP FUNCTION IF EXISTS message_has_file(TEXT);`,
+	},
+	{
+		// Sequence numbers give each conversation (direct pair or group) a
+		// server-assigned order; existing rows are numbered by timestamp
+		Version: 7,
+		Name:    "add_message_sequences",
+		Up: `ALTER TABLE messages ADD COLUMN conversation_id TEXT;
+			ALTER TABLE messages ADD COLUMN seq BIGINT;
+			UPDATE messages SET conversation_id = CASE WHEN from_id < to_id
+				THEN from_id || ':' || to_id ELSE to_id || ':' || from_id END;
+			UPDATE messages SET seq = r.rn FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY timestamp, id) AS rn FROM messages
+			) AS r WHERE r.id = messages.id;
+			CREATE UNIQUE INDEX idx_messages_conversation_seq ON messages(conversation_id, seq);
+
+			ALTER TABLE group_messages ADD COLUMN seq BIGINT;
+			UPDATE group_messages SET seq = r.rn FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY group_id ORDER BY timestamp, id) AS rn FROM group_messages
+			) AS r WHERE r.id = group_messages.id;
+			CREATE UNIQUE INDEX idx_group_messages_seq ON group_messages(group_id, seq);
+
+			CREATE TABLE conversation_sequences (
+				conversation_id TEXT PRIMARY KEY,
+				last_seq BIGINT NOT NULL
+			);
+			INSERT INTO conversation_sequences (conversation_id, last_seq)
+				SELECT conversation_id, MAX(seq) FROM messages GROUP BY conversation_id;
+			INSERT INTO conversation_sequences (conversation_id, last_seq)
+				SELECT group_id, MAX(seq) FROM group_messages GROUP BY group_id;`,
+		Down: `DROP TABLE IF EXISTS conversation_sequences;
+			DROP INDEX IF EXISTS idx_group_messages_seq;
+			ALTER TABLE group_messages DROP COLUMN seq;
+			DROP INDEX IF EXISTS idx_messages_conversation_seq;
+			ALTER TABLE messages DROP COLUMN seq;
+			ALTER TABLE messages DROP COLUMN conversation_id;`,
+	},
+	{
+		// Per-member receipts for group messages, superseding read_by, which
+		// is backfilled into it
+		Version: 8,
+		Name:    "create_group_message_receipts",
+		Up: `CREATE TABLE group_message_receipts (
+				message_id TEXT NOT NULL REFERENCES group_messages(id) ON DELETE CASCADE,
+				user_id TEXT NOT NULL,
+				delivered_at TIMESTAMPTZ,
+				read_at TIMESTAMPTZ,
+				PRIMARY KEY (message_id, user_id)
+			);
+			INSERT INTO group_message_receipts (message_id, user_id, delivered_at, read_at)
+				SELECT DISTINCT gm.id, j.value, gm.timestamp, gm.timestamp
+				FROM group_messages gm
+				CROSS JOIN LATERAL jsonb_array_elements_text(
+					CASE WHEN jsonb_typeof(gm.read_by) = 'array' THEN gm.read_by ELSE '[]'::jsonb END
+				) AS j(value);`,
+		Down: `DROP TABLE IF EXISTS group_message_receipts;`,
+	},
+	{
+		// How far each device of a user has synced, per conversation
+		Version: 9,
+		Name:    "create_sync_cursors",
+		Up: `CREATE TABLE sync_cursors (
+				user_id TEXT NOT NULL,
+				device_id TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				seq BIGINT NOT NULL,
+				updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (user_id, device_id, conversation_id)
+			);`,
+		Down: `DROP TABLE IF EXISTS sync_cursors;`,
+	},
+	{
+		// Registered users and their login sessions
+		Version: 10,
+		Name:    "create_users_and_sessions",
+		Up: `CREATE TABLE users (
+				id TEXT PRIMARY KEY,
+				password_hash TEXT NOT NULL,
+				created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE sessions (
+				token_hash TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+				expires_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX idx_sessions_user ON sessions(user_id);`,
+		Down: `DROP TABLE IF EXISTS sessions;
+			DROP TABLE IF EXISTS users;`,
+	},
+	{
+		// Profile fields shown to other users
+		Version: 11,
+		Name:    "add_user_profiles",
+		Up: `ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+			ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+			ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';`,
+		Down: `ALTER TABLE users DROP COLUMN bio;
+			ALTER TABLE users DROP COLUMN avatar_url;
+			ALTER TABLE users DROP COLUMN display_name;`,
+	},
+	{
+		// Registry of issued user ids, backfilled with every id already in use
+		Version: 12,
+		Name:    "create_user_ids",
+		Up: `CREATE TABLE user_ids (
+				id TEXT PRIMARY KEY,
+				issued_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+			);
+			INSERT INTO user_ids (id)
+				SELECT id FROM (
+					SELECT id FROM users
+					UNION SELECT from_id FROM messages
+					UNION SELECT to_id FROM messages
+					UNION SELECT user_id FROM group_members
+					UNION SELECT from_id FROM group_messages
+					UNION SELECT user_id FROM user_presence
+				) used
+				WHERE id <> '' AND id NOT LIKE 'GROUP%';`,
+		Down: `DROP TABLE IF EXISTS user_ids;`,
+	},
+	{
+		// Per-user contact lists with nicknames, and the users each user has blocked
+		Version: 13,
+		Name:    "create_contacts_and_blocks",
+		Up: `CREATE TABLE contacts (
+				owner_id TEXT NOT NULL,
+				contact_id TEXT NOT NULL,
+				nickname TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (owner_id, contact_id)
+			);
+			CREATE TABLE blocks (
+				blocker_id TEXT NOT NULL,
+				blocked_id TEXT NOT NULL,
+				created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (blocker_id, blocked_id)
+			);`,
+		Down: `DROP TABLE IF EXISTS blocks;
+			DROP TABLE IF EXISTS contacts;`,
+	},
+	{
+		// Per-user privacy settings; presence is shown to contacts and group co-members by default
+		Version: 14,
+		Name:    "create_privacy_settings",
+		Up: `CREATE TABLE privacy_settings (
+				user_id TEXT PRIMARY KEY,
+				presence TEXT NOT NULL DEFAULT 'contacts',
+				updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+			);`,
+		Down: `DROP TABLE IF EXISTS privacy_settings;`,
+	},
+	{
+		// Chosen presence state and custom status text, kept across connections
+		Version: 15,
+		Name:    "add_presence_state",
+		Up: `ALTER TABLE user_presence ADD COLUMN state TEXT NOT NULL DEFAULT 'available';
+			ALTER TABLE user_presence ADD COLUMN status_text TEXT NOT NULL DEFAULT '';`,
+		Down: `ALTER TABLE user_presence DROP COLUMN status_text;
+			ALTER TABLE user_presence DROP COLUMN state;`,
+	},
+	{
+		// Edit flag on messages and the log of edits, which keeps the replaced content
+		// and doubles as the feed offline devices catch up from
+		Version: 16,
+		Name:    "add_message_edits",
+		Up: `ALTER TABLE messages ADD COLUMN edited_at TIMESTAMPTZ;
+			ALTER TABLE group_messages ADD COLUMN edited_at TIMESTAMPTZ;
+			CREATE TABLE message_edits (
+				seq BIGSERIAL PRIMARY KEY,
+				message_id TEXT NOT NULL,
+				group_id TEXT NOT NULL DEFAULT '',
+				from_id TEXT NOT NULL,
+				to_id TEXT NOT NULL,
+				previous_content TEXT NOT NULL,
+				content TEXT NOT NULL,
+				edited_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX idx_message_edits_message ON message_edits(group_id, message_id);`,
+		Down: `DROP TABLE IF EXISTS message_edits;
+			ALTER TABLE group_messages DROP COLUMN edited_at;
+			ALTER TABLE messages DROP COLUMN edited_at;`,
+	},
+	{
+		// Messages sent to a recipient who blocked the sender, and edits made while
+		// blocked, are kept for the sender but hidden from the recipient. Version 17
+		// only concerned the SQLite search index.
+		Version: 18,
+		Name:    "add_hidden_messages",
+		Up: `ALTER TABLE messages ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE message_edits ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;`,
+		Down: `ALTER TABLE message_edits DROP COLUMN hidden;
+			ALTER TABLE messages DROP COLUMN hidden;`,
+	},
+	{
+		// Claims let whoever was handed an id register it; ids without one, such as
+		// those backfilled in version 12, need a claim issued with the claim-id command
+		Version: 19,
+		Name:    "add_id_claims",
+		Up: `ALTER TABLE user_ids ADD COLUMN claim_hash TEXT;
+			ALTER TABLE user_ids ADD COLUMN claim_expires_at TIMESTAMPTZ;`,
+		Down: `ALTER TABLE user_ids DROP COLUMN claim_expires_at;
+			ALTER TABLE user_ids DROP COLUMN claim_hash;`,
+	},
+	{
+		// Senders pick message ids themselves, so retries are recognised by sender and
+		// client id; a message whose id another sender took is stored under a new one
+		Version: 20,
+		Name:    "add_message_client_ids",
+		Up: `ALTER TABLE messages ADD COLUMN client_id TEXT;
+			UPDATE messages SET client_id = id;
+			CREATE UNIQUE INDEX idx_messages_client_id ON messages(from_id, client_id);
+			ALTER TABLE group_messages ADD COLUMN client_id TEXT;
+			UPDATE group_messages SET client_id = id;
+			CREATE UNIQUE INDEX idx_group_messages_client_id ON group_messages(from_id, client_id);`,
+		Down: `DROP INDEX IF EXISTS idx_group_messages_client_id;
+			ALTER TABLE group_messages DROP COLUMN client_id;
+			DROP INDEX IF EXISTS idx_messages_client_id;
+			ALTER TABLE messages DROP COLUMN client_id;`,
+	},
+}
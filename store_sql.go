@@ -0,0 +1,1575 @@
+// store_sql.go - database/sql implementation of the storage interfaces (SQLite and PostgreSQL)
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore implements MessageStore, GroupStore and PresenceStore on top of a SQL
+// database. Queries are written with ? placeholders and rebound for the dialect.
+type sqlStore struct {
+	db       *sql.DB
+	dialect  string // "sqlite" or "postgres"
+	fullText bool   // SQLite only: the FTS5 search index exists
+}
+
+func newSQLiteStore(path string, autoMigrate bool) (*sqlStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection queues writers instead of
+	// failing them with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s := &sqlStore{db: db, dialect: "sqlite"}
+	if err := s.checkSearchIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.prepareSchema(autoMigrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if s.fullText, err = sqliteHasSearchIndex(s.db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !s.fullText {
+		log.Printf("No full-text search index; search scans messages instead (build with -tags sqlite_fts5 to index them)")
+	}
+
+	if err := s.resetPresence(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// resetPresence marks everyone offline: nobody is connected to a freshly
+// started server
+func (s *sqlStore) resetPresence() error {
+	if _, err := s.db.Exec("UPDATE user_presence SET online = FALSE"); err != nil {
+		return fmt.Errorf("resetting presence: %w", err)
+	}
+	return nil
+}
+
+// sqliteHasFTS5 reports whether the linked SQLite can maintain the search
+// index. go-sqlite3 only compiles FTS5 in with the sqlite_fts5 build tag.
+func sqliteHasFTS5(db *sql.DB) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	return enabled, err
+}
+
+// sqliteHasSearchIndex reports whether the database has the FTS5 search index
+func sqliteHasSearchIndex(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'").Scan(&count)
+	return count > 0, err
+}
+
+// checkSearchIndex refuses a database indexed by a build with FTS5 when this
+// one lacks it: the index triggers would fail every new message.
+func (s *sqlStore) checkSearchIndex() error {
+	enabled, err := sqliteHasFTS5(s.db)
+	if err != nil || enabled {
+		return err
+	}
+	indexed, err := sqliteHasSearchIndex(s.db)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		return fmt.Errorf("the database has a full-text search index but SQLite was built without FTS5; build the server with -tags sqlite_fts5")
+	}
+	return nil
+}
+
+func (s *sqlStore) migrator() *migrator {
+	return newMigrator(s.db, s.dialect)
+}
+
+// prepareSchema applies pending migrations, or with autoMigrate disabled
+// refuses to run against a schema that is not up to date. A search index left
+// out by a build without FTS5 is built either way.
+func (s *sqlStore) prepareSchema(autoMigrate bool) error {
+	m := s.migrator()
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return m.ensureSearchIndex()
+	}
+	if !autoMigrate {
+		return fmt.Errorf("database schema has %d pending migrations; run the migrate command first", len(pending))
+	}
+	return m.Up(m.latestVersion())
+}
+
+// rebind rewrites ? placeholders into the $n form PostgreSQL expects
+func rebind(dialect, query string) string {
+	if dialect != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Close closes the database once in-flight queries have finished
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) rebind(query string) string {
+	return rebind(s.dialect, query)
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// Helpers for converting between Go values and their column representation
+
+func encodeReplyTo(replyTo *ReplyMetadata) sql.NullString {
+	if replyTo == nil {
+		return sql.NullString{}
+	}
+	replyToBytes, err := json.Marshal(replyTo)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(replyToBytes), Valid: true}
+}
+
+func decodeReplyTo(replyToJSON sql.NullString) *ReplyMetadata {
+	if !replyToJSON.Valid {
+		return nil
+	}
+	var replyTo ReplyMetadata
+	if err := json.Unmarshal([]byte(replyToJSON.String), &replyTo); err != nil {
+		return nil
+	}
+	return &replyTo
+}
+
+// decodeEditedAt sets the edit flag of a message from its edited_at column
+func decodeEditedAt(editedAt sql.NullTime) (bool, *time.Time) {
+	if !editedAt.Valid {
+		return false, nil
+	}
+	return true, &editedAt.Time
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Direct messages
+
+const messageColumns = "id, from_id, to_id, content, timestamp, delivered, read_status, status, reply_to, seq, edited_at, hidden"
+
+// visibleMessage limits a query to messages the user given as its argument
+// may see: hidden messages exist only for their sender
+const visibleMessage = " AND (hidden = FALSE OR from_id = ?)"
+
+func scanMessage(row rowScanner) (Message, error) {
+	var msg Message
+	var content string
+	var status sql.NullString
+	var replyToJSON sql.NullString
+	var editedAt sql.NullTime
+	err := row.Scan(
+		&msg.ID,
+		&msg.FromID,
+		&msg.ToID,
+		&content,
+		&msg.Timestamp,
+		&msg.Delivered,
+		&msg.ReadStatus,
+		&status,
+		&replyToJSON,
+		&msg.Seq,
+		&editedAt,
+		&msg.Hidden,
+	)
+	if err != nil {
+		return msg, err
+	}
+	msg.Content = content
+	msg.Status = status.String
+	msg.ReplyTo = decodeReplyTo(replyToJSON)
+	msg.Edited, msg.EditedAt = decodeEditedAt(editedAt)
+	return msg, nil
+}
+
+func (s *sqlStore) queryMessages(query string, args ...interface{}) ([]Message, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// nextSeq allocates the next sequence number of a conversation. Allocating
+// inside the inserting transaction keeps the numbers free of gaps.
+func (s *sqlStore) nextSeq(tx *sql.Tx, conversationID string) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(s.rebind(
+		`INSERT INTO conversation_sequences (conversation_id, last_seq) VALUES (?, 1)
+		ON CONFLICT (conversation_id) DO UPDATE SET last_seq = conversation_sequences.last_seq + 1
+		RETURNING last_seq`),
+		conversationID,
+	).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("allocating sequence number: %w", err)
+	}
+	return seq, nil
+}
+
+// insertedOrDuplicate checks whether an INSERT ... ON CONFLICT DO NOTHING
+// wrote its row. When it did not, the sender's message with the same client id
+// is loaded through load and returned as the original of a resubmission; if
+// the sender has none, the id clashed with another sender's message.
+func insertedOrDuplicate[T any](result sql.Result, load func() (T, error)) (bool, T, error) {
+	var existing T
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return affected > 0, existing, err
+	}
+	existing, err = load()
+	if err == sql.ErrNoRows {
+		return false, existing, ErrMessageIDTaken
+	}
+	if err != nil {
+		return false, existing, err
+	}
+	return false, existing, ErrDuplicateMessage
+}
+
+func (s *sqlStore) SaveMessage(msg Message) (Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return msg, err
+	}
+	defer tx.Rollback()
+
+	conversationID := directConversationID(msg.FromID, msg.ToID)
+	sentID := senderMessageID(msg.ID, msg.ClientID)
+	seq, err := s.nextSeq(tx, conversationID)
+	if err != nil {
+		return msg, err
+	}
+
+	result, err := tx.Exec(s.rebind(
+		"INSERT INTO messages (conversation_id, client_id, "+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, ?) ON CONFLICT DO NOTHING"),
+		conversationID,
+		sentID,
+		msg.ID,
+		msg.FromID,
+		msg.ToID,
+		encodeContent(msg.Content),
+		msg.Timestamp.UTC(),
+		msg.Delivered,
+		msg.ReadStatus,
+		msg.Status,
+		encodeReplyTo(msg.ReplyTo),
+		seq,
+		msg.Hidden,
+	)
+	if err != nil {
+		return msg, err
+	}
+
+	// A resubmission rolls back, returning its sequence number to the pool
+	inserted, existing, err := insertedOrDuplicate(result, func() (Message, error) {
+		m, err := scanMessage(tx.QueryRow(s.rebind("SELECT "+messageColumns+" FROM messages WHERE from_id = ? AND client_id = ?"), msg.FromID, sentID))
+		if err == nil && m.ID != sentID {
+			m.ClientID = sentID
+		}
+		return m, err
+	})
+	if !inserted {
+		return existing, err
+	}
+
+	msg.Seq = seq
+	return msg, tx.Commit()
+}
+
+func (s *sqlStore) UpdateMessageStatus(messageID string, delivered bool, read bool) error {
+	status := "sent"
+	if read {
+		status = "read"
+	} else if delivered {
+		status = "delivered"
+	}
+
+	_, err := s.exec(
+		"UPDATE messages SET delivered = ?, read_status = ?, status = ? WHERE id = ?",
+		delivered, read, status, messageID,
+	)
+	return err
+}
+
+func (s *sqlStore) GetMessage(messageID string) (*Message, error) {
+	msg, err := scanMessage(s.queryRow("SELECT "+messageColumns+" FROM messages WHERE id = ?", messageID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *sqlStore) MarkDelivered(messageID, toID string) (bool, error) {
+	result, err := s.exec(
+		"UPDATE messages SET delivered = TRUE WHERE id = ? AND to_id = ? AND delivered = FALSE AND hidden = FALSE",
+		messageID, toID,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// receiptUpdate returns the assignments for a receipt and the condition
+// selecting messages it would change
+func receiptUpdate(read bool) (string, string) {
+	if read {
+		return "delivered = TRUE, read_status = TRUE, status = 'read'", "read_status = FALSE"
+	}
+	return "delivered = TRUE, status = 'delivered'", "delivered = FALSE"
+}
+
+func (s *sqlStore) MarkReceipts(readerID string, messageIDs []string, read bool) ([]Message, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	set, pending := receiptUpdate(read)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messageIDs)), ", ")
+	args := []interface{}{readerID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	return s.queryMessages(
+		"UPDATE messages SET "+set+" WHERE to_id = ? AND id IN ("+placeholders+") AND "+pending+
+			" AND hidden = FALSE RETURNING "+messageColumns,
+		args...,
+	)
+}
+
+func (s *sqlStore) MarkReceiptsUpTo(readerID, contactID string, seq int64, read bool) ([]Message, error) {
+	set, pending := receiptUpdate(read)
+	return s.queryMessages(
+		"UPDATE messages SET "+set+" WHERE conversation_id = ? AND to_id = ? AND seq <= ? AND "+pending+
+			" AND hidden = FALSE RETURNING "+messageColumns,
+		directConversationID(readerID, contactID), readerID, seq,
+	)
+}
+
+func (s *sqlStore) GetUserMessages(userID string) ([]Message, error) {
+	return s.queryMessages(
+		"SELECT "+messageColumns+" FROM messages WHERE (from_id = ? OR to_id = ?)"+visibleMessage+" ORDER BY timestamp ASC",
+		userID, userID, userID,
+	)
+}
+
+func (s *sqlStore) GetUndeliveredMessages(userID string) ([]Message, error) {
+	return s.queryMessages(
+		"SELECT "+messageColumns+" FROM messages WHERE to_id = ? AND delivered = FALSE AND hidden = FALSE ORDER BY timestamp ASC",
+		userID,
+	)
+}
+
+func (s *sqlStore) GetMessagePage(userID, contactID string, q historyQuery) ([]Message, bool, error) {
+	where := "(from_id = ? OR to_id = ?)"
+	args := []interface{}{userID, userID}
+	if contactID != "" {
+		where = "((from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?))"
+		args = []interface{}{userID, contactID, contactID, userID}
+	}
+	args = append(args, userID)
+
+	cond, condArgs, order := q.sqlClause()
+	args = append(append(args, condArgs...), q.Limit+1)
+	messages, err := s.queryMessages(
+		"SELECT "+messageColumns+" FROM messages WHERE "+where+visibleMessage+cond+" ORDER BY "+order+" LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	messages, hasMore := trimPage(messages, q)
+	return messages, hasMore, nil
+}
+
+func (s *sqlStore) GetMessagesAfterSeq(userID, contactID string, afterSeq int64, limit int) ([]Message, bool, error) {
+	messages, err := s.queryMessages(
+		"SELECT "+messageColumns+" FROM messages WHERE conversation_id = ? AND seq > ?"+visibleMessage+" ORDER BY seq LIMIT ?",
+		directConversationID(userID, contactID), afterSeq, userID, limit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	messages, hasMore := trimSeqPage(messages, limit)
+	return messages, hasMore, nil
+}
+
+func (s *sqlStore) GetContactIDs(userID string) ([]string, error) {
+	return s.queryStrings(
+		`SELECT DISTINCT CASE WHEN from_id = ? THEN to_id ELSE from_id END AS contact_id
+		FROM messages WHERE (from_id = ? OR to_id = ?)`+visibleMessage+` ORDER BY contact_id`,
+		userID, userID, userID, userID,
+	)
+}
+
+func (s *sqlStore) DeleteConversation(userID, contactID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.rebind(
+		"DELETE FROM messages WHERE (from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?)"),
+		userID, contactID, contactID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.rebind(
+		"DELETE FROM message_edits WHERE group_id = '' AND ((from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?))"),
+		userID, contactID, contactID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Groups
+
+func (s *sqlStore) CreateGroup(group Group, memberIDs []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.rebind(
+		"INSERT INTO groups (id, name, description, created_by, created_at) VALUES (?, ?, ?, ?, ?)"),
+		group.ID, group.Name, group.Description, group.CreatedBy, group.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("creating group: %w", err)
+	}
+
+	_, err = tx.Exec(s.rebind(
+		"INSERT INTO group_members (group_id, user_id, role) VALUES (?, ?, 'admin')"),
+		group.ID, group.CreatedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("adding creator: %w", err)
+	}
+
+	for _, userID := range memberIDs {
+		if userID == group.CreatedBy || userID == "" {
+			continue
+		}
+		_, err = tx.Exec(s.rebind(
+			"INSERT INTO group_members (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING"),
+			group.ID, userID,
+		)
+		if err != nil {
+			return fmt.Errorf("adding member %s: %w", userID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+const groupColumns = `g.id, g.name, g.description, g.created_by, g.created_at, g.avatar_url,
+	(SELECT COUNT(*) FROM group_members WHERE group_id = g.id) AS member_count`
+
+func scanGroup(row rowScanner) (Group, error) {
+	var g Group
+	var description, avatarURL sql.NullString
+	err := row.Scan(&g.ID, &g.Name, &description, &g.CreatedBy, &g.CreatedAt, &avatarURL, &g.MemberCount)
+	g.Description = description.String
+	g.AvatarURL = avatarURL.String
+	return g, err
+}
+
+func (s *sqlStore) GetGroup(groupID string) (*Group, error) {
+	g, err := scanGroup(s.queryRow("SELECT "+groupColumns+" FROM groups g WHERE g.id = ?", groupID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *sqlStore) GetUserGroups(userID string) ([]Group, error) {
+	rows, err := s.query(
+		"SELECT "+groupColumns+` FROM groups g
+		WHERE g.id IN (
+			SELECT group_id FROM group_members WHERE user_id = ? AND is_banned = FALSE
+		)`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (s *sqlStore) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (s *sqlStore) GetUserGroupIDs(userID string) ([]string, error) {
+	return s.queryStrings(
+		"SELECT group_id FROM group_members WHERE user_id = ? AND is_banned = FALSE",
+		userID,
+	)
+}
+
+const memberColumns = "group_id, user_id, role, joined_at, is_muted, is_banned"
+
+func scanMember(row rowScanner) (GroupMember, error) {
+	var m GroupMember
+	err := row.Scan(&m.GroupID, &m.UserID, &m.Role, &m.JoinedAt, &m.IsMuted, &m.IsBanned)
+	return m, err
+}
+
+func (s *sqlStore) GetMember(groupID, userID string) (*GroupMember, error) {
+	m, err := scanMember(s.queryRow(
+		"SELECT "+memberColumns+" FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupID, userID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *sqlStore) GetMembers(groupID string) ([]GroupMember, error) {
+	rows, err := s.query(
+		"SELECT "+memberColumns+" FROM group_members WHERE group_id = ? ORDER BY role DESC, joined_at ASC",
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []GroupMember
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *sqlStore) GetActiveMemberIDs(groupID string) ([]string, error) {
+	return s.queryStrings(
+		"SELECT user_id FROM group_members WHERE group_id = ? AND is_banned = FALSE",
+		groupID,
+	)
+}
+
+func (s *sqlStore) AddMember(groupID, userID string) error {
+	_, err := s.exec(
+		"INSERT INTO group_members (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		groupID, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) RemoveMember(groupID, userID string) error {
+	_, err := s.exec(
+		"DELETE FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupID, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetMuted(groupID, userID string, muted bool) error {
+	_, err := s.exec(
+		"UPDATE group_members SET is_muted = ? WHERE group_id = ? AND user_id = ?",
+		muted, groupID, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetBanned(groupID, userID string, banned bool) error {
+	_, err := s.exec(
+		"UPDATE group_members SET is_banned = ? WHERE group_id = ? AND user_id = ?",
+		banned, groupID, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetRole(groupID, userID, role string) error {
+	_, err := s.exec(
+		"UPDATE group_members SET role = ? WHERE group_id = ? AND user_id = ?",
+		role, groupID, userID,
+	)
+	return err
+}
+
+func (s *sqlStore) ShareGroup(userA, userB string) (bool, error) {
+	var exists int
+	err := s.queryRow(
+		`SELECT 1 FROM group_members a JOIN group_members b ON a.group_id = b.group_id
+		WHERE a.user_id = ? AND b.user_id = ? AND a.is_banned = FALSE AND b.is_banned = FALSE LIMIT 1`,
+		userA, userB,
+	).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) GetCoMemberIDs(userID string) ([]string, error) {
+	return s.queryStrings(
+		`SELECT DISTINCT b.user_id FROM group_members a JOIN group_members b ON a.group_id = b.group_id
+		WHERE a.user_id = ? AND b.user_id != a.user_id AND a.is_banned = FALSE AND b.is_banned = FALSE`,
+		userID,
+	)
+}
+
+func (s *sqlStore) CountAdmins(groupID string) (int, error) {
+	var count int
+	err := s.queryRow(
+		"SELECT COUNT(*) FROM group_members WHERE group_id = ? AND role = 'admin'",
+		groupID,
+	).Scan(&count)
+	return count, err
+}
+
+// Group messages
+
+func (s *sqlStore) SaveGroupMessage(msg GroupMessage) (GroupMessage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return msg, err
+	}
+	defer tx.Rollback()
+
+	sentID := senderMessageID(msg.ID, msg.ClientID)
+	seq, err := s.nextSeq(tx, msg.GroupID)
+	if err != nil {
+		return msg, err
+	}
+
+	result, err := tx.Exec(s.rebind(
+		"INSERT INTO group_messages (id, client_id, group_id, from_id, content, timestamp, status, reply_to, seq) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING"),
+		msg.ID, sentID, msg.GroupID, msg.FromID, encodeContent(msg.Content), msg.Timestamp.UTC(),
+		msg.Status, encodeReplyTo(msg.ReplyTo), seq,
+	)
+	if err != nil {
+		return msg, err
+	}
+
+	inserted, existing, err := insertedOrDuplicate(result, func() (GroupMessage, error) {
+		m, err := scanGroupMessage(tx.QueryRow(s.rebind("SELECT "+s.groupMessageColumns()+" FROM group_messages WHERE from_id = ? AND client_id = ?"), msg.FromID, sentID))
+		if err == nil && m.ID != sentID {
+			m.ClientID = sentID
+		}
+		return m, err
+	})
+	if !inserted {
+		return existing, err
+	}
+
+	// Whoever the message starts out read by (its sender) has it already
+	for _, userID := range msg.ReadBy {
+		_, err := tx.Exec(s.rebind(
+			"INSERT INTO group_message_receipts (message_id, user_id, delivered_at, read_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING"),
+			msg.ID, userID, msg.Timestamp.UTC(), msg.Timestamp.UTC(),
+		)
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	msg.Seq = seq
+	return msg, tx.Commit()
+}
+
+// groupMessageColumns lists the columns read by scanGroupMessage. read_by is
+// collected from group_message_receipts as a JSON array.
+func (s *sqlStore) groupMessageColumns() string {
+	readBy := "(SELECT json_group_array(user_id) FROM group_message_receipts r WHERE r.message_id = group_messages.id AND r.read_at IS NOT NULL)"
+	if s.dialect == "postgres" {
+		readBy = "(SELECT COALESCE(json_agg(user_id ORDER BY read_at), '[]'::json)::text FROM group_message_receipts r WHERE r.message_id = group_messages.id AND r.read_at IS NOT NULL)"
+	}
+	return "id, group_id, from_id, content, timestamp, delivered, " + readBy + ", status, reply_to, seq, edited_at"
+}
+
+func scanGroupMessage(row rowScanner) (GroupMessage, error) {
+	var m GroupMessage
+	var content, readByJSON string
+	var replyToJSON sql.NullString
+	var editedAt sql.NullTime
+
+	err := row.Scan(
+		&m.ID, &m.GroupID, &m.FromID, &content,
+		&m.Timestamp, &m.Delivered, &readByJSON, &m.Status, &replyToJSON, &m.Seq, &editedAt,
+	)
+	if err != nil {
+		return m, err
+	}
+
+	m.Content = content
+	json.Unmarshal([]byte(readByJSON), &m.ReadBy)
+	m.ReplyTo = decodeReplyTo(replyToJSON)
+	m.Edited, m.EditedAt = decodeEditedAt(editedAt)
+	return m, nil
+}
+
+func (s *sqlStore) queryGroupMessages(query string, args ...interface{}) ([]GroupMessage, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []GroupMessage
+	for rows.Next() {
+		m, err := scanGroupMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func (s *sqlStore) GetRecentGroupMessages(groupID string, limit int) ([]GroupMessage, error) {
+	messages, _, err := s.GetGroupMessagePage(groupID, historyQuery{Limit: limit})
+	return messages, err
+}
+
+func (s *sqlStore) GetGroupMessagePage(groupID string, q historyQuery) ([]GroupMessage, bool, error) {
+	cond, condArgs, order := q.sqlClause()
+	args := append(append([]interface{}{groupID}, condArgs...), q.Limit+1)
+	messages, err := s.queryGroupMessages(
+		"SELECT "+s.groupMessageColumns()+" FROM group_messages WHERE group_id = ?"+cond+" ORDER BY "+order+" LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	messages, hasMore := trimPage(messages, q)
+	return messages, hasMore, nil
+}
+
+func (s *sqlStore) GetGroupMessage(groupID, messageID string) (*GroupMessage, error) {
+	m, err := scanGroupMessage(s.queryRow(
+		"SELECT "+s.groupMessageColumns()+" FROM group_messages WHERE group_id = ? AND id = ?",
+		groupID, messageID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// forUpdate locks the rows a transaction reads before changing them, so that
+// concurrent writers on PostgreSQL queue up. SQLite transactions on the single
+// connection are serialized already.
+func (s *sqlStore) forUpdate() string {
+	if s.dialect == "postgres" {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// timestampParam is a placeholder for a timestamp in a select list, where
+// PostgreSQL cannot infer the parameter type
+func (s *sqlStore) timestampParam() string {
+	if s.dialect == "postgres" {
+		return "CAST(? AS TIMESTAMPTZ)"
+	}
+	return "?"
+}
+
+// markGroupReceipts records a receipt from userID for the messages of a group
+// selected by cond, skipping their own messages and messages the receipt would
+// not change. It returns the messages that changed.
+func (s *sqlStore) markGroupReceipts(groupID, userID string, read bool, cond string, condArgs ...interface{}) ([]GroupMessage, error) {
+	pending := "delivered_at IS NOT NULL"
+	if read {
+		pending = "read_at IS NOT NULL"
+	}
+	where := " WHERE group_id = ? AND from_id <> ?" + cond +
+		" AND NOT EXISTS (SELECT 1 FROM group_message_receipts r WHERE r.message_id = group_messages.id AND r.user_id = ? AND r." + pending + ")"
+	args := append(append([]interface{}{groupID, userID}, condArgs...), userID)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(s.rebind("SELECT "+s.groupMessageColumns()+" FROM group_messages"+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	var changed []GroupMessage
+	for rows.Next() {
+		m, err := scanGroupMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changed = append(changed, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(changed) == 0 {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var readAt interface{}
+	if read {
+		readAt = now
+	}
+	_, err = tx.Exec(s.rebind(
+		"INSERT INTO group_message_receipts (message_id, user_id, delivered_at, read_at) SELECT id, CAST(? AS TEXT), "+
+			s.timestampParam()+", "+s.timestampParam()+" FROM group_messages"+where+
+			` ON CONFLICT (message_id, user_id) DO UPDATE SET
+			delivered_at = COALESCE(group_message_receipts.delivered_at, excluded.delivered_at),
+			read_at = COALESCE(group_message_receipts.read_at, excluded.read_at)`),
+		append([]interface{}{userID, now, readAt}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return changed, tx.Commit()
+}
+
+func (s *sqlStore) MarkGroupReceipts(groupID, userID string, messageIDs []string, read bool) ([]GroupMessage, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messageIDs)), ", ")
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	return s.markGroupReceipts(groupID, userID, read, " AND id IN ("+placeholders+")", args...)
+}
+
+func (s *sqlStore) MarkGroupReceiptsUpTo(groupID, userID string, seq int64, read bool) ([]GroupMessage, error) {
+	return s.markGroupReceipts(groupID, userID, read, " AND seq <= ?", seq)
+}
+
+func (s *sqlStore) GetGroupMessageReceipts(groupID, messageID string) ([]GroupReceipt, error) {
+	var fromID string
+	err := s.queryRow("SELECT from_id FROM group_messages WHERE id = ? AND group_id = ?", messageID, groupID).Scan(&fromID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.query(
+		"SELECT user_id, delivered_at, read_at FROM group_message_receipts WHERE message_id = ? AND user_id <> ? ORDER BY delivered_at, user_id",
+		messageID, fromID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []GroupReceipt{}
+	for rows.Next() {
+		var r GroupReceipt
+		var deliveredAt, readAt sql.NullTime
+		if err := rows.Scan(&r.UserID, &deliveredAt, &readAt); err != nil {
+			return nil, err
+		}
+		if deliveredAt.Valid {
+			r.DeliveredAt = &deliveredAt.Time
+		}
+		if readAt.Valid {
+			r.ReadAt = &readAt.Time
+		}
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+// Search
+
+// searchSource returns the FROM clause and text condition for searching table,
+// the arguments of the condition, and the expression telling whether a row
+// carries a file. Without the FTS5 index every word must appear in the text.
+func (s *sqlStore) searchSource(table, text string) (string, string, []interface{}, string) {
+	if s.dialect == "postgres" {
+		return table, "search_vector @@ plainto_tsquery('simple', ?)", []interface{}{text}, "has_file"
+	}
+	if !s.fullText {
+		var conds []string
+		var args []interface{}
+		for _, word := range strings.Fields(text) {
+			conds = append(conds, sqliteSearchText("content")+` LIKE ? ESCAPE '\'`)
+			args = append(args, likePattern(word))
+		}
+		return table, strings.Join(conds, " AND "), args, sqliteHasFile("content")
+	}
+	fts := table + "_fts"
+	return table + " JOIN " + fts + " ON " + fts + ".rowid = " + table + ".search_id",
+		fts + " MATCH ?", []interface{}{ftsQuery(text)}, fts + ".has_file"
+}
+
+// searchFilters returns the conditions shared by direct and group searches
+func searchFilters(q searchQuery, hasFile string) (string, []interface{}) {
+	var conds strings.Builder
+	var args []interface{}
+	if q.FromID != "" {
+		conds.WriteString(" AND from_id = ?")
+		args = append(args, q.FromID)
+	}
+	if q.Since != nil {
+		conds.WriteString(" AND timestamp >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if q.Until != nil {
+		conds.WriteString(" AND timestamp <= ?")
+		args = append(args, q.Until.UTC())
+	}
+	if q.HasFile {
+		conds.WriteString(" AND " + hasFile + " = TRUE")
+	}
+	return conds.String(), args
+}
+
+func (s *sqlStore) SearchMessages(userID string, q searchQuery) ([]Message, []GroupMessage, error) {
+	var messages []Message
+	if q.GroupID == "" {
+		from, match, args, hasFile := s.searchSource("messages", q.Text)
+		filters, filterArgs := searchFilters(q, hasFile)
+		args = append(append(args, userID, userID, userID), filterArgs...)
+		var err error
+		messages, err = s.queryMessages(
+			"SELECT "+messageColumns+" FROM "+from+
+				" WHERE "+match+" AND (from_id = ? OR to_id = ?)"+visibleMessage+filters+
+				" ORDER BY timestamp DESC LIMIT ?",
+			append(args, q.Limit)...,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	from, match, args, hasFile := s.searchSource("group_messages", q.Text)
+	filters, filterArgs := searchFilters(q, hasFile)
+	where := match + " AND group_id IN (SELECT group_id FROM group_members WHERE user_id = ? AND is_banned = FALSE)"
+	args = append(args, userID)
+	if q.GroupID != "" {
+		where += " AND group_id = ?"
+		args = append(args, q.GroupID)
+	}
+	args = append(append(args, filterArgs...), q.Limit)
+	groupMessages, err := s.queryGroupMessages(
+		"SELECT "+s.groupMessageColumns()+" FROM "+from+
+			" WHERE "+where+filters+" ORDER BY timestamp DESC LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return messages, groupMessages, nil
+}
+
+func (s *sqlStore) GetGroupMessagesAfterSeq(groupID string, afterSeq int64, limit int) ([]GroupMessage, bool, error) {
+	messages, err := s.queryGroupMessages(
+		"SELECT "+s.groupMessageColumns()+" FROM group_messages WHERE group_id = ? AND seq > ? ORDER BY seq LIMIT ?",
+		groupID, afterSeq, limit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	messages, hasMore := trimSeqPage(messages, limit)
+	return messages, hasMore, nil
+}
+
+// Sync cursors
+
+func (s *sqlStore) GetSyncCursors(userID, deviceID string) (map[string]int64, error) {
+	rows, err := s.query(
+		"SELECT conversation_id, seq FROM sync_cursors WHERE user_id = ? AND device_id = ?",
+		userID, deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cursors := make(map[string]int64)
+	for rows.Next() {
+		var conversationID string
+		var seq int64
+		if err := rows.Scan(&conversationID, &seq); err != nil {
+			return nil, err
+		}
+		cursors[conversationID] = seq
+	}
+	return cursors, rows.Err()
+}
+
+func (s *sqlStore) SaveSyncCursors(userID, deviceID string, cursors map[string]int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for conversationID, seq := range cursors {
+		_, err := tx.Exec(s.rebind(
+			`INSERT INTO sync_cursors (user_id, device_id, conversation_id, seq, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, device_id, conversation_id) DO UPDATE SET seq = excluded.seq, updated_at = excluded.updated_at`),
+			userID, deviceID, conversationID, seq, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Message edits
+
+const editColumns = "seq, message_id, group_id, from_id, to_id, previous_content, content, edited_at, hidden"
+
+func scanEdit(row rowScanner) (MessageEdit, error) {
+	var e MessageEdit
+	err := row.Scan(&e.Seq, &e.MessageID, &e.GroupID, &e.FromID, &e.ToID, &e.PreviousContent, &e.Content, &e.EditedAt, &e.Hidden)
+	return e, err
+}
+
+func (s *sqlStore) queryEdits(query string, args ...interface{}) ([]MessageEdit, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		e, err := scanEdit(rows)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+func (s *sqlStore) EditMessage(groupID, messageID, content string, editedAt time.Time, hidden bool) (MessageEdit, error) {
+	edit := MessageEdit{
+		MessageID: messageID,
+		GroupID:   groupID,
+		Content:   content,
+		EditedAt:  editedAt.UTC(),
+		Hidden:    hidden,
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return edit, err
+	}
+	defer tx.Rollback()
+
+	table := "messages"
+	if groupID == "" {
+		err = tx.QueryRow(s.rebind("SELECT from_id, to_id, content FROM messages WHERE id = ?"+s.forUpdate()), messageID).
+			Scan(&edit.FromID, &edit.ToID, &edit.PreviousContent)
+	} else {
+		table = "group_messages"
+		edit.ToID = groupID
+		err = tx.QueryRow(s.rebind("SELECT from_id, content FROM group_messages WHERE group_id = ? AND id = ?"+s.forUpdate()), groupID, messageID).
+			Scan(&edit.FromID, &edit.PreviousContent)
+	}
+	if err == sql.ErrNoRows {
+		return edit, ErrNotFound
+	}
+	if err != nil {
+		return edit, err
+	}
+
+	_, err = tx.Exec(s.rebind("UPDATE "+table+" SET content = ?, edited_at = ? WHERE id = ?"), content, edit.EditedAt, messageID)
+	if err != nil {
+		return edit, err
+	}
+	err = tx.QueryRow(s.rebind(
+		`INSERT INTO message_edits (message_id, group_id, from_id, to_id, previous_content, content, edited_at, hidden)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING seq`),
+		edit.MessageID, edit.GroupID, edit.FromID, edit.ToID, edit.PreviousContent, edit.Content, edit.EditedAt, edit.Hidden,
+	).Scan(&edit.Seq)
+	if err != nil {
+		return edit, err
+	}
+	return edit, tx.Commit()
+}
+
+func (s *sqlStore) GetMessageEdits(groupID, messageID string) ([]MessageEdit, error) {
+	return s.queryEdits(
+		"SELECT "+editColumns+" FROM message_edits WHERE group_id = ? AND message_id = ? ORDER BY seq",
+		groupID, messageID,
+	)
+}
+
+func (s *sqlStore) GetEditsSince(userID string, afterSeq int64, limit int) ([]MessageEdit, bool, error) {
+	edits, err := s.queryEdits(
+		"SELECT "+editColumns+" FROM message_edits WHERE seq > ?"+
+			" AND ((group_id = '' AND (from_id = ? OR to_id = ?) AND (hidden = FALSE OR from_id = ?))"+
+			" OR group_id IN (SELECT group_id FROM group_members WHERE user_id = ? AND is_banned = FALSE))"+
+			" ORDER BY seq LIMIT ?",
+		afterSeq, userID, userID, userID, userID, limit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	edits, hasMore := trimSeqPage(edits, limit)
+	return edits, hasMore, nil
+}
+
+func (s *sqlStore) LastEditSeq() (int64, error) {
+	var seq int64
+	err := s.queryRow("SELECT COALESCE(MAX(seq), 0) FROM message_edits").Scan(&seq)
+	return seq, err
+}
+
+// Users and sessions
+
+func (s *sqlStore) CreateUser(userID, passwordHash string) error {
+	result, err := s.exec(
+		"INSERT INTO users (id, password_hash, created_at) VALUES (?, ?, ?) ON CONFLICT (id) DO NOTHING",
+		userID, passwordHash, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+func (s *sqlStore) GetPasswordHash(userID string) (string, error) {
+	var hash string
+	err := s.queryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return hash, err
+}
+
+func (s *sqlStore) CreateSession(tokenHash, userID string, expiresAt time.Time) error {
+	_, err := s.exec(
+		"INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		tokenHash, userID, time.Now().UTC(), expiresAt.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) GetSession(tokenHash string) (string, time.Time, error) {
+	var userID string
+	var expiresAt time.Time
+	err := s.queryRow("SELECT user_id, expires_at FROM sessions WHERE token_hash = ?", tokenHash).Scan(&userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", expiresAt, ErrNotFound
+	}
+	return userID, expiresAt, err
+}
+
+func (s *sqlStore) DeleteSession(tokenHash string) error {
+	_, err := s.exec("DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+// Issued user ids
+
+func (s *sqlStore) ReserveID(id, claimHash string, claimExpiresAt time.Time) (bool, error) {
+	result, err := s.exec(
+		"INSERT INTO user_ids (id, issued_at, claim_hash, claim_expires_at) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO NOTHING",
+		id, time.Now().UTC(), claimHash, claimExpiresAt.UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlStore) IsIssued(id string) (bool, error) {
+	var exists int
+	err := s.queryRow("SELECT 1 FROM user_ids WHERE id = ?", id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) GetClaim(id string) (string, time.Time, error) {
+	var claimHash string
+	var expiresAt time.Time
+	err := s.queryRow(
+		"SELECT claim_hash, claim_expires_at FROM user_ids WHERE id = ? AND claim_hash IS NOT NULL", id,
+	).Scan(&claimHash, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, ErrNotFound
+	}
+	return claimHash, expiresAt, err
+}
+
+func (s *sqlStore) SetClaim(id, claimHash string, expiresAt time.Time) error {
+	result, err := s.exec(
+		"UPDATE user_ids SET claim_hash = ?, claim_expires_at = ? WHERE id = ? AND id NOT IN (SELECT id FROM users)",
+		claimHash, expiresAt.UTC(), id,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Contacts and blocks
+
+func (s *sqlStore) GetContacts(ownerID string) ([]Contact, error) {
+	rows, err := s.query(
+		"SELECT contact_id, nickname, created_at FROM contacts WHERE owner_id = ? ORDER BY created_at, contact_id",
+		ownerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var contact Contact
+		if err := rows.Scan(&contact.ContactID, &contact.Nickname, &contact.AddedAt); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+func (s *sqlStore) SaveContact(ownerID, contactID, nickname string) (Contact, error) {
+	_, err := s.exec(
+		`INSERT INTO contacts (owner_id, contact_id, nickname, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (owner_id, contact_id) DO UPDATE SET nickname = excluded.nickname`,
+		ownerID, contactID, nickname, time.Now().UTC(),
+	)
+	if err != nil {
+		return Contact{}, err
+	}
+
+	contact := Contact{ContactID: contactID}
+	err = s.queryRow(
+		"SELECT nickname, created_at FROM contacts WHERE owner_id = ? AND contact_id = ?",
+		ownerID, contactID,
+	).Scan(&contact.Nickname, &contact.AddedAt)
+	return contact, err
+}
+
+func (s *sqlStore) RemoveContact(ownerID, contactID string) error {
+	return s.deleteOne("DELETE FROM contacts WHERE owner_id = ? AND contact_id = ?", ownerID, contactID)
+}
+
+func (s *sqlStore) GetBlocked(blockerID string) ([]BlockedUser, error) {
+	rows, err := s.query(
+		"SELECT blocked_id, created_at FROM blocks WHERE blocker_id = ? ORDER BY created_at, blocked_id",
+		blockerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := []BlockedUser{}
+	for rows.Next() {
+		var user BlockedUser
+		if err := rows.Scan(&user.UserID, &user.BlockedAt); err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, user)
+	}
+	return blocked, rows.Err()
+}
+
+func (s *sqlStore) Block(blockerID, blockedID string) error {
+	_, err := s.exec(
+		"INSERT INTO blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?) ON CONFLICT (blocker_id, blocked_id) DO NOTHING",
+		blockerID, blockedID, time.Now().UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) Unblock(blockerID, blockedID string) error {
+	return s.deleteOne("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerID, blockedID)
+}
+
+func (s *sqlStore) IsBlocked(blockerID, blockedID string) (bool, error) {
+	var exists int
+	err := s.queryRow("SELECT 1 FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlStore) IsContact(ownerID, contactID string) (bool, error) {
+	var exists int
+	err := s.queryRow("SELECT 1 FROM contacts WHERE owner_id = ? AND contact_id = ?", ownerID, contactID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Privacy settings
+
+func (s *sqlStore) GetPrivacy(userID string) (PrivacySettings, error) {
+	settings := defaultPrivacy
+	err := s.queryRow("SELECT presence FROM privacy_settings WHERE user_id = ?", userID).Scan(&settings.Presence)
+	if err == sql.ErrNoRows {
+		return defaultPrivacy, nil
+	}
+	return settings, err
+}
+
+func (s *sqlStore) SavePrivacy(userID string, settings PrivacySettings) error {
+	_, err := s.exec(
+		`INSERT INTO privacy_settings (user_id, presence, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET presence = excluded.presence, updated_at = excluded.updated_at`,
+		userID, settings.Presence, time.Now().UTC(),
+	)
+	return err
+}
+
+// deleteOne runs a DELETE and returns ErrNotFound if it removed nothing
+func (s *sqlStore) deleteOne(query string, args ...interface{}) error {
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Profiles
+
+const profileColumns = "id, display_name, avatar_url, bio, created_at"
+
+func scanProfile(row interface{ Scan(...interface{}) error }) (UserProfile, error) {
+	var p UserProfile
+	err := row.Scan(&p.UserID, &p.DisplayName, &p.AvatarURL, &p.Bio, &p.CreatedAt)
+	return p, err
+}
+
+func (s *sqlStore) GetProfile(userID string) (*UserProfile, error) {
+	profile, err := scanProfile(s.queryRow("SELECT "+profileColumns+" FROM users WHERE id = ?", userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (s *sqlStore) GetProfiles(userIDs []string) (map[string]UserProfile, error) {
+	profiles := make(map[string]UserProfile)
+	if len(userIDs) == 0 {
+		return profiles, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(userIDs)), ", ")
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+
+	rows, err := s.query("SELECT "+profileColumns+" FROM users WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		profile, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles[profile.UserID] = profile
+	}
+	return profiles, rows.Err()
+}
+
+func (s *sqlStore) UpdateProfile(userID string, update ProfileUpdate) (*UserProfile, error) {
+	// A NULL parameter keeps the current value
+	result, err := s.exec(
+		`UPDATE users SET display_name = COALESCE(?, display_name), avatar_url = COALESCE(?, avatar_url),
+		bio = COALESCE(?, bio) WHERE id = ?`,
+		update.DisplayName, update.AvatarURL, update.Bio, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetProfile(userID)
+}
+
+// Presence
+
+func (s *sqlStore) SetOnline(userID string) error {
+	_, err := s.exec(
+		`INSERT INTO user_presence (user_id, online) VALUES (?, TRUE)
+		ON CONFLICT (user_id) DO UPDATE SET online = TRUE`,
+		userID,
+	)
+	return err
+}
+
+func (s *sqlStore) SetOffline(userID string, lastSeen time.Time) error {
+	_, err := s.exec(
+		`INSERT INTO user_presence (user_id, online, last_seen) VALUES (?, FALSE, ?)
+		ON CONFLICT (user_id) DO UPDATE SET online = FALSE, last_seen = excluded.last_seen`,
+		userID, lastSeen.UTC(),
+	)
+	return err
+}
+
+func (s *sqlStore) IsOnline(userID string) (bool, error) {
+	var online bool
+	err := s.queryRow("SELECT online FROM user_presence WHERE user_id = ?", userID).Scan(&online)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return online, err
+}
+
+func (s *sqlStore) OnlineUsers() ([]string, error) {
+	return s.queryStrings("SELECT user_id FROM user_presence WHERE online = TRUE")
+}
+
+func (s *sqlStore) GetPresence(userID string) (PresenceInfo, error) {
+	info := PresenceInfo{State: stateAvailable}
+	var lastSeen sql.NullTime
+	err := s.queryRow(
+		"SELECT online, last_seen, state, status_text FROM user_presence WHERE user_id = ?", userID,
+	).Scan(&info.Online, &lastSeen, &info.State, &info.StatusText)
+	if err == sql.ErrNoRows {
+		return info, nil
+	}
+	if lastSeen.Valid {
+		info.LastSeen = &lastSeen.Time
+	}
+	return info, err
+}
+
+func (s *sqlStore) SetState(userID, state, statusText string) error {
+	_, err := s.exec(
+		`INSERT INTO user_presence (user_id, online, state, status_text) VALUES (?, FALSE, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET state = excluded.state, status_text = excluded.status_text`,
+		userID, state, statusText,
+	)
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// forEachStore runs test against fresh memory and SQLite stores
+func forEachStore(t *testing.T, test func(t *testing.T)) {
+	t.Run("memory", func(t *testing.T) {
+		useMemoryStore(t)
+		test(t)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		useSQLiteStore(t)
+		test(t)
+	})
+}
+
+func TestSequenceNumbersPerConversation(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		send := func(id, fromID, toID string) int64 {
+			t.Helper()
+			msg, err := messageStore.SaveMessage(Message{ID: id, FromID: fromID, ToID: toID, Content: id, Timestamp: time.Now()})
+			if err != nil {
+				t.Fatalf("saving %s: %v", id, err)
+			}
+			return msg.Seq
+		}
+		sendToGroup := func(id, groupID string) int64 {
+			t.Helper()
+			msg, err := groupStore.SaveGroupMessage(GroupMessage{ID: id, GroupID: groupID, FromID: "alice", Content: id, Timestamp: time.Now()})
+			if err != nil {
+				t.Fatalf("saving %s: %v", id, err)
+			}
+			return msg.Seq
+		}
+		for _, groupID := range []string{"GROUP_a", "GROUP_b"} {
+			if err := groupStore.CreateGroup(Group{ID: groupID, Name: groupID, CreatedBy: "alice", CreatedAt: time.Now()}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Both directions of a pair share one counter; other pairs and groups
+		// count on their own
+		got := []int64{
+			send("ab1", "alice", "bob"),
+			send("ba1", "bob", "alice"),
+			send("ac1", "alice", "carol"),
+			sendToGroup("ga1", "GROUP_a"),
+			send("ab2", "alice", "bob"),
+			sendToGroup("ga2", "GROUP_a"),
+			sendToGroup("gb1", "GROUP_b"),
+			send("ca1", "carol", "alice"),
+		}
+		want := []int64{1, 2, 1, 1, 3, 2, 1, 2}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("sequence numbers %v, want %v", got, want)
+				break
+			}
+		}
+
+		// A resubmission keeps its number and does not use up the next one
+		existing, err := messageStore.SaveMessage(Message{ID: "ab2", FromID: "alice", ToID: "bob", Content: "ab2", Timestamp: time.Now()})
+		if err != ErrDuplicateMessage || existing.Seq != 3 {
+			t.Errorf("resubmitting ab2 returned seq %d and %v, want 3 and ErrDuplicateMessage", existing.Seq, err)
+		}
+		if seq := send("ab3", "alice", "bob"); seq != 4 {
+			t.Errorf("the message after a resubmission got %d, want 4", seq)
+		}
+
+		after, hasMore, err := messageStore.GetMessagesAfterSeq("bob", "alice", 2, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != 2 || after[0].ID != "ab2" || after[1].ID != "ab3" || hasMore {
+			t.Errorf("messages after seq 2: %v (more: %v)", after, hasMore)
+		}
+	})
+}
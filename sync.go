@@ -0,0 +1,176 @@
+// sync.go - Incremental history sync for reconnecting clients
+package main
+
+import (
+	"log"
+	"maps"
+)
+
+// Clients that connect with ?sync=true skip the full history replay. They send
+// a sync frame with the highest sequence number they hold in each conversation
+// and get back only what they are missing, followed by a sync_complete frame.
+// The same frame fills a gap: a cursor just below the gap resends from there.
+// A cursor of 0 asks for a conversation from its start; a conversation left
+// out gets its newest page. Devices that connect with ?deviceId= have their
+// cursors remembered by the server, so they may leave out conversations they
+// have synced before.
+//
+// Edits to messages the client already holds are replayed from the edit log,
+// after the messages, starting at editCursor. A first sync without one starts
+// at the end of the log, as the messages it sends carry their edited content.
+
+// SyncRequest is the handshake frame sent by syncing clients
+type SyncRequest struct {
+	MessageType string           `json:"messageType"`          // "sync"
+	Cursors     map[string]int64 `json:"cursors"`              // contact or group id -> highest seq held
+	EditCursor  *int64           `json:"editCursor,omitempty"` // as returned by the last sync_complete
+}
+
+// SyncComplete ends a sync. Conversations listed in HasMore were cut short and
+// the client should sync again with the returned cursors.
+type SyncComplete struct {
+	MessageType string           `json:"messageType"` // "sync_complete"
+	Cursors     map[string]int64 `json:"cursors"`
+	HasMore     []string         `json:"hasMore"`
+	EditCursor  int64            `json:"editCursor"`
+	MoreEdits   bool             `json:"moreEdits,omitempty"`
+}
+
+// editCursorKey stores a device's edit cursor among its conversation cursors.
+// It cannot clash with a user id, which never contains the ":" that separates
+// the two users in conversation ids.
+const editCursorKey = ":edits"
+
+// record notes the cursor the client should send next time for a conversation
+func (s *SyncComplete) record(conversationID string, cursor int64, hasMore bool) {
+	if cursor > 0 {
+		s.Cursors[conversationID] = cursor
+	}
+	if hasMore {
+		s.HasMore = append(s.HasMore, conversationID)
+	}
+}
+
+// missingDirectMessages returns what the client lacks from a direct conversation.
+// Without a cursor that is the newest page; older history is on the REST API.
+func missingDirectMessages(userID, contactID string, cursor int64, hasCursor bool) ([]Message, bool, error) {
+	if hasCursor {
+		return messageStore.GetMessagesAfterSeq(userID, contactID, cursor, maxHistoryLimit)
+	}
+	messages, _, err := messageStore.GetMessagePage(userID, contactID, historyQuery{Limit: defaultHistoryLimit})
+	return messages, false, err
+}
+
+// missingGroupMessages is missingDirectMessages for a group
+func missingGroupMessages(groupID string, cursor int64, hasCursor bool) ([]GroupMessage, bool, error) {
+	if hasCursor {
+		return groupStore.GetGroupMessagesAfterSeq(groupID, cursor, maxHistoryLimit)
+	}
+	messages, err := groupStore.GetRecentGroupMessages(groupID, defaultHistoryLimit)
+	return messages, false, err
+}
+
+// handleSync sends a client the messages newer than its cursors
+func handleSync(client *Client, req SyncRequest) {
+	userID := client.ID
+	done := SyncComplete{
+		MessageType: "sync_complete",
+		Cursors:     make(map[string]int64),
+		HasMore:     []string{},
+	}
+
+	// Cursors sent by the client, 0 included, win over the ones remembered
+	// for the device
+	cursors := make(map[string]int64)
+	if client.DeviceID != "" {
+		stored, err := syncStore.GetSyncCursors(userID, client.DeviceID)
+		if err != nil {
+			log.Printf("Error loading sync cursors of %s/%s: %v", userID, client.DeviceID, err)
+		}
+		for conversationID, seq := range stored {
+			cursors[conversationID] = seq
+		}
+	}
+	for conversationID, seq := range req.Cursors {
+		if seq >= 0 {
+			cursors[conversationID] = seq
+		}
+	}
+	if req.EditCursor != nil {
+		cursors[editCursorKey] = *req.EditCursor
+	}
+
+	// The end of the log is taken before the messages are read, so no edit
+	// falls in between
+	editCursor, replayEdits := cursors[editCursorKey]
+	done.EditCursor = editCursor
+	if !replayEdits {
+		last, err := editStore.LastEditSeq()
+		if err != nil {
+			log.Printf("Error reading the edit log for %s: %v", userID, err)
+		}
+		done.EditCursor = last
+	}
+
+	contactIDs, err := messageStore.GetContactIDs(userID)
+	if err != nil {
+		log.Printf("Error listing conversations for %s: %v", userID, err)
+	}
+	for _, contactID := range contactIDs {
+		cursor, hasCursor := cursors[contactID]
+		messages, hasMore, err := missingDirectMessages(userID, contactID, cursor, hasCursor)
+		if err != nil {
+			log.Printf("Error syncing conversation %s for %s: %v", contactID, userID, err)
+			continue
+		}
+
+		sendDirectMessages(client, messages)
+
+		for _, msg := range messages {
+			cursor = max(cursor, msg.Seq)
+		}
+		done.record(contactID, cursor, hasMore)
+	}
+
+	groupIDs, err := groupStore.GetUserGroupIDs(userID)
+	if err != nil {
+		log.Printf("Error getting user groups: %v", err)
+	}
+	for _, groupID := range groupIDs {
+		cursor, hasCursor := cursors[groupID]
+		groupMessages, hasMore, err := missingGroupMessages(groupID, cursor, hasCursor)
+		if err != nil {
+			log.Printf("Error syncing group %s for %s: %v", groupID, userID, err)
+			continue
+		}
+
+		for _, groupMsg := range withSenderNames(groupMessages) {
+			client.SendWait(groupMessageForUser(groupMsg, userID))
+			cursor = max(cursor, groupMsg.Seq)
+		}
+		done.record(groupID, cursor, hasMore)
+	}
+
+	if replayEdits {
+		edits, hasMore, err := editStore.GetEditsSince(userID, done.EditCursor, maxHistoryLimit)
+		if err != nil {
+			log.Printf("Error syncing edits for %s: %v", userID, err)
+		}
+		for _, edit := range edits {
+			client.SendWait(edit.event())
+			done.EditCursor = edit.Seq
+		}
+		done.MoreEdits = hasMore
+	}
+
+	client.SendWait(done)
+
+	if client.DeviceID != "" {
+		saved := maps.Clone(done.Cursors)
+		saved[editCursorKey] = done.EditCursor
+		if err := syncStore.SaveSyncCursors(userID, client.DeviceID, saved); err != nil {
+			log.Printf("Error saving sync cursors of %s/%s: %v", userID, client.DeviceID, err)
+		}
+	}
+	log.Printf("Sync complete for %s: %d conversations, %d with more", userID, len(done.Cursors), len(done.HasMore))
+}
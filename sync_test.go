@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// syncOnce sends req over conn and returns the ids of the messages replayed
+// before the sync_complete frame, with edits listed as "edited <id>", and
+// that frame
+func syncOnce(t *testing.T, conn *websocket.Conn, req SyncRequest) (string, SyncComplete) {
+	t.Helper()
+	req.MessageType = "sync"
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame struct {
+			SyncComplete
+			ID string `json:"id"`
+		}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("waiting for sync_complete: %v", err)
+		}
+		switch frame.MessageType {
+		case "":
+			ids = append(ids, frame.ID)
+		case "message_edited":
+			ids = append(ids, "edited "+frame.ID)
+		case "sync_complete":
+			return strings.Join(ids, ","), frame.SyncComplete
+		}
+	}
+}
+
+func TestSyncSendsOnlyWhatIsMissing(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+
+	save := func(ids ...string) {
+		t.Helper()
+		for _, id := range ids {
+			if _, err := messageStore.SaveMessage(Message{ID: id, FromID: alice.UserID, ToID: bob.UserID, Content: id, Timestamp: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	save("m1", "m2", "m3")
+	group := Group{ID: testGroup, Name: "Test", CreatedBy: alice.UserID, CreatedAt: time.Now()}
+	if err := groupStore.CreateGroup(group, []string{bob.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := groupStore.SaveGroupMessage(GroupMessage{ID: "g1", GroupID: testGroup, FromID: alice.UserID, Content: "g1", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A first sync without cursors gets the newest page of every conversation
+	conn := dialQuery(t, addr, bob, "&sync=true&deviceId=phone")
+	ids, done := syncOnce(t, conn, SyncRequest{})
+	if ids != "m1,m2,m3,g1" {
+		t.Errorf("first sync sent %s", ids)
+	}
+	if done.Cursors[alice.UserID] != 3 || done.Cursors[testGroup] != 1 || len(done.HasMore) != 0 {
+		t.Errorf("first sync completed with %+v", done)
+	}
+	conn.Close()
+
+	// After reconnecting, the device's stored cursors leave out what it has
+	save("m4", "m5")
+	conn = dialQuery(t, addr, bob, "&sync=true&deviceId=phone")
+	ids, done = syncOnce(t, conn, SyncRequest{})
+	if ids != "m4,m5" {
+		t.Errorf("sync after reconnecting sent %s", ids)
+	}
+	if done.Cursors[alice.UserID] != 5 || done.Cursors[testGroup] != 1 {
+		t.Errorf("sync after reconnecting completed with %+v", done)
+	}
+
+	// Cursors sent by the client win; 0 resends a conversation from its start
+	ids, _ = syncOnce(t, conn, SyncRequest{Cursors: map[string]int64{alice.UserID: 3}})
+	if ids != "m4,m5" {
+		t.Errorf("sync from cursor 3 sent %s", ids)
+	}
+	ids, _ = syncOnce(t, conn, SyncRequest{Cursors: map[string]int64{alice.UserID: 0, testGroup: 0}})
+	if ids != "m1,m2,m3,m4,m5,g1" {
+		t.Errorf("sync from cursor 0 sent %s", ids)
+	}
+
+	// Another device of the same user starts without stored cursors
+	other := dialQuery(t, addr, bob, "&sync=true&deviceId=laptop")
+	if ids, _ := syncOnce(t, other, SyncRequest{}); ids != "m1,m2,m3,m4,m5,g1" {
+		t.Errorf("first sync of another device sent %s", ids)
+	}
+}
+
+func TestSyncPagesLongConversations(t *testing.T) {
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+
+	for i := 0; i < maxHistoryLimit+3; i++ {
+		msg := Message{ID: fmt.Sprintf("m%d", i), FromID: alice.UserID, ToID: bob.UserID, Content: "hi", Timestamp: time.Now()}
+		if _, err := messageStore.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := dialQuery(t, addr, bob, "&sync=true")
+	_, done := syncOnce(t, conn, SyncRequest{Cursors: map[string]int64{alice.UserID: 0}})
+	if done.Cursors[alice.UserID] != maxHistoryLimit || len(done.HasMore) != 1 || done.HasMore[0] != alice.UserID {
+		t.Fatalf("first page completed with cursor %d and hasMore %v", done.Cursors[alice.UserID], done.HasMore)
+	}
+	ids, done := syncOnce(t, conn, SyncRequest{Cursors: done.Cursors})
+	if strings.Count(ids, ",") != 2 || len(done.HasMore) != 0 {
+		t.Errorf("second page sent %s with hasMore %v", ids, done.HasMore)
+	}
+}
@@ -0,0 +1,204 @@
+// typing.go - Ephemeral "is typing" indicators for direct and group chats
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A client sends {"messageType":"typing","toId":...,"typing":true} while the
+// user types and typing:false when they stop. The server passes these on to
+// the direct peer or the online members of a group and never stores them.
+//
+// Clients repeat typing:true every few seconds while the user keeps typing.
+// The server forwards at most one of those per Throttle for each device and
+// chat, and sends typing:false itself when no refresh arrived for Timeout,
+// when the device sends the message, or when it disconnects. Receivers get
+// expiresInMs with every start so they can clear an indicator whose stop was
+// lost. Like presence updates, typing frames are dropped for receivers whose
+// send queue is full.
+
+// typingConfig holds the tunables for typing indicators
+type typingConfig struct {
+	Throttle time.Duration // minimum time between forwarded refreshes
+	Timeout  time.Duration // silence after which typing stops by itself
+}
+
+var typingSettings = typingConfig{
+	Throttle: 3 * time.Second,
+	Timeout:  6 * time.Second,
+}
+
+// TypingRequest is sent by a client when its user starts or stops typing
+type TypingRequest struct {
+	MessageType string `json:"messageType"` // "typing"
+	ToID        string `json:"toId"`        // user id or GROUP_ id
+	Typing      bool   `json:"typing"`
+}
+
+// TypingEvent tells the other side of a chat that a user is typing
+type TypingEvent struct {
+	MessageType string `json:"messageType"` // "typing"
+	FromID      string `json:"fromId"`
+	ToID        string `json:"toId"` // the receiver's id, or the group for group chats
+	Typing      bool   `json:"typing"`
+	ExpiresInMs int64  `json:"expiresInMs,omitempty"` // set when typing starts
+}
+
+// typingKey identifies one device typing in one chat
+type typingKey struct {
+	client *Client
+	toID   string
+}
+
+// typingState is an indicator currently shown to the other side
+type typingState struct {
+	forwardedAt time.Time
+	expiry      *time.Timer
+}
+
+var typingIndicators = struct {
+	sync.Mutex
+	active map[typingKey]*typingState
+}{
+	active: make(map[typingKey]*typingState),
+}
+
+// handleTyping applies a typing frame from client
+func handleTyping(client *Client, req TypingRequest) {
+	if req.ToID == "" || req.ToID == client.ID {
+		sendNack(client, "", nackInvalidPayload, "Typing needs another user or a group in toId")
+		return
+	}
+	if !req.Typing {
+		stopTyping(client, req.ToID, true)
+		return
+	}
+
+	if strings.HasPrefix(req.ToID, "GROUP_") {
+		member, err := activeMember(client.ID, req.ToID)
+		if err != nil {
+			sendNack(client, "", nackNotMember, "You are not a member of this group")
+			return
+		}
+		if member.IsMuted {
+			sendNack(client, "", nackMuted, "You are muted in this group")
+			return
+		}
+	} else if blockedBy(req.ToID, client.ID) {
+		// Dropped without telling, as messages are
+		return
+	}
+
+	key := typingKey{client, req.ToID}
+	now := time.Now()
+
+	typingIndicators.Lock()
+	state := typingIndicators.active[key]
+	if state != nil {
+		state.expiry.Reset(typingSettings.Timeout)
+		if now.Sub(state.forwardedAt) < typingSettings.Throttle {
+			typingIndicators.Unlock()
+			return
+		}
+		state.forwardedAt = now
+	} else {
+		state = &typingState{forwardedAt: now}
+		state.expiry = time.AfterFunc(typingSettings.Timeout, func() {
+			expireTyping(key, state)
+		})
+		typingIndicators.active[key] = state
+	}
+	typingIndicators.Unlock()
+
+	forwardTyping(client.ID, req.ToID, true)
+}
+
+// stopTyping ends the indicator of client in the chat with toID. The other
+// side is told only when notify is set; a sent message ends it by itself.
+func stopTyping(client *Client, toID string, notify bool) {
+	key := typingKey{client, toID}
+
+	typingIndicators.Lock()
+	state := typingIndicators.active[key]
+	if state != nil {
+		state.expiry.Stop()
+		delete(typingIndicators.active, key)
+	}
+	typingIndicators.Unlock()
+
+	if state != nil && notify {
+		forwardTyping(client.ID, toID, false)
+	}
+}
+
+// stopAllTyping ends every indicator of a disconnecting client
+func stopAllTyping(client *Client) {
+	typingIndicators.Lock()
+	var toIDs []string
+	for key, state := range typingIndicators.active {
+		if key.client == client {
+			state.expiry.Stop()
+			delete(typingIndicators.active, key)
+			toIDs = append(toIDs, key.toID)
+		}
+	}
+	typingIndicators.Unlock()
+
+	for _, toID := range toIDs {
+		forwardTyping(client.ID, toID, false)
+	}
+}
+
+// expireTyping ends an indicator that was not refreshed in time, unless it
+// was replaced or stopped meanwhile
+func expireTyping(key typingKey, state *typingState) {
+	typingIndicators.Lock()
+	current := typingIndicators.active[key] == state
+	if current {
+		delete(typingIndicators.active, key)
+	}
+	typingIndicators.Unlock()
+
+	if current {
+		forwardTyping(key.client.ID, key.toID, false)
+	}
+}
+
+// forwardTyping sends a typing change of fromID to the peer or the online
+// members of the group toID
+func forwardTyping(fromID, toID string, typing bool) {
+	event := TypingEvent{
+		MessageType: "typing",
+		FromID:      fromID,
+		ToID:        toID,
+		Typing:      typing,
+	}
+	if typing {
+		event.ExpiresInMs = typingSettings.Timeout.Milliseconds()
+	}
+
+	if !strings.HasPrefix(toID, "GROUP_") {
+		sendTypingEvent(toID, event)
+		return
+	}
+	memberIDs, err := groupStore.GetActiveMemberIDs(toID)
+	if err != nil {
+		log.Printf("Error loading members of %s for typing indicator: %v", toID, err)
+		return
+	}
+	for _, memberID := range memberIDs {
+		if memberID != fromID {
+			sendTypingEvent(memberID, event)
+		}
+	}
+}
+
+// sendTypingEvent queues a typing event on the connected devices of a user
+func sendTypingEvent(userID string, event TypingEvent) {
+	for _, device := range userClients(userID) {
+		device.SendPresence(event)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// readTyping collects the typing events on conn up to and including the
+// first stop, with the time each arrived
+func readTyping(t *testing.T, conn *websocket.Conn) (string, time.Time) {
+	t.Helper()
+	var events string
+	for {
+		frame := readUntil(t, conn, func(frame map[string]interface{}) bool { return frame["messageType"] == "typing" })
+		if frame["typing"] == true {
+			events += fmt.Sprintf("start(%v) ", frame["expiresInMs"])
+			continue
+		}
+		return events + "stop", time.Now()
+	}
+}
+
+func TestTypingThrottleAndExpiry(t *testing.T) {
+	saved := typingSettings
+	typingSettings = typingConfig{Throttle: 200 * time.Millisecond, Timeout: 400 * time.Millisecond}
+	t.Cleanup(func() { typingSettings = saved })
+
+	app := newTestApp(t)
+	alice, bob := registerUser(t, app), registerUser(t, app)
+	addr := serve(t, app)
+	aliceConn, bobConn := dialQuery(t, addr, alice, "&sync=true"), dialQuery(t, addr, bob, "&sync=true")
+	typing := func(on bool) {
+		sendFrame(t, aliceConn, TypingRequest{MessageType: "typing", ToID: bob.UserID, Typing: on})
+	}
+
+	// Refreshes within the throttle are not forwarded; without refreshes the
+	// indicator stops by itself
+	typing(true)
+	typing(true)
+	typing(true)
+	time.Sleep(250 * time.Millisecond)
+	typing(true)
+	lastRefresh := time.Now()
+	events, stoppedAt := readTyping(t, bobConn)
+	if events != "start(400) start(400) stop" {
+		t.Errorf("bob saw %s", events)
+	}
+	if waited := stoppedAt.Sub(lastRefresh); waited < 350*time.Millisecond {
+		t.Errorf("typing expired %v after the last refresh, before the timeout", waited)
+	}
+
+	// An explicit stop is forwarded right away
+	typing(true)
+	typing(false)
+	if events, _ := readTyping(t, bobConn); events != "start(400) stop" {
+		t.Errorf("bob saw %s", events)
+	}
+
+	// Typing in a group needs membership
+	sendFrame(t, aliceConn, TypingRequest{MessageType: "typing", ToID: "GROUP_other", Typing: true})
+	nack := readUntil(t, aliceConn, func(frame map[string]interface{}) bool { return frame["messageType"] == "nack" })
+	if nack["code"] != nackNotMember {
+		t.Errorf("typing in a foreign group: %v", nack)
+	}
+}